@@ -1,21 +1,22 @@
 package text
 
 import (
+	"bufio"
 	"os"
 )
 
 const EOF = 0
 
 type InStream struct {
-	stream *os.File
+	stream *bufio.Reader
 }
 
 func NewInStream(path string) *InStream {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0222)
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return &InStream{}
 	}
-	return &InStream{f}
+	return &InStream{bufio.NewReader(f)}
 }
 
 func (is *InStream) IsOpen() bool {
@@ -23,12 +24,27 @@ func (is *InStream) IsOpen() bool {
 }
 
 func (is *InStream) GetChar() byte {
-	buf := make([]byte, 1)
-	_, err := is.stream.Read(buf)
-	panic(err)
+	c, err := is.stream.ReadByte()
+	if err != nil {
+		return EOF
+	}
+	return c
+}
+
+// Get next char without consuming it, return EOF at the end of stream
+func (is *InStream) PeekChar() byte {
+	buf, err := is.stream.Peek(1)
+	if err != nil {
+		return EOF
+	}
 	return buf[0]
 }
 
+// Read bytes of stream, InStream can be used as io.Reader
+func (is *InStream) Read(p []byte) (int, error) {
+	return is.stream.Read(p)
+}
+
 type InStringStream struct {
 	str string
 	pos int
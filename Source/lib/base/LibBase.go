@@ -7,32 +7,56 @@ import (
 	"os"
 )
 
+// Convert value at index of stack to string, the __tostring
+// metamethod of the value is used when it is existed
+func toString(state *State, api *StackAPI, index int) string {
+	v := *api.GetValue(index)
+	if v.Type() == ValueTUpvalue {
+		v = *v.Upvalue().GetValue()
+	}
+
+	metaMethod := state.GetMetaMethod(&v, "__tostring")
+	if !metaMethod.IsNil() {
+		f := api.GetStackSize()
+		api.PushValue(metaMethod)
+		api.PushValue(v)
+		api.Call(f, 1, 1)
+		if !api.IsString(f) {
+			panic(NewCallCFuncError("'__tostring' must return a string"))
+		}
+		return api.GetCString(f)
+	}
+
+	switch v.Type() {
+	case ValueTNil:
+		return "nil"
+	case ValueTBool:
+		return fmt.Sprintf("%t", v.Bool())
+	case ValueTNumber:
+		return NumberToString(&v)
+	case ValueTString:
+		return v.Str().GetStdString()
+	case ValueTClosure:
+		return fmt.Sprintf("function:\t%p", v.Closure())
+	case ValueTTable:
+		return fmt.Sprintf("table:\t%p", v.Table())
+	case ValueTUserData:
+		return fmt.Sprintf("userdata:\t%p", v.UserData())
+	case ValueTCFunction:
+		return fmt.Sprintf("function:\t%p", v.CFunc())
+	case ValueTThread:
+		return fmt.Sprintf("thread:\t%p", v.Thread())
+	default:
+		return ""
+	}
+}
+
 func print(state *State) int {
 	api := NewStackAPI(state)
 	params := api.GetStackSize()
 
 	for i := 0; i < params; i++ {
-		vType := api.GetValueType(i)
-
-		switch vType {
-		case ValueTNil:
-			fmt.Printf("nil")
-		case ValueTBool:
-			fmt.Printf("%t", api.GetBool(i))
-		case ValueTNumber:
-			fmt.Printf("%.14g", api.GetNumber(i))
-		case ValueTString:
-			fmt.Printf("%s", api.GetCString(i))
-		case ValueTClosure:
-			fmt.Printf("function:\t%p", api.GetClosure(i))
-		case ValueTTable:
-			fmt.Printf("table:\t%p", api.GetTable(i))
-		case ValueTUserData:
-			fmt.Printf("userdata:\t%p", api.GetUserData(i))
-		case ValueTCFunction:
-			fmt.Printf("function:\t%p", api.GetCFunction(i))
-		default:
-		}
+		fmt.Printf("%s", toString(state, api, i))
 
 		if i != params-1 {
 			fmt.Printf("\t")
@@ -43,9 +67,19 @@ func print(state *State) int {
 	return 0
 }
 
+func tostring(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	api.PushString(toString(state, api, 0))
+	return 1
+}
+
 func puts(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTString) {
+	if !api.CheckArgs1(1, ValueTString) {
 		return 0
 	}
 
@@ -61,10 +95,10 @@ func dataType(state *State) int {
 
 	v := api.GetValue(0)
 	var vType int
-	if v.Type == ValueTUpvalue {
-		vType = v.Upvalue.GetValue().Type
+	if v.Type() == ValueTUpvalue {
+		vType = v.Upvalue().GetValue().Type()
 	} else {
-		vType = v.Type
+		vType = v.Type()
 	}
 
 	switch vType {
@@ -80,6 +114,8 @@ func dataType(state *State) int {
 		api.PushString("table")
 	case ValueTUserData:
 		api.PushString("userdata")
+	case ValueTThread:
+		api.PushString("thread")
 	case ValueTClosure, ValueTCFunction:
 		api.PushString("function")
 	default:
@@ -96,12 +132,12 @@ func doIPairs(state *State) int {
 	}
 
 	t := api.GetTable(0)
-	num := api.GetNumber(1) + 1
+	num := api.GetInteger(1) + 1
 
-	k := NewValueNum(num)
+	k := NewValueInt(num)
 	v := t.GetValue(k)
 
-	if v.Type == ValueTNil {
+	if v.Type() == ValueTNil {
 		return 0
 	}
 
@@ -112,46 +148,52 @@ func doIPairs(state *State) int {
 
 func iPairs(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTTable) {
+	if !api.CheckArgs1(1, ValueTTable) {
 		return 0
 	}
 
 	t := api.GetTable(0)
 	api.PushCFunction(doIPairs)
 	api.PushTable(t)
-	api.PushNumber(0)
+	api.PushInteger(0)
 	return 3
 }
 
-func doPairs(state *State) int {
+func next(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(2, ValueTTable) {
+	if !api.CheckArgs1(1, ValueTTable) {
 		return 0
 	}
 
 	t := api.GetTable(0)
-	lastKey := api.GetValue(1)
+	var key Value
+	if api.GetStackSize() > 1 {
+		key = *api.GetValue(1)
+	}
 
-	var key, value Value
-	if lastKey.Type == ValueTNil {
-		t.FirstKeyValue(&key, &value)
-	} else {
-		t.NextKeyValue(lastKey, &key, &value)
+	var nextKey, nextValue Value
+	if !t.Next(key, &nextKey, &nextValue) {
+		panic(NewCallCFuncError("invalid key to 'next'"))
+	}
+
+	if nextKey.IsNil() {
+		api.PushNil()
+		return 1
 	}
 
-	api.PushValue(key)
-	api.PushValue(value)
+	api.PushValue(nextKey)
+	api.PushValue(nextValue)
 	return 2
 }
 
 func pairs(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTTable) {
+	if !api.CheckArgs1(1, ValueTTable) {
 		return 0
 	}
 
 	t := api.GetTable(0)
-	api.PushCFunction(doPairs)
+	api.PushCFunction(next)
 	api.PushTable(t)
 	api.PushNil()
 	return 3
@@ -166,7 +208,7 @@ func getLine(state *State) int {
 
 func require(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTString) {
+	if !api.CheckArgs1(1, ValueTString) {
 		return 0
 	}
 
@@ -178,13 +220,179 @@ func require(state *State) int {
 	return 0
 }
 
+func raiseError(state *State) int {
+	api := NewStackAPI(state)
+	params := api.GetStackSize()
+
+	level := 1
+	if params > 1 {
+		if !api.IsNumber(1) {
+			api.ArgTypeError(1, ValueTNumber)
+			return 0
+		}
+		level = int(api.GetNumber(1))
+	}
+
+	var value Value
+	if params > 0 {
+		value = *api.GetValue(0)
+	}
+
+	// Add position information to the message
+	if value.Type() == ValueTString && level > 0 {
+		if module, line, ok := state.GetCallPos(level); ok {
+			msg := fmt.Sprintf("%s:%d: %s", module, line, value.Str().GetCStr())
+			value = NewValueString(state.GetString(msg))
+		}
+	}
+
+	state.ThrowError(value)
+	return 0
+}
+
+func pcall(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	// Results or error value are placed from index 0
+	params := api.GetStackSize()
+	err := api.ProtectedCallK(0, params-1, ExpValueCountAny, nil, 0, finishPCall)
+	return finishPCall(state, err, 0)
+}
+
+func xpcall(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(2) {
+		return 0
+	}
+
+	params := api.GetStackSize()
+	handler := *api.GetValue(1)
+
+	// Push function and its arguments to top of stack
+	api.PushValue(*api.GetValue(0))
+	for i := 2; i < params; i++ {
+		api.PushValue(*api.GetValue(i))
+	}
+
+	// Results or error value are placed from index params
+	err := api.ProtectedCallK(params, params-2, ExpValueCountAny, &handler, params, finishPCall)
+	return finishPCall(state, err, params)
+}
+
+// Finish pcall and xpcall after the protected call returned or failed,
+// results or error value of the call are placed from index 'ctx'
+func finishPCall(state *State, err error, ctx interface{}) int {
+	api := NewStackAPI(state)
+	index := ctx.(int)
+	api.InsertValue(index, NewValueBValue(err == nil))
+	return api.GetStackSize() - index
+}
+
+func setMetaTable(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(2, ValueTTable) {
+		return 0
+	}
+
+	var metaTable *Table
+	if api.IsTable(1) {
+		metaTable = api.GetTable(1)
+	} else if api.GetValueType(1) != ValueTNil {
+		api.ArgTypeError(1, ValueTTable)
+		return 0
+	}
+
+	t := api.GetTable(0)
+	if protected := state.GetMetaMethod(api.GetValue(0), "__metatable"); !protected.IsNil() {
+		panic(NewCallCFuncError("cannot change a protected metatable"))
+	}
+
+	t.SetMetaTable(metaTable)
+
+	api.PushTable(t)
+	return 1
+}
+
+func getMetaTable(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	v := api.GetValue(0)
+	metaTable := state.GetValueMetaTable(v)
+	if metaTable == nil {
+		api.PushNil()
+	} else if protected := state.GetMetaMethod(v, "__metatable"); !protected.IsNil() {
+		// Protected metaTable is hidden by the __metatable field
+		api.PushValue(protected)
+	} else {
+		api.PushTable(metaTable)
+	}
+	return 1
+}
+
+// Names of GC modes for collectgarbage
+var gcModeNames = map[int]string{
+	GCModeGenerational: "generational",
+	GCModeIncremental:  "incremental",
+}
+
+func collectGarbage(state *State) int {
+	api := NewStackAPI(state)
+	opt := "collect"
+	if api.GetStackSize() > 0 {
+		if !api.IsString(0) {
+			api.ArgTypeError(0, ValueTString)
+			return 0
+		}
+		opt = api.GetCString(0)
+	}
+
+	gc := state.GetGC()
+	switch opt {
+	case "collect":
+		state.FullGC()
+		api.PushInteger(0)
+	case "count":
+		// Estimated memory in use in Kbytes
+		api.PushNumber(float64(gc.GetObjectSize()) / 1024)
+	case "step":
+		api.PushBool(state.StepGC())
+	case "stop":
+		gc.Stop()
+		api.PushInteger(0)
+	case "restart":
+		gc.Restart()
+		api.PushInteger(0)
+	case "generational":
+		api.PushString(gcModeNames[gc.SetMode(GCModeGenerational)])
+	case "incremental":
+		api.PushString(gcModeNames[gc.SetMode(GCModeIncremental)])
+	default:
+		panic(NewCallCFuncError("bad argument #1 to 'collectgarbage' (invalid option '", opt, "')"))
+	}
+	return 1
+}
+
 func RegisterLibBase(state *State) {
 	lib := NewLibrary(state)
 	lib.RegisterFunc("print", print)
+	lib.RegisterFunc("tostring", tostring)
 	lib.RegisterFunc("puts", puts)
 	lib.RegisterFunc("ipairs", iPairs)
 	lib.RegisterFunc("pairs", pairs)
+	lib.RegisterFunc("next", next)
 	lib.RegisterFunc("type", dataType)
 	lib.RegisterFunc("getline", getLine)
 	lib.RegisterFunc("require", require)
+	lib.RegisterFunc("error", raiseError)
+	lib.RegisterFunc("pcall", pcall)
+	lib.RegisterFunc("xpcall", xpcall)
+	lib.RegisterFunc("setmetatable", setMetaTable)
+	lib.RegisterFunc("getmetatable", getMetaTable)
+	lib.RegisterFunc("collectgarbage", collectGarbage)
 }
@@ -0,0 +1,141 @@
+package coroutine
+
+import (
+	. "InterpreterVM/Source/vm"
+)
+
+func isFunction(api *StackAPI, index int) bool {
+	return api.IsClosure(index) || api.IsCFunction(index)
+}
+
+func create(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	if !isFunction(api, 0) {
+		api.ArgTypeError(0, ValueTClosure)
+		return 0
+	}
+
+	api.PushThread(state.NewCoroutine(*api.GetValue(0)))
+	return 1
+}
+
+func resume(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1, ValueTThread) {
+		return 0
+	}
+
+	params := api.GetStackSize()
+	args := make([]Value, 0, params-1)
+	for i := 1; i < params; i++ {
+		args = append(args, *api.GetValue(i))
+	}
+
+	results, err := state.Resume(api.GetThread(0), args)
+	if err != nil {
+		api.PushBool(false)
+		api.PushValue(state.ErrorToValue(err))
+		return 2
+	}
+
+	api.PushBool(true)
+	for _, v := range results {
+		api.PushValue(v)
+	}
+	return len(results) + 1
+}
+
+func yield(state *State) int {
+	api := NewStackAPI(state)
+	return api.Yield(api.GetStackSize())
+}
+
+func status(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1, ValueTThread) {
+		return 0
+	}
+
+	co := api.GetThread(0)
+	switch co.GetStatus() {
+	case ThreadStatusSuspended:
+		api.PushString("suspended")
+	case ThreadStatusRunning:
+		api.PushString("running")
+	case ThreadStatusNormal:
+		api.PushString("normal")
+	case ThreadStatusDead:
+		api.PushString("dead")
+	}
+	return 1
+}
+
+func wrap(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	if !isFunction(api, 0) {
+		api.ArgTypeError(0, ValueTClosure)
+		return 0
+	}
+
+	co := state.NewCoroutine(*api.GetValue(0))
+	resumeCo := func(state *State) int {
+		api := NewStackAPI(state)
+		params := api.GetStackSize()
+		args := make([]Value, 0, params)
+		for i := 0; i < params; i++ {
+			args = append(args, *api.GetValue(i))
+		}
+
+		// Error is propagated to the caller
+		results, err := state.Resume(co, args)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, v := range results {
+			api.PushValue(v)
+		}
+		return len(results)
+	}
+
+	// The coroutine is kept alive by the function value
+	api.PushValue(NewValueCFunctionWithObj(resumeCo, co))
+	return 1
+}
+
+func running(state *State) int {
+	api := NewStackAPI(state)
+	thread := state.GetCurrentThread()
+	api.PushThread(thread)
+	api.PushBool(thread.IsMain())
+	return 2
+}
+
+func isYieldable(state *State) int {
+	api := NewStackAPI(state)
+	api.PushBool(state.GetCurrentThread().IsYieldable())
+	return 1
+}
+
+func RegisterLibCoroutine(state *State) {
+	lib := NewLibrary(state)
+	table := []TableMemberReg{
+		*NewTableMemberRegCFunction("create", create),
+		*NewTableMemberRegCFunction("resume", resume),
+		*NewTableMemberRegCFunction("yield", yield),
+		*NewTableMemberRegCFunction("status", status),
+		*NewTableMemberRegCFunction("wrap", wrap),
+		*NewTableMemberRegCFunction("running", running),
+		*NewTableMemberRegCFunction("isyieldable", isYieldable),
+	}
+
+	lib.RegisterTableFunction("coroutine", &table[0], len(table))
+}
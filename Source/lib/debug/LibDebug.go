@@ -0,0 +1,34 @@
+package debug
+
+import (
+	. "InterpreterVM/Source/vm"
+)
+
+func traceback(state *State) int {
+	api := NewStackAPI(state)
+	params := api.GetStackSize()
+
+	// Return the message untouched when it is not a string or nil
+	if params > 0 && !api.IsString(0) && api.GetValueType(0) != ValueTNil {
+		api.PushValue(*api.GetValue(0))
+		return 1
+	}
+
+	// Skip the frame of traceback itself
+	str := FormatTraceback(state.GetTraceback(1))
+	if params > 0 && api.IsString(0) {
+		str = api.GetCString(0) + "\n" + str
+	}
+
+	api.PushString(str)
+	return 1
+}
+
+func RegisterLibDebug(state *State) {
+	lib := NewLibrary(state)
+	table := [1]TableMemberReg{
+		*NewTableMemberRegCFunction("traceback", traceback),
+	}
+
+	lib.RegisterTableFunction("debug", &table[0], len(table))
+}
@@ -49,7 +49,7 @@ func readByFormat(api *StackAPI, file *os.File, format string) {
 
 func ioclose(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTUserData) {
+	if !api.CheckArgs1(1, ValueTUserData) {
 		return 0
 	}
 
@@ -61,7 +61,7 @@ func ioclose(state *State) int {
 
 func flush(state *State) int {
 	//api := NewStackAPI(state)
-	//if !api.CheckArgs(1, ValueTUserData) {
+	//if !api.CheckArgs1(1, ValueTUserData) {
 	//	return 0
 	//}
 	//
@@ -73,7 +73,7 @@ func flush(state *State) int {
 
 func read(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTUserData) {
+	if !api.CheckArgs1(1, ValueTUserData) {
 		return 0
 	}
 
@@ -146,7 +146,7 @@ func setvbuf(state *State) int {
 
 func write(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTUserData) {
+	if !api.CheckArgs1(1, ValueTUserData) {
 		return 0
 	}
 
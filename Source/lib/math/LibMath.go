@@ -5,18 +5,36 @@ import (
 	"math"
 )
 
+// Push float 'f' as integer when it has an integer value which
+// fits in integer, otherwise push it as float
+func pushFloatAsInteger(api *StackAPI, f float64) {
+	if math.Floor(f) == f && f >= math.MinInt64 && f < -math.MinInt64 {
+		api.PushInteger(int64(f))
+	} else {
+		api.PushNumber(f)
+	}
+}
+
 func abs(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
-	api.PushNumber(math.Abs(api.GetNumber(0)))
+	if api.IsInteger(0) {
+		n := api.GetInteger(0)
+		if n < 0 {
+			n = -n
+		}
+		api.PushInteger(n)
+	} else {
+		api.PushNumber(math.Abs(api.GetNumber(0)))
+	}
 	return 1
 }
 
 func acos(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Acos(api.GetNumber(0)))
@@ -25,7 +43,7 @@ func acos(state *State) int {
 
 func asin(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Asin(api.GetNumber(0)))
@@ -34,7 +52,7 @@ func asin(state *State) int {
 
 func atan(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Atan(api.GetNumber(0)))
@@ -43,16 +61,20 @@ func atan(state *State) int {
 
 func ceil(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
-	api.PushNumber(math.Ceil(api.GetNumber(0)))
+	if api.IsInteger(0) {
+		api.PushValue(*api.GetValue(0))
+	} else {
+		pushFloatAsInteger(api, math.Ceil(api.GetNumber(0)))
+	}
 	return 1
 }
 
 func cos(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Cos(api.GetNumber(0)))
@@ -61,7 +83,7 @@ func cos(state *State) int {
 
 func cosh(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Cosh(api.GetNumber(0)))
@@ -70,7 +92,7 @@ func cosh(state *State) int {
 
 func exp(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Exp(api.GetNumber(0)))
@@ -79,16 +101,20 @@ func exp(state *State) int {
 
 func floor(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
-	api.PushNumber(math.Floor(api.GetNumber(0)))
+	if api.IsInteger(0) {
+		api.PushValue(*api.GetValue(0))
+	} else {
+		pushFloatAsInteger(api, math.Floor(api.GetNumber(0)))
+	}
 	return 1
 }
 
 func sin(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Sin(api.GetNumber(0)))
@@ -97,7 +123,7 @@ func sin(state *State) int {
 
 func sinh(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Sinh(api.GetNumber(0)))
@@ -106,7 +132,7 @@ func sinh(state *State) int {
 
 func sqrt(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Sqrt(api.GetNumber(0)))
@@ -115,7 +141,7 @@ func sqrt(state *State) int {
 
 func tan(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Tan(api.GetNumber(0)))
@@ -124,7 +150,7 @@ func tan(state *State) int {
 
 func tanh(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	api.PushNumber(math.Tanh(api.GetNumber(0)))
@@ -169,7 +195,7 @@ func pow(state *State) int {
 
 func deg(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 
@@ -179,7 +205,7 @@ func deg(state *State) int {
 
 func rad(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 
@@ -205,11 +231,11 @@ func log(state *State) int {
 
 func min(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 
-	min := api.GetNumber(0)
+	min := 0
 	params := api.GetStackSize()
 	for i := 1; i < params; i++ {
 		if !api.IsNumber(i) {
@@ -217,23 +243,22 @@ func min(state *State) int {
 			return 0
 		}
 
-		n := api.GetNumber(i)
-		if n < min {
-			min = n
+		if api.GetNumber(i) < api.GetNumber(min) {
+			min = i
 		}
 	}
 
-	api.PushNumber(min)
+	api.PushValue(*api.GetValue(min))
 	return 1
 }
 
 func max(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 
-	max := api.GetNumber(0)
+	max := 0
 	params := api.GetStackSize()
 	for i := 1; i < params; i++ {
 		if !api.IsNumber(i) {
@@ -241,19 +266,50 @@ func max(state *State) int {
 			return 0
 		}
 
-		n := api.GetNumber(i)
-		if n > max {
-			max = n
+		if api.GetNumber(i) > api.GetNumber(max) {
+			max = i
 		}
 	}
 
-	api.PushNumber(max)
+	api.PushValue(*api.GetValue(max))
+	return 1
+}
+
+// Get subtype of number, "integer" or "float", nil if it is not a number
+func numberType(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	if api.IsInteger(0) {
+		api.PushString("integer")
+	} else if api.IsNumber(0) {
+		api.PushString("float")
+	} else {
+		api.PushNil()
+	}
+	return 1
+}
+
+// Convert number to integer, nil if it has no integer representation
+func toInteger(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1) {
+		return 0
+	}
+
+	if i, ok := api.GetValue(0).ToInteger(); ok {
+		api.PushInteger(i)
+	} else {
+		api.PushNil()
+	}
 	return 1
 }
 
 func frexp(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 
@@ -265,7 +321,7 @@ func frexp(state *State) int {
 
 func modf(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 
@@ -303,7 +359,7 @@ func random(state *State) int {
 func randomSeed(state *State) int {
 	// TODO
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTNumber) {
+	if !api.CheckArgs1(1, ValueTNumber) {
 		return 0
 	}
 	return 1
@@ -339,7 +395,11 @@ func RegisterLibMath(state *State) {
 		*NewTableMemberRegCFunction("sqrt", sqrt),
 		*NewTableMemberRegCFunction("tan", tan),
 		*NewTableMemberRegCFunction("tanh", tanh),
+		*NewTableMemberRegCFunction("tointeger", toInteger),
+		*NewTableMemberRegCFunction("type", numberType),
 		*NewTableMemberRegNumber("pi", math.Pi),
+		*NewTableMemberRegInteger("maxinteger", math.MaxInt64),
+		*NewTableMemberRegInteger("mininteger", math.MinInt64),
 	}
 
 	lib.RegisterTableFunction("math", &libmath[0], len(libmath))
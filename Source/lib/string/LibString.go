@@ -2,7 +2,9 @@ package string
 
 import (
 	. "InterpreterVM/Source/vm"
+	"fmt"
 	"math"
+	"strconv"
 	"strings"
 )
 
@@ -35,7 +37,7 @@ func abyte(state *State) int {
 
 	for index := i - 1; index < j; index++ {
 		if index >= 0 && index < len {
-			api.PushNumber(float64(s[index]))
+			api.PushInteger(int64(s[index]))
 			count++
 		}
 	}
@@ -62,17 +64,150 @@ func char(state *State) int {
 
 func alen(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTString) {
+	if !api.CheckArgs1(1, ValueTString) {
 		return 0
 	}
 
-	api.PushNumber(float64(api.GetString(0).GetLength()))
+	api.PushInteger(int64(api.GetString(0).GetLength()))
+	return 1
+}
+
+// Get integer argument of format, panic when it is not a number
+// or has no integer representation
+func formatInteger(api *StackAPI, arg int) (int64, bool) {
+	if !api.IsNumber(arg) {
+		api.ArgTypeError(arg, ValueTNumber)
+		return 0, false
+	}
+
+	i, ok := api.GetValue(arg).ToInteger()
+	if !ok {
+		panic(NewCallCFuncError(fmt.Sprintf(
+			"bad argument #%d to 'format' (number has no integer representation)", arg+1)))
+	}
+	return i, true
+}
+
+// Quote string 's' which can be read back by lexer
+func formatQuoted(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\0")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Format arguments by the first argument, integers are formatted
+// exactly by %d, %i, %x, %X, %o and %c
+func format(state *State) int {
+	api := NewStackAPI(state)
+	if !api.CheckArgs1(1, ValueTString) {
+		return 0
+	}
+
+	fmtStr := api.GetString(0).GetStdString()
+	params := api.GetStackSize()
+	arg := 0
+
+	var b strings.Builder
+	for i := 0; i < len(fmtStr); i++ {
+		if fmtStr[i] != '%' {
+			b.WriteByte(fmtStr[i])
+			continue
+		}
+
+		// Flags, width and precision of the conversion
+		start := i
+		for i++; i < len(fmtStr) && strings.IndexByte("-+ #0123456789.", fmtStr[i]) >= 0; i++ {
+		}
+		if i >= len(fmtStr) {
+			panic(NewCallCFuncError("invalid conversion '", fmtStr[start:], "' to 'format'"))
+		}
+
+		spec := fmtStr[start:i]
+		conversion := fmtStr[i]
+		if conversion == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		arg++
+		if arg >= params {
+			panic(NewCallCFuncError(fmt.Sprintf(
+				"bad argument #%d to 'format' (no value)", arg+1)))
+		}
+
+		switch conversion {
+		case 'd', 'i':
+			n, ok := formatInteger(api, arg)
+			if !ok {
+				return 0
+			}
+			b.WriteString(fmt.Sprintf(spec+"d", n))
+		case 'x', 'X', 'o':
+			n, ok := formatInteger(api, arg)
+			if !ok {
+				return 0
+			}
+			b.WriteString(fmt.Sprintf(spec+string(conversion), uint64(n)))
+		case 'c':
+			n, ok := formatInteger(api, arg)
+			if !ok {
+				return 0
+			}
+			b.WriteByte(byte(n))
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			if !api.IsNumber(arg) {
+				api.ArgTypeError(arg, ValueTNumber)
+				return 0
+			}
+			b.WriteString(fmt.Sprintf(spec+string(conversion), api.GetNumber(arg)))
+		case 'q':
+			if api.IsInteger(arg) {
+				b.WriteString(strconv.FormatInt(api.GetInteger(arg), 10))
+			} else if api.IsString(arg) {
+				b.WriteString(formatQuoted(api.GetString(arg).GetStdString()))
+			} else {
+				api.ArgTypeError(arg, ValueTString)
+				return 0
+			}
+		case 's':
+			var str string
+			if api.IsNumber(arg) {
+				str = NumberToString(api.GetValue(arg))
+			} else if api.IsString(arg) {
+				str = api.GetString(arg).GetStdString()
+			} else {
+				api.ArgTypeError(arg, ValueTString)
+				return 0
+			}
+			b.WriteString(fmt.Sprintf(spec+"s", str))
+		default:
+			panic(NewCallCFuncError("invalid conversion '", spec, string(conversion), "' to 'format'"))
+		}
+	}
+
+	api.PushString(b.String())
 	return 1
 }
 
 func lower(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTString) {
+	if !api.CheckArgs1(1, ValueTString) {
 		return 0
 	}
 
@@ -91,7 +226,7 @@ func lower(state *State) int {
 
 func reverse(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTString) {
+	if !api.CheckArgs1(1, ValueTString) {
 		return 0
 	}
 
@@ -153,7 +288,7 @@ func sub(state *State) int {
 
 func upper(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTString) {
+	if !api.CheckArgs1(1, ValueTString) {
 		return 0
 	}
 
@@ -172,9 +307,10 @@ func upper(state *State) int {
 
 func RegisterLibString(state *State) {
 	lib := NewLibrary(state)
-	str := [7]TableMemberReg{
+	str := [8]TableMemberReg{
 		*NewTableMemberRegCFunction("byte", abyte),
 		*NewTableMemberRegCFunction("char", char),
+		*NewTableMemberRegCFunction("format", format),
 		*NewTableMemberRegCFunction("len", alen),
 		*NewTableMemberRegCFunction("lower", lower),
 		*NewTableMemberRegCFunction("reverse", reverse),
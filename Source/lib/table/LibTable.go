@@ -22,7 +22,7 @@ func getNumber(api *StackAPI, index int, numType interface{}) bool {
 
 func concat(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(1, ValueTTable) {
+	if !api.CheckArgs1(1, ValueTTable) {
 		return 0
 	}
 
@@ -62,13 +62,13 @@ func concat(state *State) int {
 	// Concat values(number or string) of the range [i, j]
 	var str string
 	for ; i <= j; i++ {
-		key.Num = 1
+		key.SetNum(float64(i))
 		value := table.GetValue(key)
 
-		if value.Type == ValueTNumber {
-			str += fmt.Sprint(value.Num)
+		if value.Type() == ValueTNumber {
+			str += fmt.Sprint(value.Num())
 		} else {
-			str += fmt.Sprint(value.Str.GetCStr())
+			str += fmt.Sprint(value.Str().GetCStr())
 		}
 
 		if i != j {
@@ -82,7 +82,7 @@ func concat(state *State) int {
 
 func insert(state *State) int {
 	api := NewStackAPI(state)
-	if !api.CheckArgs(2, ValueTTable) {
+	if !api.CheckArgs1(2, ValueTTable) {
 		return 0
 	}
 
@@ -161,7 +161,7 @@ func unpack(state *State) int {
 	count := 0
 	key := NewValueNum(0.0)
 	for i := begin; i <= end; i++ {
-		key.Num = float64(i)
+		key.SetNum(float64(i))
 		api.PushValue(table.GetValue(key))
 		count++
 	}
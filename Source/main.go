@@ -2,11 +2,25 @@ package main
 
 import (
 	"InterpreterVM/Source/lib/base"
+	"InterpreterVM/Source/lib/coroutine"
+	"InterpreterVM/Source/lib/debug"
 	"InterpreterVM/Source/vm"
+	"flag"
 	"fmt"
 	"os"
 )
 
+func printError(err error) {
+	switch e := err.(type) {
+	case vm.RuntimeError:
+		fmt.Println(e.StackTrace())
+	case vm.ScriptError:
+		fmt.Println(e.StackTrace())
+	default:
+		fmt.Println(err)
+	}
+}
+
 func repl(state *vm.State) {
 	fmt.Println("Luna 2.0 Copyright (C) 2014")
 	state.DoString("a = 1", "stdin")
@@ -25,27 +39,54 @@ func repl(state *vm.State) {
 			break
 		}
 
-		state.DoString(string(buffer[:]), "stdin")
+		if err := state.TryDoString(string(buffer[:n]), "stdin"); err != nil {
+			printError(err)
+		}
 	}
 }
 
-func executeFile(args []string, state *vm.State) {
-	state.DoModule(args[1])
+func executeFile(file string, state *vm.State) {
+	if err := state.TryDoModule(file); err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+// Print bytecode listing of the file without executing it
+func listFile(file string, state *vm.State) {
+	if err := state.TryLoadModule(file); err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+	if err := state.Disassemble(os.Stdout); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 func main() {
 	var state = vm.NewState()
 
 	base.RegisterLibBase(state)
+	coroutine.RegisterLibCoroutine(state)
+	debug.RegisterLibDebug(state)
 	//io.RegisterLibIO(state)
 	//math.RegisterLibMath(state)
 	//string2.RegisterLibString(state)
 	//table.RegisterLibTable(state)
 
-	if len(os.Args) < 2 {
+	list := flag.Bool("l", false, "list bytecode of the file instead of executing it")
+	noOptimize := flag.Bool("O0", false, "disable the optimizer for debugging")
+	flag.Parse()
+
+	state.SetOptimize(!*noOptimize)
+
+	if flag.NArg() < 1 {
 		repl(state)
+	} else if *list {
+		listFile(flag.Arg(0), state)
 	} else {
-		executeFile(os.Args, state)
+		executeFile(flag.Arg(0), state)
 	}
 
 }
@@ -0,0 +1,476 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	gohash "hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Header of binary chunk
+const (
+	chunkSignature = "\x1bLuna"
+	chunkVersion   = 2
+	chunkFormat    = 0
+
+	// Values to check the byte order and number format of the chunk
+	chunkCheckInteger int64   = 0x5678
+	chunkCheckNumber  float64 = 370.5
+)
+
+// Max count of elements of each list in function,
+// it limits the memory allocated for corrupt chunk
+const maxChunkListCount = 1 << 24
+
+// Type tags of const values in chunk
+const (
+	chunkConstNil = iota
+	chunkConstFalse
+	chunkConstTrue
+	chunkConstNumber
+	chunkConstInteger
+	chunkConstString
+)
+
+// Whether the first byte of a stream is the start of binary chunk
+func IsBinaryChunk(c byte) bool {
+	return c == chunkSignature[0]
+}
+
+// Binary chunk writer, the first error stops all later writes
+type chunkWriter struct {
+	w   io.Writer
+	crc gohash.Hash32
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (cw *chunkWriter) write(p []byte) {
+	if cw.err != nil {
+		return
+	}
+	_, cw.err = cw.w.Write(p)
+	cw.crc.Write(p)
+}
+
+func (cw *chunkWriter) writeByte(c byte) {
+	cw.write([]byte{c})
+}
+
+func (cw *chunkWriter) writeBool(b bool) {
+	if b {
+		cw.writeByte(1)
+	} else {
+		cw.writeByte(0)
+	}
+}
+
+func (cw *chunkWriter) writeVarint(i int64) {
+	cw.write(cw.buf[:binary.PutVarint(cw.buf[:], i)])
+}
+
+func (cw *chunkWriter) writeUint32(u uint32) {
+	binary.LittleEndian.PutUint32(cw.buf[:4], u)
+	cw.write(cw.buf[:4])
+}
+
+func (cw *chunkWriter) writeUint64(u uint64) {
+	binary.LittleEndian.PutUint64(cw.buf[:8], u)
+	cw.write(cw.buf[:8])
+}
+
+func (cw *chunkWriter) writeString(s *String) {
+	str := s.GetStdString()
+	cw.writeVarint(int64(len(str)))
+	cw.write([]byte(str))
+}
+
+func (cw *chunkWriter) writeHeader() {
+	cw.write([]byte(chunkSignature))
+	cw.writeByte(chunkVersion)
+	cw.writeByte(chunkFormat)
+	cw.writeUint64(uint64(chunkCheckInteger))
+	cw.writeUint64(math.Float64bits(chunkCheckNumber))
+}
+
+func (cw *chunkWriter) writeConst(f *Function, v *Value) {
+	switch {
+	case v.IsNil():
+		cw.writeByte(chunkConstNil)
+	case v.Type() == ValueTBool:
+		if v.Bool() {
+			cw.writeByte(chunkConstTrue)
+		} else {
+			cw.writeByte(chunkConstFalse)
+		}
+	case v.IsFloat():
+		cw.writeByte(chunkConstNumber)
+		cw.writeUint64(math.Float64bits(v.Num()))
+	case v.IsInteger():
+		cw.writeByte(chunkConstInteger)
+		cw.writeUint64(uint64(v.Int()))
+	case v.Type() == ValueTString:
+		cw.writeByte(chunkConstString)
+		cw.writeString(v.Str())
+	default:
+		if cw.err == nil {
+			cw.err = NewBinaryChunkError(f.module.GetStdString(),
+				"can not dump const value of type ", v.TypeName())
+		}
+	}
+}
+
+func (cw *chunkWriter) writeFunction(f *Function) {
+	cw.writeString(f.module)
+	cw.writeVarint(int64(f.line))
+	cw.writeVarint(int64(f.args))
+	cw.writeBool(f.isVararg)
+
+	cw.writeVarint(int64(len(f.opCodes)))
+	for i, code := range f.opCodes {
+		cw.writeUint32(uint32(code.OpCode))
+		cw.writeVarint(int64(f.opCodeLines[i]))
+	}
+
+	cw.writeVarint(int64(len(f.constValues)))
+	for i := range f.constValues {
+		cw.writeConst(f, &f.constValues[i])
+	}
+
+	cw.writeVarint(int64(len(f.localVars)))
+	for _, v := range f.localVars {
+		cw.writeString(v.Name)
+		cw.writeVarint(int64(v.RegisterId))
+		cw.writeVarint(int64(v.BeginPc))
+		cw.writeVarint(int64(v.EndPc))
+	}
+
+	cw.writeVarint(int64(len(f.upvalues)))
+	for _, u := range f.upvalues {
+		cw.writeString(u.Name)
+		cw.writeBool(u.ParentLocal)
+		cw.writeVarint(int64(u.RegisterIndex))
+	}
+
+	cw.writeVarint(int64(len(f.childFuncs)))
+	for _, child := range f.childFuncs {
+		cw.writeFunction(child)
+	}
+}
+
+// Dump function prototype 'f' and all its child functions to 'w'
+// as a binary chunk, which can be loaded by ModuleManager.LoadBinary
+func DumpFunction(w io.Writer, f *Function) error {
+	cw := &chunkWriter{w: w, crc: crc32.NewIEEE()}
+	cw.writeHeader()
+	cw.writeFunction(f)
+	if cw.err != nil {
+		return cw.err
+	}
+
+	// Checksum of all bytes before it
+	cw.writeUint32(cw.crc.Sum32())
+	return cw.err
+}
+
+// Binary chunk reader, any error panics with BinaryChunkError
+type chunkReader struct {
+	r     io.ByteReader
+	crc   gohash.Hash32
+	state *State
+	name  string
+}
+
+func (cr *chunkReader) error(args ...interface{}) {
+	panic(NewBinaryChunkError(cr.name, args...))
+}
+
+func (cr *chunkReader) ReadByte() (byte, error) {
+	c, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc.Write([]byte{c})
+	}
+	return c, err
+}
+
+func (cr *chunkReader) readByte() byte {
+	c, err := cr.ReadByte()
+	if err != nil {
+		cr.error("truncated chunk")
+	}
+	return c
+}
+
+func (cr *chunkReader) readBytes(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = cr.readByte()
+	}
+	return buf
+}
+
+func (cr *chunkReader) readBool() bool {
+	switch cr.readByte() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	cr.error("bad bool value")
+	return false
+}
+
+func (cr *chunkReader) readVarint() int64 {
+	i, err := binary.ReadVarint(cr)
+	if err != nil {
+		cr.error("bad integer")
+	}
+	return i
+}
+
+// Read a varint in [min, max]
+func (cr *chunkReader) readInt(min, max int, what string) int {
+	i := cr.readVarint()
+	if i < int64(min) || i > int64(max) {
+		cr.error("bad ", what)
+	}
+	return int(i)
+}
+
+func (cr *chunkReader) readCount(what string) int {
+	return cr.readInt(0, maxChunkListCount, "count of "+what)
+}
+
+func (cr *chunkReader) readUint32() uint32 {
+	return binary.LittleEndian.Uint32(cr.readBytes(4))
+}
+
+func (cr *chunkReader) readUint64() uint64 {
+	return binary.LittleEndian.Uint64(cr.readBytes(8))
+}
+
+func (cr *chunkReader) readString() *String {
+	n := cr.readInt(0, math.MaxInt32, "string length")
+
+	// Grow the buffer by the bytes read, not by the length
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		buf.WriteByte(cr.readByte())
+	}
+	return cr.state.GetString(buf.String())
+}
+
+func (cr *chunkReader) readHeader() {
+	signature := make([]byte, len(chunkSignature))
+	for i := range signature {
+		c, err := cr.ReadByte()
+		if err != nil {
+			cr.error("truncated header")
+		}
+		signature[i] = c
+	}
+	if string(signature) != chunkSignature {
+		cr.error("not a binary chunk")
+	}
+
+	if cr.readByte() != chunkVersion {
+		cr.error("version mismatch")
+	}
+	if cr.readByte() != chunkFormat {
+		cr.error("format mismatch")
+	}
+	if int64(cr.readUint64()) != chunkCheckInteger {
+		cr.error("integer format mismatch")
+	}
+	if math.Float64frombits(cr.readUint64()) != chunkCheckNumber {
+		cr.error("number format mismatch")
+	}
+}
+
+func (cr *chunkReader) readConst() Value {
+	switch cr.readByte() {
+	case chunkConstNil:
+		return Value{}
+	case chunkConstFalse:
+		return NewValueBValue(false)
+	case chunkConstTrue:
+		return NewValueBValue(true)
+	case chunkConstNumber:
+		return NewValueNum(math.Float64frombits(cr.readUint64()))
+	case chunkConstInteger:
+		return NewValueInt(int64(cr.readUint64()))
+	case chunkConstString:
+		return NewValueString(cr.readString())
+	}
+	cr.error("bad const value type")
+	return Value{}
+}
+
+// Read function, 'parent' is nil for the main function of chunk
+func (cr *chunkReader) readFunction(parent *Function) *Function {
+	f := cr.state.NewFunction()
+	f.SetSuperior(parent)
+	f.SetModuleName(cr.readString())
+	f.line = int(cr.readVarint())
+	f.args = cr.readInt(0, frameRegisterCount-1, "count of args")
+	f.isVararg = cr.readBool()
+
+	count := cr.readCount("instructions")
+	for i := 0; i < count; i++ {
+		code := cr.readUint32()
+		f.AddInstruction(Instruction{int(code)}, int(cr.readVarint()))
+	}
+
+	count = cr.readCount("const values")
+	for i := 0; i < count; i++ {
+		v := cr.readConst()
+		f.AddConstValue(&v)
+	}
+
+	count = cr.readCount("local variables")
+	for i := 0; i < count; i++ {
+		name := cr.readString()
+		registerId := int(cr.readVarint())
+		beginPc := int(cr.readVarint())
+		endPc := int(cr.readVarint())
+		f.AddLocalVar(name, registerId, beginPc, endPc)
+	}
+
+	count = cr.readCount("upvalues")
+	if parent == nil && count != 0 {
+		cr.error("main function has upvalues")
+	}
+	for i := 0; i < count; i++ {
+		name := cr.readString()
+		parentLocal := cr.readBool()
+		var index int
+		if parentLocal {
+			index = cr.readInt(0, frameRegisterCount-1, "upvalue register")
+		} else {
+			index = cr.readInt(0, len(parent.upvalues)-1, "upvalue index")
+		}
+		f.AddUpvalue(name, parentLocal, index)
+	}
+
+	count = cr.readCount("child functions")
+	for i := 0; i < count; i++ {
+		f.AddChildFunction(cr.readFunction(f))
+	}
+
+	cr.checkInstructions(f)
+	return f
+}
+
+// Check operands of instructions, so the VM never accesses any
+// const value, upvalue, child function or instruction out of range.
+// Instructions which use the values up to the stack top must follow
+// the instruction which leaves open results there.
+func (cr *chunkReader) checkInstructions(f *Function) {
+	size := len(f.opCodes)
+	checkJump := func(target int) {
+		if target < 0 || target > size {
+			cr.error("bad jump target")
+		}
+	}
+	checkOpen := func(open bool) {
+		if !open {
+			cr.error("bad open value count")
+		}
+	}
+
+	// Whether the previous instruction leaves open results
+	open := false
+	for pc := 0; pc < size; pc++ {
+		i := f.opCodes[pc]
+		a := GetParamA(i)
+		if !IsValidOpType(GetOpCode(i)) {
+			cr.error("bad opcode")
+		}
+
+		switch GetOpTypeMode(GetOpCode(i)) {
+		case OpModeAB, OpModeABC:
+			if GetParamB(i) >= frameRegisterCount || GetParamC(i) >= frameRegisterCount {
+				cr.error("bad operand")
+			}
+		case OpModeABCRK:
+			for _, rk := range []int{GetParamB(i), GetParamC(i)} {
+				if IsRKConst(rk) && GetRKConstIndex(rk) >= len(f.constValues) {
+					cr.error("bad const index")
+				}
+			}
+		}
+
+		switch GetOpCode(i) {
+		case OpTypeLoadConst, OpTypeGetGlobal, OpTypeSetGlobal:
+			if int(GetParamBx(i)) >= len(f.constValues) {
+				cr.error("bad const index")
+			}
+		case OpTypeClosure:
+			if int(GetParamBx(i)) >= len(f.childFuncs) {
+				cr.error("bad child function index")
+			}
+		case OpTypeGetUpvalue, OpTypeSetUpvalue:
+			if GetParamB(i) >= len(f.upvalues) {
+				cr.error("bad upvalue index")
+			}
+		case OpTypeCall, OpTypeTailCall:
+			if GetParamB(i) == 0 {
+				checkOpen(open)
+			}
+		case OpTypeVarArg, OpTypeRet:
+			count := int(GetParamsBx(i))
+			if count < ExpValueCountAny || a+count > frameRegisterCount {
+				cr.error("bad value count")
+			}
+			if count == ExpValueCountAny && GetOpCode(i) == OpTypeRet {
+				checkOpen(open)
+			}
+		case OpTypeJmpFalse, OpTypeJmpTrue, OpTypeJmpNil, OpTypeJmp:
+			checkJump(pc + int(GetParamsBx(i)))
+		case OpTypeLoadInt:
+			// Next instruction is the integer
+			if pc++; pc >= size {
+				cr.error("missing integer of instruction")
+			}
+		case OpTypeForStep:
+			// Next instruction is the jump of loop
+			if pc++; pc >= size {
+				cr.error("missing jump of instruction")
+			}
+			checkJump(pc + int(GetParamsBx(f.opCodes[pc])))
+		}
+
+		switch GetOpCode(i) {
+		case OpTypeCall:
+			open = GetParamC(i) == 0
+		case OpTypeVarArg:
+			open = int(GetParamsBx(i)) == ExpValueCountAny
+		default:
+			// Results of tail call of c function are returned by next Ret
+			open = GetOpCode(i) == OpTypeTailCall
+		}
+	}
+}
+
+// Load a binary chunk from 'r' and return the main function, 'name' is
+// used to report error. Bytes after the chunk may be read from 'r' when
+// 'r' is not an io.ByteReader.
+func loadFunction(state *State, r io.Reader, name string) *Function {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	cr := &chunkReader{r: br, crc: crc32.NewIEEE(), state: state, name: name}
+	cr.readHeader()
+	f := cr.readFunction(nil)
+
+	sum := cr.crc.Sum32()
+	if cr.readUint32() != sum {
+		cr.error("checksum mismatch")
+	}
+	return f
+}
@@ -41,7 +41,7 @@ type generateBlock struct {
 }
 
 func newGenerateBlock() *generateBlock {
-	return &generateBlock{}
+	return &generateBlock{Names: make(map[*String]localNameInfo)}
 }
 
 // Jump info for loop AST
@@ -103,10 +103,8 @@ func (cgv *codeGenerateVisitor) VisitChunk(chunk *Chunk, data unsafe.Pointer) {
 		closure.SetPrototype(function)
 
 		// Put closure on stack
-		top := cgv.state.stack.Top
-		cgv.state.stack.Top = vPointerAdd(cgv.state.stack.Top, 1)
-		top.Closure = closure
-		top.Type = ValueTClosure
+		cgv.state.checkStack(cgv.state.stack.Top, 1)
+		cgv.state.stack.Push(NewValueClosure(closure))
 	}
 }
 
@@ -131,12 +129,21 @@ func (cgv *codeGenerateVisitor) VisitReturnStatement(retStmt *ReturnStatement, d
 	}
 
 	function := cgv.GetCurrentFunction()
+	if retStmt.TailCall {
+		// The function call is the last instruction, change it to tail call,
+		// Ret is still needed when the callee is not a closure
+		call := function.GetMutableInstruction(function.OpCodeSize() - 1)
+		if GetOpCode(*call) != OpTypeCall {
+			panic("assert")
+		}
+		*call = ABCode(OpTypeTailCall, GetParamA(*call), GetParamB(*call))
+	}
 	instruction := AsBxCode(OpTypeRet, registerId, retStmt.ExpValueCount)
 	function.AddInstruction(instruction, retStmt.Line)
 }
 
 func (cgv *codeGenerateVisitor) VisitBreakStatement(breakStmt *BreakStatement, data unsafe.Pointer) {
-	if breakStmt.Loop != nil {
+	if breakStmt.Loop == nil {
 		panic("assert")
 	}
 	function := cgv.GetCurrentFunction()
@@ -170,7 +177,11 @@ func (cgv *codeGenerateVisitor) VisitWhileStatement(whileStmt *WhileStatement, d
 	index := function.AddInstruction(instruction, whileStmt.FirstLine)
 	cgv.AddLoopJumpInfo(whileStmt, index, jumpTail)
 
-	whileStmt.Block.Accept(cgv, nil)
+	func() {
+		cgv.EnterBlock()
+		defer cgv.LeaveBlock()
+		whileStmt.Block.Accept(cgv, nil)
+	}()
 
 	// Jump to loop head
 	instruction = AsBxCode(OpTypeJmp, 0, 0)
@@ -183,11 +194,11 @@ func (cgv *codeGenerateVisitor) VisitRepeatStatement(repeatStmt *RepeatStatement
 	defer cgv.LeaveBlock()
 	cgv.EnterLoop(repeatStmt)
 	defer cgv.LeaveLoop()
-	{
+	func() {
 		r := cgv.GetNextRegisterId()
 		defer cgv.ResetRegisterIdGenerator(r)
 		repeatStmt.Block.Accept(cgv, nil)
-	}
+	}()
 
 	// Get exp value
 	registerId, err := cgv.GenerateRegisterId()
@@ -236,19 +247,19 @@ func (cgv *codeGenerateVisitor) VisitNumericForStatement(numFor *NumericForState
 	line := numFor.Name.Line
 
 	// Init name, limit, step
-	{
+	func() {
 		r := cgv.GetNextRegisterId()
 		defer cgv.ResetRegisterIdGenerator(r)
 		nameExpData := newCgExpVarData(varRegister, varRegister+1)
 		numFor.Exp1.Accept(cgv, unsafe.Pointer(nameExpData))
-	}
-	{
+	}()
+	func() {
 		r := cgv.GetNextRegisterId()
 		defer cgv.ResetRegisterIdGenerator(r)
 		limitExpData := newCgExpVarData(limitRegister, limitRegister+1)
 		numFor.Exp2.Accept(cgv, unsafe.Pointer(limitExpData))
-	}
-	{
+	}()
+	func() {
 		r := cgv.GetNextRegisterId()
 		defer cgv.ResetRegisterIdGenerator(r)
 		if numFor.Exp3 != nil {
@@ -262,19 +273,19 @@ func (cgv *codeGenerateVisitor) VisitNumericForStatement(numFor *NumericForState
 			instruction.OpCode = 1
 			function.AddInstruction(instruction, line)
 		}
-	}
+	}()
 
 	// Init 'for' var, limit, step value
-	instruction := ABCCode(OpTypeFillNil, varRegister, limitRegister, stepRegister)
+	instruction := ABCCode(OpTypeForInit, varRegister, limitRegister, stepRegister)
 	function.AddInstruction(instruction, line)
 
 	cgv.EnterLoop(numFor)
 	defer cgv.LeaveLoop()
-	{
+	func() {
 		cgv.EnterBlock()
 		defer cgv.LeaveBlock()
 
-		// Check 'for', continu loop or not
+		// Check 'for', continue loop or not
 		instruction := ABCCode(OpTypeForStep, varRegister, limitRegister, stepRegister)
 		function.AddInstruction(instruction, line)
 
@@ -298,9 +309,9 @@ func (cgv *codeGenerateVisitor) VisitNumericForStatement(numFor *NumericForState
 		// var = var + step
 		instruction = ABCCode(OpTypeAdd, varRegister, varRegister, stepRegister)
 		function.AddInstruction(instruction, line)
-	}
+	}()
 	// Jump to the begin of the loop
-	instruction = AsBxCode(OpTypeJmpFalse, 0, 0)
+	instruction = AsBxCode(OpTypeJmp, 0, 0)
 	index := function.AddInstruction(instruction, line)
 	cgv.AddLoopJumpInfo(numFor, index, jumpHead)
 }
@@ -319,6 +330,9 @@ func (cgv *codeGenerateVisitor) VisitGenericForStatement(genFor *GenericForState
 		panic(err)
 	}
 	varRegister, err := cgv.GenerateRegisterId()
+	if err != nil {
+		panic(err)
+	}
 	eListData := newCgExpListData(funcRegister, varRegister+1)
 	genFor.ExpList.Accept(cgv, unsafe.Pointer(eListData))
 
@@ -326,7 +340,7 @@ func (cgv *codeGenerateVisitor) VisitGenericForStatement(genFor *GenericForState
 	line := genFor.Line
 	cgv.EnterLoop(genFor)
 	defer cgv.LeaveLoop()
-	{
+	func() {
 		cgv.EnterBlock()
 		defer cgv.LeaveBlock()
 
@@ -380,7 +394,7 @@ func (cgv *codeGenerateVisitor) VisitGenericForStatement(genFor *GenericForState
 		move(varRegister, nameStart)
 
 		genFor.Block.Accept(cgv, nil)
-	}
+	}()
 
 	// Jump to loop start
 	instruction := AsBxCode(OpTypeJmp, 0, 0)
@@ -454,7 +468,7 @@ func (cgv *codeGenerateVisitor) VisitFunctionName(funcName *FunctionName, data u
 			if err != nil {
 				panic(err)
 			}
-			instruction = ABCode(OpTypeMove, tableRegister, index)
+			instruction = ABCode(OpTypeGetUpvalue, tableRegister, index)
 		case LexicalScopingLocal:
 			// Load local variable to table register
 			localName := cgv.SearchLocalName(firstName)
@@ -481,7 +495,7 @@ func (cgv *codeGenerateVisitor) VisitFunctionName(funcName *FunctionName, data u
 			function.AddInstruction(instruction, line)
 		}
 
-		for i := 0; i < count; i++ {
+		for i := 1; i < count; i++ {
 			// Get value from table by key
 			name := funcName.Names[i].Str
 			line := funcName.Names[i].Line
@@ -525,10 +539,10 @@ func (cgv *codeGenerateVisitor) VisitLocalNameListStatement(lNameListStmt *Local
 		startRegister := cgv.GetNextRegisterId()
 		endRegister := startRegister + lNameListStmt.NameCount
 		cgv.ResetRegisterIdGenerator(endRegister)
-		defer cgv.ResetRegisterIdGenerator(startRegister)
 
 		eListData := newCgExpListData(startRegister, endRegister)
 		lNameListStmt.ExpList.Accept(cgv, unsafe.Pointer(eListData))
+		cgv.ResetRegisterIdGenerator(startRegister)
 	}
 
 	// NameList need init itself when ExpList is not existed
@@ -623,12 +637,7 @@ func (cgv *codeGenerateVisitor) VisitTerminator(term *Terminator, data unsafe.Po
 	switch term.Token.Token {
 	case TokenNumber, TokenString:
 		// Load const to register
-		index := 0
-		if term.Token.Token == TokenNumber {
-			index = function.AddConstNumber(term.Token.Number)
-		} else {
-			index = function.AddConstString(term.Token.Str)
-		}
+		index := addConstToken(function, &term.Token)
 		instruction := ABxCode(OpTypeLoadConst, registerId, index)
 		registerId++
 		function.AddInstruction(instruction, term.Token.Line)
@@ -730,18 +739,31 @@ func (cgv *codeGenerateVisitor) VisitBinaryExpression(binaryExp *BinaryExpressio
 		return
 	}
 
-	leftRegister := 0
+	// Const and local variable operands are referenced by RK operands
+	// directly, left local variable is referenced directly only when the
+	// right expression can not change it
+	leftRegister, leftDirect := cgv.getOperandRK(binaryExp.Left)
+	rightRegister, rightDirect := cgv.getOperandRK(binaryExp.Right)
+	if leftDirect && !rightDirect && !IsRKConst(leftRegister) {
+		leftDirect = false
+	}
+
 	// Generate code to calculate left expression
-	{
+	if !leftDirect {
 		eVarData := newCgExpVarData(registerId, registerId+1)
 		binaryExp.Left.Accept(cgv, unsafe.Pointer(eVarData))
 		leftRegister = registerId
 	}
 
-	rightRegister := 0
 	// Generate code to calculate right expression
-	{
-		if endRegister != ExpValueCountAny && registerId+1 < endRegister {
+	if !rightDirect {
+		if leftDirect {
+			// Left expression uses no register, so calculate right
+			// expression in the dst register
+			eVarData := newCgExpVarData(registerId, registerId+1)
+			binaryExp.Right.Accept(cgv, unsafe.Pointer(eVarData))
+			rightRegister = registerId
+		} else if endRegister != ExpValueCountAny && registerId+1 < endRegister {
 			// If parent AST provide more than one register, then use the second
 			// register as temp register of right expression
 			eVarData := newCgExpVarData(registerId+1, registerId+2)
@@ -752,7 +774,11 @@ func (cgv *codeGenerateVisitor) VisitBinaryExpression(binaryExp *BinaryExpressio
 			// right expression
 			r := cgv.GetNextRegisterId()
 			defer cgv.ResetRegisterIdGenerator(r)
-			rightRegister = cgv.GetNextRegisterId()
+			var err error
+			rightRegister, err = cgv.GenerateRegisterId()
+			if err != nil {
+				panic(err)
+			}
 			eVarData := newCgExpVarData(rightRegister, rightRegister+1)
 			binaryExp.Right.Accept(cgv, unsafe.Pointer(eVarData))
 		}
@@ -773,6 +799,18 @@ func (cgv *codeGenerateVisitor) VisitBinaryExpression(binaryExp *BinaryExpressio
 		opType = OpTypePow
 	case '%':
 		opType = OpTypeMod
+	case TokenIDiv:
+		opType = OpTypeIDiv
+	case '&':
+		opType = OpTypeBAnd
+	case '|':
+		opType = OpTypeBOr
+	case '~':
+		opType = OpTypeBXor
+	case TokenShiftLeft:
+		opType = OpTypeShl
+	case TokenShiftRight:
+		opType = OpTypeShr
 	case '<':
 		opType = OpTypeLess
 	case '>':
@@ -793,9 +831,8 @@ func (cgv *codeGenerateVisitor) VisitBinaryExpression(binaryExp *BinaryExpressio
 
 	// Generate instruction to calculate
 	instruction := ABCCode(opType, registerId, leftRegister, rightRegister)
-	leftRegister++
 	function.AddInstruction(instruction, line)
-	cgv.fillRemainRegisterNil(registerId, endRegister, line)
+	cgv.fillRemainRegisterNil(registerId+1, endRegister, line)
 }
 
 func (cgv *codeGenerateVisitor) VisitUnaryExpression(unaryExp *UnaryExpression, data unsafe.Pointer) {
@@ -816,6 +853,8 @@ func (cgv *codeGenerateVisitor) VisitUnaryExpression(unaryExp *UnaryExpression,
 		opType = OpTypeNeg
 	case '#':
 		opType = OpTypeLen
+	case '~':
+		opType = OpTypeBNot
 	case TokenNot:
 		opType = OpTypeNot
 	default:
@@ -833,14 +872,14 @@ func (cgv *codeGenerateVisitor) VisitUnaryExpression(unaryExp *UnaryExpression,
 
 func (cgv *codeGenerateVisitor) VisitFunctionBody(funcBody *FunctionBody, data unsafe.Pointer) {
 	childIndex := 0
-	{
+	func() {
 		cgv.EnterFunction()
 		defer cgv.LeaveFunction()
 		function := cgv.GetCurrentFunction()
 		function.SetLine(funcBody.Line)
 		childIndex = cgv.currentFunction.FuncIndex
 
-		{
+		func() {
 			cgv.EnterBlock()
 			defer cgv.LeaveBlock()
 			// Child function generate code
@@ -860,8 +899,8 @@ func (cgv *codeGenerateVisitor) VisitFunctionBody(funcBody *FunctionBody, data u
 				funcBody.ParamList.Accept(cgv, nil)
 			}
 			funcBody.BLock.Accept(cgv, nil)
-		}
-	}
+		}()
+	}()
 
 	// Generate closure
 	eVarData := (*cgExpVarData)(data)
@@ -967,7 +1006,7 @@ func (cgv *codeGenerateVisitor) VisitTableNameField(tableNField *TableNameField,
 	if err != nil {
 		panic(err)
 	}
-	instruction := AsBxCode(OpTypeLoadConst, keyRegister, keyIndex)
+	instruction := ABxCode(OpTypeLoadConst, keyRegister, keyIndex)
 	function.AddInstruction(instruction, tableNField.Name.Line)
 
 	cgv.setTableFieldValue(tableNField, tableRegister, keyRegister, tableNField.Name.Line)
@@ -1025,7 +1064,7 @@ func (cgv *codeGenerateVisitor) VisitMemberFuncCall(mFuncCall *MemberFuncCall, d
 		instruction := ABCode(OpTypeMove, argRegister, callerRegister)
 		function.AddInstruction(instruction, mFuncCall.Member.Line)
 
-		{
+		func() {
 			r := cgv.GetNextRegisterId()
 			defer cgv.ResetRegisterIdGenerator(r)
 			// Get key
@@ -1036,7 +1075,11 @@ func (cgv *codeGenerateVisitor) VisitMemberFuncCall(mFuncCall *MemberFuncCall, d
 			}
 			instruction := ABxCode(OpTypeLoadConst, keyRegister, index)
 			function.AddInstruction(instruction, mFuncCall.Member.Line)
-		}
+
+			// Get value from table by key
+			instruction = ABCCode(OpTypeGetTable, callerRegister, keyRegister, callerRegister)
+			function.AddInstruction(instruction, mFuncCall.Member.Line)
+		}()
 
 		return 1
 	})
@@ -1141,11 +1184,9 @@ func (cgv *codeGenerateVisitor) EnterFunction() {
 	function.Parent = parent
 	cgv.currentFunction = function
 
-	// New function is default on GCGen2, so barrier it
+	// New function is default on GCGen2, it barriers itself when
+	// GC objects are added to it
 	cgv.currentFunction.Function_ = cgv.state.NewFunction()
-	if CheckBarrier(cgv.currentFunction.Function_) {
-		cgv.state.GetGC().SetBarrier(cgv.currentFunction.Function_)
-	}
 
 	if parent != nil {
 		index := parent.Function_.AddChildFunction(function.Function_)
@@ -1254,7 +1295,7 @@ func (cgv *codeGenerateVisitor) InsertName(name *String, registerId int) {
 		function.AddLocalVar(name, info.RegisterId, info.BeginPc, endPc)
 
 		// New variable replace the old one
-		info = *newLocalNameInfo(registerId, beginPc)
+		block.Names[name] = *newLocalNameInfo(registerId, beginPc)
 	} else {
 		// Variable not existed, then insert into
 		local := *newLocalNameInfo(registerId, beginPc)
@@ -1312,7 +1353,7 @@ func (cgv *codeGenerateVisitor) PrepareUpvalue(name *String) (int, error) {
 			}
 			registerIndex = index
 			parentLocal = false
-			parents = parents[:len(parents)-2] // pop
+			parents = parents[:len(parents)-1] // pop
 		} else {
 			// Find name from local names
 			nameInfo := cgv.SearchFunctionLocalName(current, name)
@@ -1320,7 +1361,7 @@ func (cgv *codeGenerateVisitor) PrepareUpvalue(name *String) (int, error) {
 				// Find it, get its registerId and start backtrack
 				registerIndex = nameInfo.RegisterId
 				parentLocal = true
-				parents = parents[:len(parents)-2] // pop
+				parents = parents[:len(parents)-1] // pop
 			} else {
 				// Find it from current function upvalue list
 				index := current.Function_.SearchUpvalue(name)
@@ -1329,7 +1370,7 @@ func (cgv *codeGenerateVisitor) PrepareUpvalue(name *String) (int, error) {
 					// then get the upvalue index, and start backtrack
 					registerIndex = index
 					parentLocal = false
-					parents = parents[:len(parents)-2] // pop
+					parents = parents[:len(parents)-1] // pop
 				} else {
 					// Not find it, continue to search its parent
 					parents = append(parents, current.Parent)
@@ -1412,12 +1453,58 @@ func (cgv *codeGenerateVisitor) fillRemainRegisterNil(registerId, endRegister, l
 	}
 }
 
+// Add const value of number or string token and return index of the const value
+func addConstToken(function *Function, token *TokenDetail) int {
+	switch {
+	case token.Token == TokenNumber && token.IsInteger:
+		return function.AddConstInt(token.Integer)
+	case token.Token == TokenNumber:
+		return function.AddConstNumber(token.Number)
+	case token.Token == TokenString:
+		return function.AddConstString(token.Str)
+	case token.Token == TokenTrue || token.Token == TokenFalse:
+		v := NewValueBValue(token.Token == TokenTrue)
+		return function.AddConstValue(&v)
+	default:
+		v := Value{}
+		return function.AddConstValue(&v)
+	}
+}
+
+// Get RK operand of expression 'exp' which is a const or a local variable,
+// return false when 'exp' is not, or the const index is too large for RK
+// operand, or the optimizer is disabled
+func (cgv *codeGenerateVisitor) getOperandRK(exp SyntaxTree) (int, bool) {
+	term, ok := exp.(*Terminator)
+	if !ok || !cgv.state.optimize {
+		return 0, false
+	}
+	switch term.Token.Token {
+	case TokenNumber, TokenString, TokenTrue, TokenFalse, TokenNil:
+	case TokenId:
+		if term.Scoping == LexicalScopingLocal && term.Semantic == SemanticOpRead {
+			if local := cgv.SearchLocalName(term.Token.Str); local != nil {
+				return local.RegisterId, true
+			}
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+
+	function := cgv.GetCurrentFunction()
+	if function.ConstValueCount() > MaxRKConstIndex {
+		return 0, false
+	}
+	return RKConst(addConstToken(function, &term.Token)), true
+}
+
 func (cgv *codeGenerateVisitor) ifStatementGenerateCode(stmtType interface{}) {
 	switch ifStmt := stmtType.(type) {
 	case *IfStatement:
 		function := cgv.GetCurrentFunction()
 		jmpEndIndex := 0
-		{
+		func() {
 			r := cgv.GetNextRegisterId()
 			defer cgv.ResetRegisterIdGenerator(r)
 			registerId, err := cgv.GenerateRegisterId()
@@ -1430,12 +1517,12 @@ func (cgv *codeGenerateVisitor) ifStatementGenerateCode(stmtType interface{}) {
 			instruction := AsBxCode(OpTypeJmpFalse, registerId, 0)
 			jmpIndex := function.AddInstruction(instruction, ifStmt.Line)
 
-			{
+			func() {
 				// True branch block generate code
 				cgv.EnterBlock()
 				defer cgv.LeaveBlock()
 				ifStmt.TrueBranch.Accept(cgv, nil)
-			}
+			}()
 
 			// jmp to the of if-elseif-else statement after execute block
 			instruction = AsBxCode(OpTypeJmp, 0, 0)
@@ -1444,7 +1531,7 @@ func (cgv *codeGenerateVisitor) ifStatementGenerateCode(stmtType interface{}) {
 			// Refill OpType JmpFalse instruction
 			index := function.OpCodeSize()
 			function.GetMutableInstruction(jmpIndex).RefillsBx(index - jmpIndex)
-		}
+		}()
 
 		if ifStmt.FalseBranch != nil {
 			ifStmt.FalseBranch.Accept(cgv, nil)
@@ -1456,7 +1543,7 @@ func (cgv *codeGenerateVisitor) ifStatementGenerateCode(stmtType interface{}) {
 	case *ElseIfStatement:
 		function := cgv.GetCurrentFunction()
 		jmpEndIndex := 0
-		{
+		func() {
 			r := cgv.GetNextRegisterId()
 			defer cgv.ResetRegisterIdGenerator(r)
 			registerId, err := cgv.GenerateRegisterId()
@@ -1469,12 +1556,12 @@ func (cgv *codeGenerateVisitor) ifStatementGenerateCode(stmtType interface{}) {
 			instruction := AsBxCode(OpTypeJmpFalse, registerId, 0)
 			jmpIndex := function.AddInstruction(instruction, ifStmt.Line)
 
-			{
+			func() {
 				// True branch block generate code
 				cgv.EnterBlock()
 				defer cgv.LeaveBlock()
 				ifStmt.TrueBranch.Accept(cgv, nil)
-			}
+			}()
 
 			// jmp to the of if-elseif-else statement after execute block
 			instruction = AsBxCode(OpTypeJmp, 0, 0)
@@ -1483,7 +1570,7 @@ func (cgv *codeGenerateVisitor) ifStatementGenerateCode(stmtType interface{}) {
 			// Refill OpType JmpFalse instruction
 			index := function.OpCodeSize()
 			function.GetMutableInstruction(jmpIndex).RefillsBx(index - jmpIndex)
-		}
+		}()
 
 		if ifStmt.FalseBranch != nil {
 			ifStmt.FalseBranch.Accept(cgv, nil)
@@ -1559,7 +1646,11 @@ func (cgv *codeGenerateVisitor) accessTableField(tableAccessorType interface{},
 			if endRegister != ExpValueCountAny && registerId+1 < endRegister {
 				keyRegister = registerId + 1
 			} else {
-				keyRegister = cgv.GetNextRegisterId()
+				var err error
+				keyRegister, err = cgv.GenerateRegisterId()
+				if err != nil {
+					panic(err)
+				}
 			}
 			tableRegister = registerId
 			valueRegister = registerId
@@ -1568,12 +1659,17 @@ func (cgv *codeGenerateVisitor) accessTableField(tableAccessorType interface{},
 			if accessor.Semantic != SemanticOpWrite {
 				panic("assert")
 			}
-			if registerId+1 == endRegister {
+			if registerId+1 != endRegister {
 				panic("assert")
 			}
 
-			tableRegister = cgv.GetNextRegisterId()
-			keyRegister = cgv.GetNextRegisterId()
+			var err error
+			if tableRegister, err = cgv.GenerateRegisterId(); err != nil {
+				panic(err)
+			}
+			if keyRegister, err = cgv.GenerateRegisterId(); err != nil {
+				panic(err)
+			}
 			valueRegister = registerId
 			opType = OpTypeSetTable
 		}
@@ -1611,7 +1707,11 @@ func (cgv *codeGenerateVisitor) accessTableField(tableAccessorType interface{},
 			if endRegister != ExpValueCountAny && registerId+1 < endRegister {
 				keyRegister = registerId + 1
 			} else {
-				keyRegister = cgv.GetNextRegisterId()
+				var err error
+				keyRegister, err = cgv.GenerateRegisterId()
+				if err != nil {
+					panic(err)
+				}
 			}
 			tableRegister = registerId
 			valueRegister = registerId
@@ -1620,12 +1720,17 @@ func (cgv *codeGenerateVisitor) accessTableField(tableAccessorType interface{},
 			if accessor.Semantic != SemanticOpWrite {
 				panic("assert")
 			}
-			if registerId+1 == endRegister {
+			if registerId+1 != endRegister {
 				panic("assert")
 			}
 
-			tableRegister = cgv.GetNextRegisterId()
-			keyRegister = cgv.GetNextRegisterId()
+			var err error
+			if tableRegister, err = cgv.GenerateRegisterId(); err != nil {
+				panic(err)
+			}
+			if keyRegister, err = cgv.GenerateRegisterId(); err != nil {
+				panic(err)
+			}
 			valueRegister = registerId
 			opType = OpTypeSetTable
 		}
@@ -1667,20 +1772,20 @@ func (cgv *codeGenerateVisitor) functionCall(funcCallType interface{}, data unsa
 		// Generate code to get caller
 		callerRegister := 0
 		if endRegister == ExpValueCountAny {
-			callerArgAdjuster = startRegister
+			callerRegister = startRegister
 		} else {
-			callerArgAdjuster, err = cgv.GenerateRegisterId()
+			callerRegister, err = cgv.GenerateRegisterId()
 			if err != nil {
 				panic(err)
 			}
 		}
 
-		{
+		func() {
 			r := cgv.GetNextRegisterId()
 			defer cgv.ResetRegisterIdGenerator(r)
 			callerData := newCgExpVarData(callerRegister, callerRegister+1)
 			funcCall.Caller.Accept(cgv, unsafe.Pointer(callerData))
-		}
+		}()
 
 		// Adjust caller, and also adjust args, return how many args adjusted
 		adjustArgs := adjustCallerArg(callerRegister)
@@ -1737,20 +1842,20 @@ func (cgv *codeGenerateVisitor) functionCall(funcCallType interface{}, data unsa
 		// Generate code to get caller
 		callerRegister := 0
 		if endRegister == ExpValueCountAny {
-			callerArgAdjuster = startRegister
+			callerRegister = startRegister
 		} else {
-			callerArgAdjuster, err = cgv.GenerateRegisterId()
+			callerRegister, err = cgv.GenerateRegisterId()
 			if err != nil {
 				panic(err)
 			}
 		}
 
-		{
+		func() {
 			r := cgv.GetNextRegisterId()
 			defer cgv.ResetRegisterIdGenerator(r)
 			callerData := newCgExpVarData(callerRegister, callerRegister+1)
 			funcCall.Caller.Accept(cgv, unsafe.Pointer(callerData))
-		}
+		}()
 
 		// Adjust caller, and also adjust args, return how many args adjusted
 		adjustArgs := adjustCallerArg(callerRegister)
@@ -0,0 +1,429 @@
+package vm
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Visitor to fold constant expressions of AST, the data of expression
+// node is the pointer of the SyntaxTree which refers to the node, folded
+// node is replaced by a Terminator of the constant result
+type constantFoldVisitor struct {
+	state *State
+}
+
+func newConstantFoldVisitor(state *State) *constantFoldVisitor {
+	return &constantFoldVisitor{state}
+}
+
+// Fold expression 'exp' and replace it by the result when it is constant
+func (cfv *constantFoldVisitor) fold(exp *SyntaxTree) {
+	if *exp != nil {
+		(*exp).Accept(cfv, unsafe.Pointer(exp))
+	}
+}
+
+// Replace the expression referred by 'data' with constant 'v',
+// the position of the new Terminator is the same as 'op'
+func (cfv *constantFoldVisitor) replace(data unsafe.Pointer, v Value, op TokenDetail) {
+	token := TokenDetail{Module: op.Module, Line: op.Line, Column: op.Column}
+	switch {
+	case v.IsNil():
+		token.Token = TokenNil
+	case v.Type() == ValueTBool && v.Bool():
+		token.Token = TokenTrue
+	case v.Type() == ValueTBool:
+		token.Token = TokenFalse
+	case v.IsInteger():
+		token.Token = TokenNumber
+		token.Integer = v.Int()
+		token.IsInteger = true
+	case v.IsFloat():
+		token.Token = TokenNumber
+		token.Number = v.Num()
+	case v.Type() == ValueTString:
+		token.Token = TokenString
+		token.Str = v.Str()
+	default:
+		panic("assert")
+	}
+
+	term := NewTerminator(token)
+	term.Semantic = SemanticOpRead
+	*(*SyntaxTree)(data) = term
+}
+
+// Get constant value of expression 'exp', return false when
+// 'exp' is not a constant
+func constantValue(exp SyntaxTree) (Value, bool) {
+	term, ok := exp.(*Terminator)
+	if !ok {
+		return Value{}, false
+	}
+
+	switch term.Token.Token {
+	case TokenNil:
+		return Value{}, true
+	case TokenTrue, TokenFalse:
+		return NewValueBValue(term.Token.Token == TokenTrue), true
+	case TokenNumber:
+		if term.Token.IsInteger {
+			return NewValueInt(term.Token.Integer), true
+		}
+		return NewValueNum(term.Token.Number), true
+	case TokenString:
+		return NewValueString(term.Token.Str), true
+	}
+	return Value{}, false
+}
+
+// Calculate arithmetic operator 'op' of number 'x' and 'y' the same as
+// VM, return false when the operation must be reported at runtime
+func foldArith(op int, x, y *Value) (Value, bool) {
+	if !x.IsNumber() || !y.IsNumber() {
+		return Value{}, false
+	}
+
+	if x.IsInteger() && y.IsInteger() {
+		a, b := x.Int(), y.Int()
+		switch op {
+		case '+':
+			return NewValueInt(a + b), true
+		case '-':
+			return NewValueInt(a - b), true
+		case '*':
+			return NewValueInt(a * b), true
+		case '%':
+			if b == 0 {
+				return Value{}, false
+			}
+			return NewValueInt(intMod(a, b)), true
+		case TokenIDiv:
+			if b == 0 {
+				return Value{}, false
+			}
+			return NewValueInt(intFloorDiv(a, b)), true
+		}
+	}
+
+	a, b := x.Num(), y.Num()
+	switch op {
+	case '+':
+		return NewValueNum(a + b), true
+	case '-':
+		return NewValueNum(a - b), true
+	case '*':
+		return NewValueNum(a * b), true
+	case '/':
+		return NewValueNum(a / b), true
+	case '^':
+		return NewValueNum(math.Pow(a, b)), true
+	case '%':
+		return NewValueNum(floatMod(a, b)), true
+	case TokenIDiv:
+		return NewValueNum(floatFloorDiv(a, b)), true
+	}
+	return Value{}, false
+}
+
+// Calculate bitwise operator 'op' of 'x' and 'y', return false
+// when any operand has no integer representation
+func foldBitwise(op int, x, y *Value) (Value, bool) {
+	a, ok1 := x.ToInteger()
+	b, ok2 := y.ToInteger()
+	if !ok1 || !ok2 {
+		return Value{}, false
+	}
+
+	switch op {
+	case '&':
+		return NewValueInt(a & b), true
+	case '|':
+		return NewValueInt(a | b), true
+	case '~':
+		return NewValueInt(a ^ b), true
+	case TokenShiftLeft:
+		return NewValueInt(shiftLeft(a, b)), true
+	case TokenShiftRight:
+		return NewValueInt(shiftLeft(a, -b)), true
+	}
+	return Value{}, false
+}
+
+// Calculate binary operator 'op' of constant 'x' and 'y'
+func (cfv *constantFoldVisitor) foldBinary(op int, x, y *Value) (Value, bool) {
+	switch op {
+	case '+', '-', '*', '/', '^', '%', TokenIDiv:
+		return foldArith(op, x, y)
+	case '&', '|', '~', TokenShiftLeft, TokenShiftRight:
+		return foldBitwise(op, x, y)
+	case TokenConcat:
+		str := func(v *Value) (string, bool) {
+			if v.Type() == ValueTString {
+				return v.Str().GetStdString(), true
+			} else if v.IsNumber() {
+				return NumberToString(v), true
+			}
+			return "", false
+		}
+		// Concat of two numbers is reported at runtime as VM does
+		s1, ok1 := str(x)
+		s2, ok2 := str(y)
+		if !ok1 || !ok2 || (x.IsNumber() && y.IsNumber()) {
+			return Value{}, false
+		}
+		return NewValueString(cfv.state.GetString(s1 + s2)), true
+	case TokenEqual:
+		return NewValueBValue(x.IsEqual(y)), true
+	case TokenNotEqual:
+		return NewValueBValue(!x.IsEqual(y)), true
+	case '<', '>', TokenLessEqual, TokenGreaterEqual:
+		if !x.IsNumber() || !y.IsNumber() {
+			return Value{}, false
+		}
+		switch op {
+		case '<':
+			return NewValueBValue(numberLess(x, y)), true
+		case '>':
+			return NewValueBValue(numberLess(y, x)), true
+		case TokenLessEqual:
+			return NewValueBValue(numberLessEqual(x, y)), true
+		default:
+			return NewValueBValue(numberLessEqual(y, x)), true
+		}
+	}
+	return Value{}, false
+}
+
+func (cfv *constantFoldVisitor) VisitChunk(chunk *Chunk, data unsafe.Pointer) {
+	chunk.Block.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitBlock(block *Block, data unsafe.Pointer) {
+	for i := range block.Statements {
+		block.Statements[i].Accept(cfv, nil)
+	}
+	if block.ReturnStmt != nil {
+		block.ReturnStmt.Accept(cfv, nil)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitReturnStatement(retStmt *ReturnStatement, data unsafe.Pointer) {
+	if retStmt.ExpList != nil {
+		retStmt.ExpList.Accept(cfv, nil)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitBreakStatement(breakStmt *BreakStatement, data unsafe.Pointer) {
+}
+
+func (cfv *constantFoldVisitor) VisitDoStatement(doStmt *DoStatement, data unsafe.Pointer) {
+	doStmt.Block.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitWhileStatement(whileStmt *WhileStatement, data unsafe.Pointer) {
+	cfv.fold(&whileStmt.Exp)
+	whileStmt.Block.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitRepeatStatement(repeatStmt *RepeatStatement, data unsafe.Pointer) {
+	repeatStmt.Block.Accept(cfv, nil)
+	cfv.fold(&repeatStmt.Exp)
+}
+
+func (cfv *constantFoldVisitor) VisitIfStatement(ifStmt *IfStatement, data unsafe.Pointer) {
+	cfv.fold(&ifStmt.Exp)
+	ifStmt.TrueBranch.Accept(cfv, nil)
+	if ifStmt.FalseBranch != nil {
+		ifStmt.FalseBranch.Accept(cfv, nil)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitElseIfStatement(elseifStmt *ElseIfStatement, data unsafe.Pointer) {
+	cfv.fold(&elseifStmt.Exp)
+	elseifStmt.TrueBranch.Accept(cfv, nil)
+	if elseifStmt.FalseBranch != nil {
+		elseifStmt.FalseBranch.Accept(cfv, nil)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitElseStatement(elseStmt *ElseStatement, data unsafe.Pointer) {
+	elseStmt.Block.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitNumericForStatement(numFor *NumericForStatement, data unsafe.Pointer) {
+	cfv.fold(&numFor.Exp1)
+	cfv.fold(&numFor.Exp2)
+	cfv.fold(&numFor.Exp3)
+	numFor.Block.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitGenericForStatement(genFor *GenericForStatement, data unsafe.Pointer) {
+	genFor.ExpList.Accept(cfv, nil)
+	genFor.Block.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitFunctionStatement(funcStmt *FunctionStatement, data unsafe.Pointer) {
+	funcStmt.FuncBody.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitFunctionName(funcName *FunctionName, data unsafe.Pointer) {
+}
+
+func (cfv *constantFoldVisitor) VisitLocalFunctionStatement(lFuncStmt *LocalFunctionStatement, data unsafe.Pointer) {
+	lFuncStmt.FuncBody.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitLocalNameListStatement(lNameListStmt *LocalNameListStatement, data unsafe.Pointer) {
+	if lNameListStmt.ExpList != nil {
+		lNameListStmt.ExpList.Accept(cfv, nil)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitAssignmentStatement(assignStmt *AssignmentStatement, data unsafe.Pointer) {
+	assignStmt.VarList.Accept(cfv, nil)
+	assignStmt.ExpList.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitVarList(varList *VarList, data unsafe.Pointer) {
+	for i := range varList.VarList {
+		cfv.fold(&varList.VarList[i])
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitTerminator(term *Terminator, data unsafe.Pointer) {
+}
+
+func (cfv *constantFoldVisitor) VisitBinaryExpression(binaryExp *BinaryExpression, data unsafe.Pointer) {
+	cfv.fold(&binaryExp.Left)
+	cfv.fold(&binaryExp.Right)
+
+	left, ok := constantValue(binaryExp.Left)
+	if !ok {
+		return
+	}
+
+	op := binaryExp.OpToken
+	if op.Token == TokenAnd || op.Token == TokenOr {
+		// Result is the left value when the right expression is skipped,
+		// otherwise fold only when the right expression is constant too
+		if left.IsFalse() == (op.Token == TokenAnd) {
+			cfv.replace(data, left, op)
+		} else if right, ok := constantValue(binaryExp.Right); ok {
+			cfv.replace(data, right, op)
+		}
+		return
+	}
+
+	right, ok := constantValue(binaryExp.Right)
+	if !ok {
+		return
+	}
+	if result, ok := cfv.foldBinary(op.Token, &left, &right); ok {
+		cfv.replace(data, result, op)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitUnaryExpression(unaryExp *UnaryExpression, data unsafe.Pointer) {
+	cfv.fold(&unaryExp.Exp)
+
+	v, ok := constantValue(unaryExp.Exp)
+	if !ok {
+		return
+	}
+
+	op := unaryExp.OpToken
+	switch op.Token {
+	case '-':
+		if v.IsInteger() {
+			cfv.replace(data, NewValueInt(-v.Int()), op)
+		} else if v.IsFloat() {
+			cfv.replace(data, NewValueNum(-v.Num()), op)
+		}
+	case '~':
+		if x, ok := v.ToInteger(); ok {
+			cfv.replace(data, NewValueInt(^x), op)
+		}
+	case '#':
+		if v.Type() == ValueTString {
+			cfv.replace(data, NewValueInt(int64(v.Str().GetLength())), op)
+		}
+	case TokenNot:
+		cfv.replace(data, NewValueBValue(v.IsFalse()), op)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitFunctionBody(funcBody *FunctionBody, data unsafe.Pointer) {
+	funcBody.BLock.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitParamList(paramList *ParamList, data unsafe.Pointer) {
+}
+
+func (cfv *constantFoldVisitor) VisitNameList(nameList *NameList, data unsafe.Pointer) {
+}
+
+func (cfv *constantFoldVisitor) VisitTableDefine(tableDef *TableDefine, data unsafe.Pointer) {
+	for i := range tableDef.Fields {
+		tableDef.Fields[i].Accept(cfv, nil)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitTableIndexField(tableIField *TableIndexField, data unsafe.Pointer) {
+	cfv.fold(&tableIField.Index)
+	cfv.fold(&tableIField.Value)
+}
+
+func (cfv *constantFoldVisitor) VisitTableNameField(tableNField *TableNameField, data unsafe.Pointer) {
+	cfv.fold(&tableNField.Value)
+}
+
+func (cfv *constantFoldVisitor) VisitTableArrayField(tableAField *TableArrayField, data unsafe.Pointer) {
+	cfv.fold(&tableAField.Value)
+}
+
+func (cfv *constantFoldVisitor) VisitIndexAccessor(indexAccessor *IndexAccessor, data unsafe.Pointer) {
+	cfv.fold(&indexAccessor.Table)
+	cfv.fold(&indexAccessor.Index)
+}
+
+func (cfv *constantFoldVisitor) VisitMemberAccessor(memberAccessor *MemberAccessor, data unsafe.Pointer) {
+	cfv.fold(&memberAccessor.Table)
+}
+
+func (cfv *constantFoldVisitor) VisitNormalFuncCall(funcCall *NormalFuncCall, data unsafe.Pointer) {
+	cfv.fold(&funcCall.Caller)
+	funcCall.Args.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitMemberFuncCall(funcCall *MemberFuncCall, data unsafe.Pointer) {
+	cfv.fold(&funcCall.Caller)
+	funcCall.Args.Accept(cfv, nil)
+}
+
+func (cfv *constantFoldVisitor) VisitFuncCallArgs(callArgs *FuncCallArgs, data unsafe.Pointer) {
+	if callArgs.Arg == nil {
+		return
+	}
+	if callArgs.Type == ArgTypeExpList {
+		callArgs.Arg.Accept(cfv, nil)
+	} else {
+		cfv.fold(&callArgs.Arg)
+	}
+}
+
+func (cfv *constantFoldVisitor) VisitExpressionList(expList *ExpressionList, data unsafe.Pointer) {
+	for i := range expList.ExpList {
+		cfv.fold(&expList.ExpList[i])
+	}
+}
+
+// Fold constant expressions of AST 'root', it should be called after
+// SemanticAnalysis and before CodeGenerate
+func FoldConstants(root SyntaxTree, state *State) {
+	if root == nil || state == nil {
+		panic("assert")
+	}
+	constantFold := newConstantFoldVisitor(state)
+	root.Accept(constantFold, nil)
+}
@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format const value for listing
+func constValueStr(v *Value) string {
+	switch {
+	case v.IsNil():
+		return "nil"
+	case v.Type() == ValueTBool:
+		return strconv.FormatBool(v.Bool())
+	case v.IsInteger():
+		return strconv.FormatInt(v.Int(), 10)
+	case v.IsFloat():
+		return strconv.FormatFloat(v.Num(), 'g', -1, 64)
+	case v.Type() == ValueTString:
+		return strconv.Quote(v.Str().GetStdString())
+	}
+	return v.TypeName()
+}
+
+// Format the function name for listing
+func functionStr(f *Function) string {
+	module := "?"
+	if f.module != nil {
+		module = f.module.GetStdString()
+	}
+	return fmt.Sprintf("function <%s:%d>", module, f.line)
+}
+
+// Format operands of instruction 'i' by operand mode
+func operandsStr(i Instruction) string {
+	switch GetOpTypeMode(GetOpCode(i)) {
+	case OpModeAB:
+		return fmt.Sprintf("%d %d", GetParamA(i), GetParamB(i))
+	case OpModeABC:
+		return fmt.Sprintf("%d %d %d", GetParamA(i), GetParamB(i), GetParamC(i))
+	case OpModeABx:
+		return fmt.Sprintf("%d %d", GetParamA(i), GetParamBx(i))
+	case OpModeAsBx:
+		return fmt.Sprintf("%d %d", GetParamA(i), GetParamsBx(i))
+	case OpModesBx:
+		return fmt.Sprintf("%d", GetParamsBx(i))
+	case OpModeABCRK:
+		return fmt.Sprintf("%d %s %s", GetParamA(i), rkStr(GetParamB(i)), rkStr(GetParamC(i)))
+	default:
+		return fmt.Sprintf("%d", GetParamA(i))
+	}
+}
+
+// Format RK operand, const index is prefixed with 'k'
+func rkStr(rk int) string {
+	if IsRKConst(rk) {
+		return fmt.Sprintf("k%d", GetRKConstIndex(rk))
+	}
+	return strconv.Itoa(rk)
+}
+
+// Describe operands of instruction at 'pc' which refer to const values,
+// upvalues, child functions or instructions, empty if there is not
+func (f *Function) operandComment(pc int) string {
+	i := f.opCodes[pc]
+	switch GetOpCode(i) {
+	case OpTypeLoadBool:
+		return strconv.FormatBool(GetParamB(i) != 0)
+	case OpTypeLoadConst, OpTypeGetGlobal, OpTypeSetGlobal:
+		if index := int(GetParamBx(i)); index < len(f.constValues) {
+			return constValueStr(&f.constValues[index])
+		}
+	case OpTypeGetUpvalue, OpTypeSetUpvalue:
+		if index := GetParamB(i); index < len(f.upvalues) {
+			return f.upvalues[index].Name.GetStdString()
+		}
+	case OpTypeClosure:
+		if index := int(GetParamBx(i)); index < len(f.childFuncs) {
+			return functionStr(f.childFuncs[index])
+		}
+	case OpTypeJmpFalse, OpTypeJmpTrue, OpTypeJmpNil, OpTypeJmp:
+		return fmt.Sprintf("to %d", pc+int(GetParamsBx(i)))
+	}
+
+	if GetOpTypeMode(GetOpCode(i)) == OpModeABCRK {
+		var consts []string
+		for _, rk := range []int{GetParamB(i), GetParamC(i)} {
+			if index := GetRKConstIndex(rk); IsRKConst(rk) && index < len(f.constValues) {
+				consts = append(consts, constValueStr(&f.constValues[index]))
+			}
+		}
+		return strings.Join(consts, " ")
+	}
+	return ""
+}
+
+func (f *Function) disassemble(b *strings.Builder) {
+	vararg := ""
+	if f.isVararg {
+		vararg = ", vararg"
+	}
+	fmt.Fprintf(b, "%s (%d instructions, %d args%s)\n",
+		functionStr(f), len(f.opCodes), f.args, vararg)
+
+	line := func(pc int, name, operands, comment string) {
+		str := fmt.Sprintf("\t[%d]\t%d\t%-12s\t%s", pc, f.opCodeLines[pc], name, operands)
+		if comment != "" {
+			str += "\t; " + comment
+		}
+		b.WriteString(str + "\n")
+	}
+
+	for pc := 0; pc < len(f.opCodes); pc++ {
+		i := f.opCodes[pc]
+		line(pc, GetOpTypeName(GetOpCode(i)), operandsStr(i), f.operandComment(pc))
+
+		// Instructions which take the next instruction as data
+		if pc+1 < len(f.opCodes) {
+			switch GetOpCode(i) {
+			case OpTypeLoadInt:
+				pc++
+				line(pc, ".Int", strconv.Itoa(f.opCodes[pc].OpCode), "")
+			case OpTypeForStep:
+				pc++
+				sBx := int(GetParamsBx(f.opCodes[pc]))
+				line(pc, ".Jmp", strconv.Itoa(sBx), fmt.Sprintf("to %d", pc+sBx))
+			}
+		}
+	}
+
+	fmt.Fprintf(b, "constants (%d):\n", len(f.constValues))
+	for index := range f.constValues {
+		fmt.Fprintf(b, "\t[%d]\t%s\n", index, constValueStr(&f.constValues[index]))
+	}
+
+	fmt.Fprintf(b, "locals (%d):\n", len(f.localVars))
+	for index, v := range f.localVars {
+		fmt.Fprintf(b, "\t[%d]\t%s\tr%d\t[%d, %d)\n",
+			index, v.Name.GetStdString(), v.RegisterId, v.BeginPc, v.EndPc)
+	}
+
+	fmt.Fprintf(b, "upvalues (%d):\n", len(f.upvalues))
+	for index, u := range f.upvalues {
+		if u.ParentLocal {
+			fmt.Fprintf(b, "\t[%d]\t%s\tlocal r%d\n", index, u.Name.GetStdString(), u.RegisterIndex)
+		} else {
+			fmt.Fprintf(b, "\t[%d]\t%s\tupvalue %d\n", index, u.Name.GetStdString(), u.RegisterIndex)
+		}
+	}
+
+	for _, child := range f.childFuncs {
+		b.WriteString("\n")
+		child.disassemble(b)
+	}
+}
+
+// Write listing of function prototype 'f' and all its child functions
+// to 'w', includes instructions, const values, local variables and upvalues
+func Disassemble(w io.Writer, f *Function) error {
+	var b strings.Builder
+	f.disassemble(&b)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
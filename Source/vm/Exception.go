@@ -1,12 +1,39 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 )
 
+// Kind of runtime error
+const (
+	RuntimeErrorKindGeneral   = iota // General runtime error
+	RuntimeErrorKindType             // Value is not the expected type
+	RuntimeErrorKindOperand          // Attempt to operate an invalid operand
+	RuntimeErrorKindBinaryOp         // Attempt to operate two invalid operands
+	RuntimeErrorKindCFunction        // Called c function reported error
+	RuntimeErrorKindInterrupt        // Execution is interrupted by the host
+	RuntimeErrorKindLimit            // Resource limit of State is exceeded
+)
+
+// Causes of interrupt error, the execution is aborted by the context
+var (
+	ErrCanceled         = errors.New("execution canceled")
+	ErrDeadlineExceeded = errors.New("execution deadline exceeded")
+)
+
+// Causes of limit error, one for each limit of State
+var (
+	ErrInstructionLimit = errors.New("instruction count limit exceeded")
+	ErrCallDepthLimit   = errors.New("call depth limit exceeded")
+	ErrStackSizeLimit   = errors.New("stack size limit exceeded")
+	ErrObjectLimit      = errors.New("object count limit exceeded")
+	ErrStackOverflow    = errors.New("stack overflow")
+)
+
 // Module file open failed, this Error will be throw
 type OpenFileFail struct {
-	what string
+	File string // File name of the module
 }
 
 func NewOpenFileFail(file string) error {
@@ -14,108 +41,224 @@ func NewOpenFileFail(file string) error {
 }
 
 func (o OpenFileFail) Error() string {
-	return o.what
+	return "can not open file " + o.File
 }
 
 // For lexer report error of token
 type LexError struct {
-	what string
+	Module string // Module name
+	Line   int    // Line number of error
+	Column int    // Column number of error
+	Desc   string // Error description
 }
 
 func NewLexError(module string, line, column int, args ...interface{}) error {
-	what := fmt.Sprintf("%s:%d:%d ", module, line, column) + fmt.Sprintln(args)
-	return LexError{what}
+	return LexError{module, line, column, fmt.Sprint(args...)}
 }
 
 func (l LexError) Error() string {
-	return l.what
+	return fmt.Sprintf("%s:%d:%d %s", l.Module, l.Line, l.Column, l.Desc)
 }
 
 // For parser report grammar error
 type ParseError struct {
-	what string
+	Module string // Module name
+	Line   int    // Line number of the token
+	Column int    // Column number of the token
+	Token  string // String of the token which caused the error
+	Desc   string // Error description
 }
 
 func NewParseError(str string, t TokenDetail) ParseError {
-	what := fmt.Sprintf("%s:%d:%d '%s' %s",
-		t.Module.GetCStr(), t.Line, t.Column, GetTokenStr(t), str)
-	return ParseError{what}
+	return ParseError{t.Module.GetCStr(), t.Line, t.Column, GetTokenStr(t), str}
 }
 
 func (p ParseError) Error() string {
-	return p.what
+	return fmt.Sprintf("%s:%d:%d '%s' %s", p.Module, p.Line, p.Column, p.Token, p.Desc)
 }
 
 // For semantic analyser report semantic error
 type SemanticError struct {
-	what string
+	Module string // Module name
+	Line   int    // Line number of the token
+	Column int    // Column number of the token
+	Token  string // String of the token which caused the error
+	Desc   string // Error description
 }
 
 func NewSemanticError(str string, t TokenDetail) error {
-	what := fmt.Sprintf("%s:%d:%d '%s' %s",
-		t.Module.GetCStr(), t.Line, t.Column, GetTokenStr(t), str)
-	return SemanticError{what}
+	return SemanticError{t.Module.GetCStr(), t.Line, t.Column, GetTokenStr(t), str}
 }
 
 func (s SemanticError) Error() string {
-	return s.what
+	return fmt.Sprintf("%s:%d:%d '%s' %s", s.Module, s.Line, s.Column, s.Token, s.Desc)
 }
 
 // For code generator report error
 type CodeGenerateError struct {
-	what string
+	Module string // Module name
+	Line   int    // Line number of error
+	Desc   string // Error description
 }
 
 func NewCodeGenerateError(module string, line int, args ...interface{}) error {
-	what := fmt.Sprintf("%s:%d ", module, line) + fmt.Sprintln(args)
-	return CodeGenerateError{what}
+	return CodeGenerateError{module, line, fmt.Sprint(args...)}
 }
 
 func (c CodeGenerateError) Error() string {
-	return c.what
+	return fmt.Sprintf("%s:%d %s", c.Module, c.Line, c.Desc)
+}
+
+// For loader report error of binary chunk
+type BinaryChunkError struct {
+	Module string // Name of the chunk
+	Desc   string // Error description
+}
+
+func NewBinaryChunkError(module string, args ...interface{}) error {
+	return BinaryChunkError{module, fmt.Sprint(args...)}
+}
+
+func (b BinaryChunkError) Error() string {
+	return fmt.Sprintf("%s: bad binary chunk, %s", b.Module, b.Desc)
 }
 
 // Report error of call c function
 type CallCFuncError struct {
-	what string
+	Desc string // Error description
 }
 
 func NewCallCFuncError(args ...interface{}) error {
-	return CallCFuncError{fmt.Sprintln(args)}
+	return CallCFuncError{fmt.Sprint(args...)}
 }
 
 func (c CallCFuncError) Error() string {
-	return c.what
+	return c.Desc
 }
 
 // For VM report runtime error
 type RuntimeError struct {
-	what string
+	Module    string       // Module name of the error instruction
+	Line      int          // Line number of the error instruction
+	Kind      int          // RuntimeErrorKind
+	Desc      string       // Error description
+	Traceback []TraceFrame // Stack frames when error occurred, innermost first
+	Cause     error        // Cause of interrupt or limit error, nil for other kinds
 }
 
 func NewRuntimeError1(module string, line int, desc string) error {
-	what := fmt.Sprintf("%s:%d %s", module, line, desc)
-	return RuntimeError{what}
+	return RuntimeError{Module: module, Line: line, Kind: RuntimeErrorKindGeneral, Desc: desc}
 }
 
 func NewRuntimeError2(module string, line int, v Value, vName, expectType string) error {
-	what := fmt.Sprintf("%s:%d %s is a %s value, expect a %s value",
-		module, line, vName, v.TypeName(), expectType)
-	return RuntimeError{what}
+	desc := fmt.Sprintf("%s is a %s value, expect a %s value",
+		vName, v.TypeName(), expectType)
+	return RuntimeError{Module: module, Line: line, Kind: RuntimeErrorKindType, Desc: desc}
 }
 
 func NewRuntimeError3(module string, line int, v Value, vName, vScope, op string) error {
-	what := fmt.Sprintf("%s:%d attempt to %s %s '%s' (a %s value)",
-		module, line, op, vScope, vName, v.TypeName())
-	return RuntimeError{what}
+	desc := fmt.Sprintf("attempt to %s %s '%s' (a %s value)",
+		op, vScope, vName, v.TypeName())
+	return RuntimeError{Module: module, Line: line, Kind: RuntimeErrorKindOperand, Desc: desc}
 }
 
 func NewRuntimeError4(module string, line int, v1, v2 Value, op string) error {
-	what := fmt.Sprintf("%s:%d attempt to %s %s with %s",
-		module, line, op, v1.TypeName(), v2.TypeName())
-	return RuntimeError{what}
+	desc := fmt.Sprintf("attempt to %s %s with %s",
+		op, v1.TypeName(), v2.TypeName())
+	return RuntimeError{Module: module, Line: line, Kind: RuntimeErrorKindBinaryOp, Desc: desc}
+}
+
+// Interrupt error can not be caught by protected call in script,
+// it aborts the execution to the host
+func NewInterruptError(module string, line int, cause error) error {
+	return RuntimeError{Module: module, Line: line, Kind: RuntimeErrorKindInterrupt,
+		Desc: cause.Error(), Cause: cause}
+}
+
+// Limit error can be caught by protected call in script
+func NewLimitError(module string, line int, cause error) error {
+	return RuntimeError{Module: module, Line: line, Kind: RuntimeErrorKindLimit,
+		Desc: cause.Error(), Cause: cause}
 }
 
 func (r RuntimeError) Error() string {
-	return r.what
+	return fmt.Sprintf("%s:%d: %s", r.Module, r.Line, r.Desc)
+}
+
+// Get the cause of interrupt or limit error, then errors.Is can be used
+// to check which one caused the error, e.g. ErrCanceled
+func (r RuntimeError) Unwrap() error {
+	return r.Cause
+}
+
+func isInterruptError(err error) bool {
+	e, ok := err.(RuntimeError)
+	return ok && e.Kind == RuntimeErrorKindInterrupt
+}
+
+// Get error message with stack traceback
+func (r RuntimeError) StackTrace() string {
+	return r.Error() + "\n" + FormatTraceback(r.Traceback)
+}
+
+// Stack frame info of traceback
+type TraceFrame struct {
+	IsGoFunction bool   // The frame is a call of Go function
+	IsMainChunk  bool   // The frame is a call of module or string function
+	Module       string // Module name of the function
+	Line         int    // Current line of the frame
+	FuncLine     int    // Line of the function define
+}
+
+func (t TraceFrame) String() string {
+	if t.IsGoFunction {
+		return "[Go function]"
+	} else if t.IsMainChunk {
+		return fmt.Sprintf("%s:%d: in main chunk", t.Module, t.Line)
+	} else {
+		return fmt.Sprintf("%s:%d: in function <%s:%d>",
+			t.Module, t.Line, t.Module, t.FuncLine)
+	}
+}
+
+// Format stack frames as traceback string
+func FormatTraceback(frames []TraceFrame) string {
+	str := "stack traceback:"
+	for _, frame := range frames {
+		str += "\n\t" + frame.String()
+	}
+	return str
+}
+
+// Error thrown by script, the error value can be any Value
+type ScriptError struct {
+	value     Value
+	Traceback []TraceFrame // Stack frames when error thrown, innermost first
+}
+
+func NewScriptError(value Value) error {
+	return ScriptError{value: value}
+}
+
+// Get the error value
+func (s ScriptError) GetValue() Value {
+	return s.value
+}
+
+// Get error message with stack traceback
+func (s ScriptError) StackTrace() string {
+	return s.Error() + "\n" + FormatTraceback(s.Traceback)
+}
+
+func (s ScriptError) Error() string {
+	switch s.value.Type() {
+	case ValueTString:
+		return s.value.Str().GetCStr()
+	case ValueTNumber:
+		return NumberToString(&s.value)
+	case ValueTNil:
+		return "nil"
+	default:
+		return fmt.Sprintf("(error object is a %s value)", s.value.TypeName())
+	}
 }
@@ -15,6 +15,7 @@ type Function struct {
 	line        int            // function define line at module
 	args        int            // count of args
 	isVararg    bool           // has '...' param or not
+	registers   int            // count of registers used by instructions, 0 when not counted
 	superior    *Function      // superior function pointer
 }
 
@@ -73,12 +74,8 @@ func (f *Function) Accept(v GCObjectVisitor) {
 }
 
 // Get function instructions and size
-func (f *Function) GetOpCodes() *Instruction {
-	if len(f.opCodes) == 0 {
-		return nil
-	} else {
-		return &f.opCodes[0]
-	}
+func (f *Function) GetOpCodes() []Instruction {
+	return f.opCodes
 }
 
 func (f *Function) OpCodeSize() int {
@@ -90,6 +87,70 @@ func (f *Function) GetMutableInstruction(index int) *Instruction {
 	return &f.opCodes[index]
 }
 
+// Get count of registers used by instructions of the function, registers
+// above it are not used by the frame of the function. Instructions must
+// not be changed after it is counted.
+func (f *Function) RegisterCount() int {
+	if f.registers == 0 {
+		f.registers = f.countRegisters()
+	}
+	return f.registers
+}
+
+func (f *Function) countRegisters() int {
+	count := f.args
+	use := func(end int) {
+		if end > count {
+			count = end
+		}
+	}
+
+	for pc := 0; pc < len(f.opCodes); pc++ {
+		i := f.opCodes[pc]
+		a := GetParamA(i)
+		switch GetOpCode(i) {
+		case OpTypeJmp:
+		case OpTypeFillNil:
+			use(GetParamB(i))
+		case OpTypeMove:
+			use(a + 1)
+			use(GetParamB(i) + 1)
+		case OpTypeSetTable, OpTypeGetTable, OpTypeForInit, OpTypeForStep:
+			use(a + 1)
+			use(GetParamB(i) + 1)
+			use(GetParamC(i) + 1)
+		case OpTypeCall:
+			// Args are in registers above 'a', then results are
+			use(a + GetParamB(i))
+			use(a + GetParamC(i) - 1)
+		case OpTypeTailCall:
+			use(a + GetParamB(i))
+		case OpTypeVarArg, OpTypeRet:
+			use(a + int(GetParamsBx(i)))
+		default:
+			use(a + 1)
+			if GetOpTypeMode(GetOpCode(i)) == OpModeABCRK {
+				for _, rk := range []int{GetParamB(i), GetParamC(i)} {
+					if !IsRKConst(rk) {
+						use(rk + 1)
+					}
+				}
+			}
+		}
+
+		// Skip the integer of LoadInt and the jump of ForStep
+		if op := GetOpCode(i); op == OpTypeLoadInt || op == OpTypeForStep {
+			pc++
+		}
+	}
+
+	// A function uses one register at least, so the count is not 0
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
 // Add instruction, 'line' is line number of the instruction 'i',
 // return index of the new instruction
 func (f *Function) AddInstruction(i Instruction, line int) int {
@@ -121,6 +182,7 @@ func (f *Function) FixedArgCount() int {
 // Set module and function define start line
 func (f *Function) SetModuleName(module *String) {
 	f.module = module
+	f.barrier(f)
 }
 
 func (f *Function) SetLine(line int) {
@@ -130,40 +192,62 @@ func (f *Function) SetLine(line int) {
 // Set superior function
 func (f *Function) SetSuperior(superior *Function) {
 	f.superior = superior
+	f.barrier(f)
+}
+
+// Get superior function, return nil when the function is a module
+// or string function
+func (f *Function) GetSuperior() *Function {
+	return f.superior
 }
 
 // Add const number and return index of the const value
 func (f *Function) AddConstNumber(num float64) int {
-	v := Value{Type: ValueTNumber, Num: num}
+	v := NewValueNum(num)
+	return f.AddConstValue(&v)
+}
+
+// Add const integer and return index of the const value
+func (f *Function) AddConstInt(num int64) int {
+	v := NewValueInt(num)
 	return f.AddConstValue(&v)
 }
 
 // Add const String and return index of the const value
 func (f *Function) AddConstString(str *String) int {
-	v := Value{Type: ValueTString, Str: str}
+	v := NewValueString(str)
 	return f.AddConstValue(&v)
 }
 
 // Add const Value and return index of the const value
 func (f *Function) AddConstValue(v *Value) int {
 	f.constValues = append(f.constValues, *v)
+	f.barrier(f)
 	return len(f.constValues) - 1
 }
 
+// Get count of const values
+func (f *Function) ConstValueCount() int {
+	return len(f.constValues)
+}
+
 // Add local variable debug info
 func (f *Function) AddLocalVar(name *String, registerId, beginPc, endPc int) {
 	f.localVars = append(f.localVars, localVarInfo{name, registerId, beginPc, endPc})
+	f.barrier(f)
 }
 
 // Add child function, return index of the function
 func (f *Function) AddChildFunction(child *Function) int {
 	f.childFuncs = append(f.childFuncs, child)
+	f.barrier(f)
 	return len(f.childFuncs) - 1
 }
 
 // Add a upvalue, return index of the upvalue
 func (f *Function) AddUpvalue(name *String, parentLocal bool, registerIndex int) int {
 	f.upvalues = append(f.upvalues, UpvalueInfo{name, parentLocal, registerIndex})
+	f.barrier(f)
 	return len(f.upvalues) - 1
 }
 
@@ -263,11 +347,13 @@ func (c *Closure) GetPrototype() *Function {
 // Set closure prototype Function
 func (c *Closure) SetPrototype(prototype *Function) {
 	c.prototype = prototype
+	c.barrier(c)
 }
 
 // Add upvalue
 func (c *Closure) AddUpvalue(upvalue *Upvalue) {
 	c.upvalues = append(c.upvalues, upvalue)
+	c.barrier(c)
 }
 
 // Get upvalue by index
@@ -2,9 +2,8 @@ package vm
 
 import (
 	"container/list"
-	"fmt"
-	"os"
 	"time"
+	"unsafe"
 )
 
 // Generational of GC object
@@ -14,12 +13,29 @@ const (
 	GCGen2            // Oldest generation
 )
 
-// GC flag for mark GC object
+// GC flag for mark GC object, there are two whites, objects of the
+// current white are alive or not marked yet, and objects of the other
+// white are dead when sweeping
 const (
 	GCFlagWhite = iota
+	GCFlagWhite1
+	GCFlagGray
 	GCFlagBlack
 )
 
+// Phase of incremental major collection
+const (
+	gcPhasePause     = iota // No major collection is in progress
+	gcPhasePropagate        // Marking gray objects step by step
+	gcPhaseSweep            // Sweeping generations step by step
+)
+
+// Collection mode of GC
+const (
+	GCModeGenerational = iota // Collect young generation mostly, and all generations sometimes
+	GCModeIncremental         // Collect all generations in every collection
+)
+
 // GC object type allocated by GC
 const (
 	GCObjectTypeTable = iota
@@ -28,6 +44,7 @@ const (
 	GCObjectTypeUpvalue
 	GCObjectTypeString
 	GCObjectTypeUserData
+	GCObjectTypeThread
 )
 
 // Visit for visit all GC objects
@@ -39,6 +56,7 @@ type GCObjectVisitor interface {
 	VisitUpvalue(value *Upvalue) bool
 	VisitString(str *String) bool
 	VisitUserData(userData *UserData) bool
+	VisitThread(thread *Thread) bool
 }
 
 // Base class of GC object, GC use this class to manipulate all GC objects
@@ -51,32 +69,56 @@ type gcObjectField struct {
 	generation int      // Generation flag
 	gc         int      // GCFlag
 	gcObjType  int      // GCObjectType
+	barriered  bool     // Whether the object is in barriered list
+	collector  *GC      // GC which allocated the object, nil when it is not allocated by GC
 }
 
 func newGCObjectField() *gcObjectField {
 	return &gcObjectField{generation: GCGen0}
 }
 
-// GC object barrier checker
-func CheckBarrier(obj GCObject) bool {
+// Get GC object field of 'obj'
+func getGCObjectField(obj GCObject) *gcObjectField {
 	switch object := obj.(type) {
 	case *Table:
-		return object.generation != GCGen0
+		return &object.gcObjectField
 	case *Function:
-		return object.generation != GCGen0
+		return &object.gcObjectField
 	case *Closure:
-		return object.generation != GCGen0
+		return &object.gcObjectField
 	case *Upvalue:
-		return object.generation != GCGen0
+		return &object.gcObjectField
 	case *String:
-		return object.generation != GCGen0
+		return &object.gcObjectField
 	case *UserData:
-		return object.generation != GCGen0
+		return &object.gcObjectField
+	case *Thread:
+		return &object.gcObjectField
 	default:
 		panic("Unrecognizable data type")
 	}
 }
 
+// Whether barrier is needed when GC objects are stored into the object,
+// old objects are scanned by minor collection, and black objects are
+// scanned again by major collection
+func (f *gcObjectField) needBarrier() bool {
+	return f.generation != GCGen0 || f.gc == GCFlagBlack
+}
+
+// Barrier 'obj' whose field is 'f' when GC objects are stored into it,
+// objects which are not allocated by GC are ignored
+func (f *gcObjectField) barrier(obj GCObject) {
+	if f.collector != nil && (f.gc == GCFlagBlack || f.generation != GCGen0 && !f.barriered) {
+		f.collector.SetBarrier(obj)
+	}
+}
+
+// GC object barrier checker
+func CheckBarrier(obj GCObject) bool {
+	return getGCObjectField(obj).needBarrier()
+}
+
 type GC struct {
 	gen0 genInfo // Youngest generation
 	gen1 genInfo // Mesozoic generation
@@ -86,33 +128,139 @@ type GC struct {
 	majorTraveller RootTravelType // Major root traveller
 
 	barriered list.List // Barriered GC objects, and its element.value is GCObject
+	finalized list.List // Unreachable user data wait for finalization, and its element.value is *UserData
+
+	userDatas []*UserData // Alive user data which may need finalization
+	gray      []GCObject  // Gray objects wait for scanning
+	grayAgain []GCObject  // Objects which are scanned again in atomic phase
+
+	weakValues []*Table // Scanned tables which have weak values
+	ephemerons []*Table // Scanned tables which have weak keys
+	allWeak    []*Table // Scanned tables which have weak keys and weak values
+
+	objDeleter      GCObjectDeleter   // GC object Deleter
+	finalizeChecker GCFinalizeChecker // Check user data need finalization or not
+	weakModeChecker GCWeakModeChecker // Get weak mode of table which has metaTable
+	observer        GCObserver        // Observer of collections, nil when not set
+
+	mode    int  // GCMode
+	stopped bool // Collection is not triggered by CheckGC when it is true
+
+	objectLimit   uint // Max count of objects, 0 means no limit
+	limitExceeded bool // Whether any allocation exceeded objectLimit since last check
+
+	white       int           // Current white, objects of the other white are dead when sweeping
+	phase       int           // Phase of major collection
+	sweeping    [3]GCObject   // Object lists of generations which are being swept
+	promoted    uint          // Count of GCGen0 objects moved to GCGen1 by sweeping
+	allocated   uint          // Count of objects allocated since last step
+	stepSize    int           // Work units of each step, 0 is unbounded
+	pauseTarget time.Duration // Max pause of each step, 0 is unbounded
+
+	cycleBefore GCGenerations // Generations before current major collection
+	cyclePause  time.Duration // Cumulative pause of current major collection
+	cycleSteps  uint          // Count of steps of current major collection
+
+	minorCount uint          // Count of minor collections
+	majorCount uint          // Count of major collections
+	minorPause time.Duration // Cumulative duration of minor collections
+	majorPause time.Duration // Cumulative duration of major collections
+	maxPause   time.Duration // Max pause of all collections and steps
+}
 
-	objDeleter GCObjectDeleter // GC object Deleter
-	logStream  *os.File        // Log file
+// Object count and threshold count of a generation
+type GCGenStats struct {
+	Count     uint // Count of GC objects
+	Threshold uint // Collection is triggered when count reaches threshold
+}
+
+// Object counts and threshold counts of all generations
+type GCGenerations struct {
+	Gen0 GCGenStats
+	Gen1 GCGenStats
+	Gen2 GCGenStats
+}
+
+// Statistics of GC, minor collection collects GCGen0, and major
+// collection collects all generations
+type GCStats struct {
+	GCGenerations
+
+	MinorCollections uint          // Count of minor collections
+	MajorCollections uint          // Count of major collections
+	MinorPause       time.Duration // Cumulative pause of minor collections
+	MajorPause       time.Duration // Cumulative pause of major collections
+	MaxPause         time.Duration // Max pause of a minor collection or a step of major collection
+}
+
+// Event of a minor or major collection
+type GCEvent struct {
+	Major    bool          // Major collection when true, otherwise minor collection
+	Before   GCGenerations // Generations before the collection
+	After    GCGenerations // Generations after the collection
+	Duration time.Duration // Pause of the collection, sum of all steps of major collection
+	Steps    uint          // Count of steps, major collection may be done in many steps
+}
+
+// Observer of collections, e.g. route GC events to a logger
+type GCObserver interface {
+	// Called after each collection
+	OnGC(event GCEvent)
+}
+
+// Adapter to use a function as GCObserver
+type GCObserverFunc func(event GCEvent)
+
+func (f GCObserverFunc) OnGC(event GCEvent) {
+	f(event)
 }
 
 type RootTravelType func(GCObjectVisitor)
 type GCObjectDeleter func(GCObject, int)
+type GCFinalizeChecker func(*UserData) bool
+type GCWeakModeChecker func(*Table) (weakKey, weakValue bool)
 
-func NewGC(deleter GCObjectDeleter, log bool) *GC {
+func NewGC(deleter GCObjectDeleter) *GC {
 	gc := GC{objDeleter: deleter}
 	gc.gen0.thresholdCount = kGen0InitThresholdCount
 	gc.gen1.thresholdCount = kGen1InitThresholdCount
-
-	if log {
-		f, err := os.OpenFile("gc.log", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-		if err != nil {
-			panic(err)
-		}
-		gc.logStream = f
-	}
+	gc.stepSize = kDefaultStepSize
+	gc.pauseTarget = kDefaultPauseTarget
 	return &gc
 }
 
+// Set observer of collections, nil removes the observer
+func (gc *GC) SetObserver(observer GCObserver) {
+	gc.observer = observer
+}
+
 func (gc *GC) ResetDeleter(objDeleter GCObjectDeleter) {
 	gc.objDeleter = objDeleter
 }
 
+// Set finalize checker, unreachable user data which checker returns true
+// will survive the collection and wait for finalization
+func (gc *GC) SetFinalizeChecker(checker GCFinalizeChecker) {
+	gc.finalizeChecker = checker
+}
+
+// Set weak mode checker, it is called with tables which have metaTable
+// when they are marked, entries of weak keys or weak values which are
+// not marked are removed from the tables
+func (gc *GC) SetWeakModeChecker(checker GCWeakModeChecker) {
+	gc.weakModeChecker = checker
+}
+
+// Pop an unreachable user data which waits for finalization,
+// return nil when there is no one
+func (gc *GC) PopFinalizeObject() *UserData {
+	e := gc.finalized.Front()
+	if e == nil {
+		return nil
+	}
+	return gc.finalized.Remove(e).(*UserData)
+}
+
 // Set minor and major root travel functions
 func (gc *GC) SetRootTraveller(minor, major RootTravelType) {
 	gc.minorTraveller = minor
@@ -164,42 +312,240 @@ func (gc *GC) NewUserData(gen int) *UserData {
 	u := &UserData{}
 	u.gcObjType = GCObjectTypeUserData
 	gc.setObjectGen(u, gen)
+	gc.userDatas = append(gc.userDatas, u)
 	return u
 }
 
-// Set Gc object barrier
+// Alloc GC objects
+func (gc *GC) NewThread(gen int) *Thread {
+	t := NewThread()
+	t.gcObjType = GCObjectTypeThread
+	gc.setObjectGen(t, gen)
+	return t
+}
+
+// Get count of all GC objects
+func (gc *GC) GetObjectCount() uint {
+	return gc.gen0.count + gc.gen1.count + gc.gen2.count
+}
+
+// Get estimated bytes of memory used by all GC objects. Objects are
+// allocated by Go, so the size is counted from their fields and buffers.
+func (gc *GC) GetObjectSize() uint {
+	size := uintptr(0)
+	lists := []GCObject{gc.gen0.gen, gc.gen1.gen, gc.gen2.gen}
+	for _, obj := range append(lists, gc.sweeping[:]...) {
+		for ; obj != nil; obj = getGCObjectField(obj).next {
+			size += getGCObjectSize(obj)
+		}
+	}
+	return uint(size)
+}
+
+// Get estimated bytes of memory used by 'obj'
+func getGCObjectSize(obj GCObject) uintptr {
+	valueSize := unsafe.Sizeof(Value{})
+	pointerSize := unsafe.Sizeof(uintptr(0))
+	switch object := obj.(type) {
+	case *Table:
+		size := unsafe.Sizeof(*object) +
+			uintptr(cap(object.hash.slots))*unsafe.Sizeof(0) +
+			uintptr(cap(object.hash.nodes))*unsafe.Sizeof(hashNode{})
+		if object.array != nil {
+			size += unsafe.Sizeof(*object.array) + uintptr(cap(*object.array))*valueSize
+		}
+		return size
+	case *Function:
+		return unsafe.Sizeof(*object) +
+			uintptr(cap(object.opCodes))*unsafe.Sizeof(Instruction{}) +
+			uintptr(cap(object.opCodeLines))*unsafe.Sizeof(0) +
+			uintptr(cap(object.constValues))*valueSize +
+			uintptr(cap(object.localVars))*unsafe.Sizeof(localVarInfo{}) +
+			uintptr(cap(object.childFuncs))*pointerSize +
+			uintptr(cap(object.upvalues))*unsafe.Sizeof(UpvalueInfo{})
+	case *Closure:
+		return unsafe.Sizeof(*object) + uintptr(cap(object.upvalues))*pointerSize
+	case *Upvalue:
+		return unsafe.Sizeof(*object)
+	case *String:
+		return unsafe.Sizeof(*object) + uintptr(len(object.strBuffer)+len(object.str))
+	case *UserData:
+		return unsafe.Sizeof(*object)
+	case *Thread:
+		size := unsafe.Sizeof(*object) + uintptr(cap(object.transfer))*valueSize
+		if object.stack != nil {
+			for _, chunk := range object.stack.chunks {
+				size += uintptr(cap(chunk)) * valueSize
+			}
+		}
+		return size
+	default:
+		panic("Unrecognizable data type")
+	}
+}
+
+// Set max count of GC objects, 0 means no limit. Allocations exceeding
+// the limit are recorded, and reported by ObjectLimitExceeded.
+func (gc *GC) SetObjectLimit(limit uint) {
+	gc.objectLimit = limit
+	gc.limitExceeded = false
+}
+
+// Return true when any allocation exceeded the object limit since last
+// call, the record is cleared by this call
+func (gc *GC) ObjectLimitExceeded() bool {
+	exceeded := gc.limitExceeded
+	gc.limitExceeded = false
+	return exceeded
+}
+
+// Check count of GC objects is not more than 'limit', run major GC to
+// collect unreachable objects when exceeded, return false when it is
+// still exceeded after major GC
+func (gc *GC) CheckObjectLimit(limit uint) bool {
+	if gc.GetObjectCount() <= limit {
+		return true
+	}
+	gc.fullGC()
+	return gc.GetObjectCount() <= limit
+}
+
+// Get statistics of GC
+func (gc *GC) Stats() GCStats {
+	return GCStats{
+		GCGenerations:    gc.generations(),
+		MinorCollections: gc.minorCount,
+		MajorCollections: gc.majorCount,
+		MinorPause:       gc.minorPause,
+		MajorPause:       gc.majorPause,
+		MaxPause:         gc.maxPause,
+	}
+}
+
+// Run a major collection to collect all unreachable objects, major
+// collection in progress is finished first
+func (gc *GC) FullGC() {
+	gc.fullGC()
+}
+
+// Run a collection of current mode even if GC is stopped, it is a minor
+// collection in generational mode, and a step of major collection in
+// incremental mode, return true when the collection is finished
+func (gc *GC) Step() bool {
+	if gc.mode == GCModeIncremental || gc.phase != gcPhasePause {
+		return gc.step(gc.stepSize, gc.pauseTarget)
+	}
+	gc.minorCollect()
+	return true
+}
+
+// Stop triggering collection by CheckGC
+func (gc *GC) Stop() {
+	gc.stopped = true
+}
+
+// Restart triggering collection by CheckGC
+func (gc *GC) Restart() {
+	gc.stopped = false
+}
+
+// Whether collection is triggered by CheckGC
+func (gc *GC) IsRunning() bool {
+	return !gc.stopped
+}
+
+// Set collection mode and return the previous mode
+func (gc *GC) SetMode(mode int) int {
+	old := gc.mode
+	gc.mode = mode
+	return old
+}
+
+// Get collection mode
+func (gc *GC) GetMode() int {
+	return gc.mode
+}
+
+// Set work units of each step of major collection, a unit is about
+// marking or sweeping an object, 0 means a step finishes the collection
+func (gc *GC) SetStepSize(size int) {
+	gc.stepSize = size
+}
+
+// Get work units of each step of major collection
+func (gc *GC) GetStepSize() int {
+	return gc.stepSize
+}
+
+// Set max pause of each step of major collection, a step stops when
+// it runs longer than 'target', 0 means a step is not limited by time
+func (gc *GC) SetPauseTarget(target time.Duration) {
+	gc.pauseTarget = target
+}
+
+// Get max pause of each step of major collection
+func (gc *GC) GetPauseTarget() time.Duration {
+	return gc.pauseTarget
+}
+
+// Whether a major collection is in progress
+func (gc *GC) IsCollecting() bool {
+	return gc.phase != gcPhasePause
+}
+
+// Set Gc object barrier, it must be called when GC objects are stored
+// into 'obj' which CheckBarrier returns true
 func (gc *GC) SetBarrier(obj GCObject) {
-	gc.barriered.PushBack(obj)
+	field := getGCObjectField(obj)
+
+	// Black object is scanned again in atomic phase when major collection
+	// is marking, so objects which are changed frequently are scanned once
+	// in each step, black threads are always in grayAgain list
+	if field.gc == GCFlagBlack && gc.phase == gcPhasePropagate &&
+		field.gcObjType != GCObjectTypeThread {
+		field.gc = GCFlagGray
+		gc.grayAgain = append(gc.grayAgain, obj)
+	}
+
+	// Old object is scanned by minor collection, young objects may be
+	// stored in it. Black object is not swept yet when major collection
+	// is sweeping, it will be old after sweeping
+	old := field.generation != GCGen0 ||
+		field.gc == GCFlagBlack && gc.phase == gcPhaseSweep
+	if old && !field.barriered {
+		field.barriered = true
+		gc.barriered.PushBack(obj)
+	}
 }
 
-// Check run GC
+// Keep string 'str' which is found in string pool alive, the string
+// may be unreachable but it is not swept yet
+func (gc *GC) reviveString(str *String) {
+	if gc.phase == gcPhaseSweep && str.gc == gc.otherWhite() {
+		str.gc = gc.white
+	}
+}
+
+// Check run GC, a step of major collection is done every some allocations
+// when it is in progress, otherwise a collection is started when GCGen0
+// reaches threshold
 func (gc *GC) CheckGC() {
-	if gc.gen0.count >= gc.gen0.thresholdCount {
-		gen0Count := gc.gen0.count
-		gen0Threshold := gc.gen0.thresholdCount
-		gen1Count := gc.gen1.count
-		gen1Threshold := gc.gen1.thresholdCount
-		gen2Count := gc.gen2.count
-		gen2Threshold := gc.gen2.thresholdCount
-
-		var gcName string
-		start := time.Now()
-		if gc.gen1.count >= gc.gen1.thresholdCount {
-			gcName = "major"
-			gc.majorGC()
-		} else {
-			gcName = "minor"
-			gc.minorGC()
+	if gc.stopped {
+		return
+	}
+
+	if gc.phase != gcPhasePause {
+		if gc.allocated >= gc.stepAllocation() {
+			gc.step(gc.stepSize, gc.pauseTarget)
 		}
+		return
+	}
 
-		duration := time.Since(start)
-		_, err := fmt.Fprintf(gc.logStream, "%s[%v]: %d %d | %d %d | %d %d"+
-			" - %d %d | %d %d | %d %d", gcName, duration, gen0Count, gen0Threshold,
-			gen1Count, gen1Threshold, gen2Count, gen2Threshold, gc.gen0.count,
-			gc.gen0.thresholdCount, gc.gen1.count, gc.gen1.thresholdCount,
-			gc.gen2.count, gc.gen2.thresholdCount)
-		if err != nil {
-			panic(err)
+	if gc.gen0.count >= gc.gen0.thresholdCount {
+		if gc.mode == GCModeIncremental || gc.gen1.count >= gc.gen1.thresholdCount {
+			gc.step(gc.stepSize, gc.pauseTarget)
+		} else {
+			gc.minorCollect()
 		}
 	}
 }
@@ -209,6 +555,16 @@ const (
 	kGen1InitThresholdCount = 512
 	kGen0MaxThresholdCount  = 2048
 	kGen1MaxThresholdCount  = 102400
+
+	kDefaultStepSize    = 1024
+	kDefaultPauseTarget = time.Millisecond
+
+	// A step is done every 1/kStepAllocationRatio step size allocations,
+	// so marking and sweeping are faster than allocation
+	kStepAllocationRatio = 4
+
+	// Check pause target every kPauseCheckInterval work loops
+	kPauseCheckInterval = 64
 )
 
 type genInfo struct {
@@ -221,53 +577,119 @@ func newGenInfo() *genInfo {
 	return &genInfo{}
 }
 
-func (gc *GC) setObjectGen(obj GCObject, gen int) {
-	var genInfo *genInfo
+func (gc *GC) getGenInfo(gen int) *genInfo {
 	switch gen {
 	case GCGen0:
-		genInfo = &gc.gen0
+		return &gc.gen0
 	case GCGen1:
-		genInfo = &gc.gen1
+		return &gc.gen1
 	case GCGen2:
-		genInfo = &gc.gen2
+		return &gc.gen2
 	}
+	panic("assert")
+}
 
-	if genInfo == nil {
-		panic("assert")
-	}
+func (gc *GC) setObjectGen(obj GCObject, gen int) {
+	genInfo := gc.getGenInfo(gen)
 
-	switch object := obj.(type) {
-	case *Table:
-		object.generation = gen
-		object.next = genInfo.gen
-	case *Function:
-		object.generation = gen
-		object.next = genInfo.gen
-	case *Closure:
-		object.generation = gen
-		object.next = genInfo.gen
-	case *Upvalue:
-		object.generation = gen
-		object.next = genInfo.gen
-	case *String:
-		object.generation = gen
-		object.next = genInfo.gen
-	case *UserData:
-		object.generation = gen
-		object.next = genInfo.gen
-	}
+	field := getGCObjectField(obj)
+	field.generation = gen
+	field.gc = gc.white
+	field.collector = gc
+	field.next = genInfo.gen
 	genInfo.gen = obj
 	genInfo.count++
+	gc.allocated++
+	if gc.objectLimit > 0 && gc.GetObjectCount() > gc.objectLimit {
+		gc.limitExceeded = true
+	}
+}
+
+// Get the white which is dead when sweeping
+func (gc *GC) otherWhite() int {
+	return gc.white ^ 1
+}
+
+// Count of allocations between two steps
+func (gc *GC) stepAllocation() uint {
+	return uint(gc.stepSize / kStepAllocationRatio)
+}
+
+// Get object counts and threshold counts of all generations
+func (gc *GC) generations() GCGenerations {
+	return GCGenerations{
+		Gen0: GCGenStats{gc.gen0.count, gc.gen0.thresholdCount},
+		Gen1: GCGenStats{gc.gen1.count, gc.gen1.thresholdCount},
+		Gen2: GCGenStats{gc.gen2.count, gc.gen2.thresholdCount},
+	}
+}
+
+func (gc *GC) recordPause(duration time.Duration) {
+	if duration > gc.maxPause {
+		gc.maxPause = duration
+	}
+}
+
+// Run minor GC, record it in statistics and report it to observer
+func (gc *GC) minorCollect() {
+	var before GCGenerations
+	if gc.observer != nil {
+		before = gc.generations()
+	}
+
+	start := time.Now()
+	gc.minorGC()
+	duration := time.Since(start)
+
+	gc.minorCount++
+	gc.minorPause += duration
+	gc.recordPause(duration)
+
+	if gc.observer != nil {
+		gc.observer.OnGC(GCEvent{false, before, gc.generations(), duration, 1})
+	}
+}
+
+// Finish major collection in progress, then run a whole major collection
+func (gc *GC) fullGC() {
+	if gc.phase != gcPhasePause {
+		gc.step(0, 0)
+	}
+	gc.step(0, 0)
 }
 
-// Run minor GC
+// Run minor GC, it stops the world and collects GCGen0 only
 func (gc *GC) minorGC() {
+	if gc.minorTraveller == nil {
+		panic("assert")
+	}
 	oldGen1Count := gc.gen1.count
 
-	gc.minorGCMark()
+	// Visit all minor GC root objects
+	marker := markVisitor{gc: gc, minor: true}
+	gc.minorTraveller(&marker)
+	gc.visitFinalizeObjects(&marker)
+
+	// Scan all barriered objects, young objects may be stored in them
+	for e := gc.barriered.Front(); e != nil; e = e.Next() {
+		gc.scan(e.Value.(GCObject), &marker)
+	}
+	gc.markAll(&marker)
+	gc.clearWeakTables(&marker)
+
 	gc.minorGCSweep()
 
+	// Old objects scanned by this collection are white again
+	for e := gc.barriered.Front(); e != nil; e = e.Next() {
+		field := getGCObjectField(e.Value.(GCObject))
+		field.gc = gc.white
+		field.barriered = false
+	}
 	clearList(&gc.barriered)
+	for _, obj := range gc.grayAgain {
+		getGCObjectField(obj).gc = gc.white
+	}
+	gc.grayAgain = nil
 
 	// Calculate objects count from gen0_ to gen1_, which is how many alived
 	// objects in gen0_ after mark-sweep, and adjust gen0_'s threshold count
@@ -277,594 +699,501 @@ func (gc *GC) minorGC() {
 		kGen0MaxThresholdCount)
 }
 
-// Run major GC
-func (gc *GC) majorGC() {
-	gc.majorGCMark()
-	gc.majorGCSweep()
-	clearList(&gc.barriered)
+func (gc *GC) minorGCSweep() {
+	// Sweep GCGen0
+	for gc.gen0.gen != nil {
+		obj := gc.gen0.gen
+		field := getGCObjectField(obj)
+		gc.gen0.gen = field.next
+
+		// Move object to GCGen1 generation when object is black
+		if field.gc == GCFlagBlack {
+			field.gc = gc.white
+			field.generation = GCGen1
+			field.next = gc.gen1.gen
+			gc.gen1.gen = obj
+			gc.gen1.count++
+		} else {
+			gc.objDeleter(obj, field.gcObjType)
+		}
+	}
+
+	gc.gen0.count = 0
 }
 
-func (gc *GC) minorGCMark() {
+// Do a step of major collection, which does about 'budget' work units
+// and pauses no longer than 'target', 0 of them is unbounded. A new major
+// collection is started when no one is in progress. Return true when the
+// major collection is finished in this step
+func (gc *GC) step(budget int, target time.Duration) bool {
 	if gc.majorTraveller == nil {
 		panic("assert")
 	}
 
-	// Visit all minor GC root objects
-	var marker minorMarkVisitor
-	gc.minorTraveller(&marker)
+	start := time.Now()
+	if gc.phase == gcPhasePause {
+		gc.startCycle()
+	}
 
-	// Visit all barriered GC objects
-	var barrieredMaker barrieredMarkVisitor
-	for e := gc.barriered.Front(); e != nil; e = e.Next() {
-		// All barriered objects must be GCGen1 or GCGen2
-		obj := e.Value.(GCObject)
-		switch object := obj.(type) {
-		case *Table:
-			if object.generation == GCGen0 {
-				panic("assert")
-			}
-			// Mark barriered objects, and visitor can visit member GC o
-			object.gc = GCFlagBlack
-			object.Accept(&barrieredMaker)
-		case *Function:
-			if object.generation == GCGen0 {
-				panic("assert")
-			}
-			// Mark barriered objects, and visitor can visit member GC o
-			object.gc = GCFlagBlack
-			object.Accept(&barrieredMaker)
-		case *Closure:
-			if object.generation == GCGen0 {
-				panic("assert")
-			}
-			// Mark barriered objects, and visitor can visit member GC o
-			object.gc = GCFlagBlack
-			object.Accept(&barrieredMaker)
-		case *Upvalue:
-			if object.generation == GCGen0 {
-				panic("assert")
-			}
-			// Mark barriered objects, and visitor can visit member GC o
-			object.gc = GCFlagBlack
-			object.Accept(&barrieredMaker)
-		case *String:
-			if object.generation == GCGen0 {
-				panic("assert")
-			}
-			// Mark barriered objects, and visitor can visit member GC o
-			object.gc = GCFlagBlack
-			object.Accept(&barrieredMaker)
-		case *UserData:
-			if object.generation == GCGen0 {
-				panic("assert")
+	marker := markVisitor{gc: gc}
+	finished := false
+	for loops := 1; !finished && (budget <= 0 || marker.work < budget); loops++ {
+		switch gc.phase {
+		case gcPhasePropagate:
+			if len(gc.gray) == 0 {
+				gc.atomic(&marker)
+			} else {
+				gc.propagate(&marker)
 			}
-			// Mark barriered objects, and visitor can visit member GC o
-			object.gc = GCFlagBlack
-			object.Accept(&barrieredMaker)
-		default:
-			panic("Unrecognizable data type")
+		case gcPhaseSweep:
+			finished = !gc.sweepStep()
+			marker.work++
 		}
 
+		if target > 0 && loops%kPauseCheckInterval == 0 && time.Since(start) >= target {
+			break
+		}
 	}
-}
+	gc.allocated = 0
 
-func (gc *GC) minorGCSweep() {
+	duration := time.Since(start)
+	gc.majorPause += duration
+	gc.cyclePause += duration
+	gc.cycleSteps++
+	gc.recordPause(duration)
 
-	// Sweep GCGen0
-	for gc.gen0.gen != nil {
-		obj := gc.gen0.gen
-		switch object := obj.(type) {
-		case *Table:
-			gc.gen0.gen = object.next
-
-			// Move object to GCGen1 generation when object is black
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.generation = GCGen1
-				object.next = gc.gen1.gen
-				gc.gen1.count++
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-			}
-		case *Function:
-			gc.gen0.gen = object.next
-
-			// Move object to GCGen1 generation when object is black
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.generation = GCGen1
-				object.next = gc.gen1.gen
-				gc.gen1.count++
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-			}
-		case *Closure:
-			gc.gen0.gen = object.next
-
-			// Move object to GCGen1 generation when object is black
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.generation = GCGen1
-				object.next = gc.gen1.gen
-				gc.gen1.count++
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-			}
-		case *Upvalue:
-			gc.gen0.gen = object.next
-
-			// Move object to GCGen1 generation when object is black
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.generation = GCGen1
-				object.next = gc.gen1.gen
-				gc.gen1.count++
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-			}
-		case *String:
-			gc.gen0.gen = object.next
-
-			// Move object to GCGen1 generation when object is black
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.generation = GCGen1
-				object.next = gc.gen1.gen
-				gc.gen1.count++
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-			}
-		case *UserData:
-			gc.gen0.gen = object.next
-
-			// Move object to GCGen1 generation when object is black
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.generation = GCGen1
-				object.next = gc.gen1.gen
-				gc.gen1.count++
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-			}
-		default:
-			panic("Unrecognizable data type")
-		}
+	if finished {
+		gc.finishCycle()
 	}
-
-	gc.gen0.count = 0
+	return finished
 }
 
-func (gc *GC) majorGCMark() {
-	if gc.majorTraveller != nil {
-		panic("assert")
+// Start a major collection, gray all root objects
+func (gc *GC) startCycle() {
+	if gc.observer != nil {
+		gc.cycleBefore = gc.generations()
 	}
+	gc.cyclePause = 0
+	gc.cycleSteps = 0
+	gc.phase = gcPhasePropagate
 
-	// Visit all major GC root objects
-	var marker majorMarkVisitor
+	marker := markVisitor{gc: gc}
 	gc.majorTraveller(&marker)
+	gc.visitFinalizeObjects(&marker)
 }
 
-func (gc *GC) majorGCSweep() {
-	// Sweep all generations
-	gc.sweepGeneration(&gc.gen2)
-	gc.sweepGeneration(&gc.gen1)
-	gc.sweepGeneration(&gc.gen0)
+// Atomic phase of major collection, mark objects which are changed
+// without barrier, separate user data which need finalization, and
+// start sweeping
+func (gc *GC) atomic(marker *markVisitor) {
+	// Root objects and threads are changed without barrier, and other
+	// objects in grayAgain list are changed after scanning
+	gc.majorTraveller(marker)
+	gc.visitFinalizeObjects(marker)
+	again := gc.grayAgain
+	gc.grayAgain = nil
+	for _, obj := range again {
+		gc.scan(obj, marker)
+	}
+	gc.markAll(marker)
+	gc.clearWeakTables(marker)
+	gc.grayAgain = nil
+
+	// Unmarked objects are the other white after flipping, they are
+	// dead, and new objects are allocated in new white
+	gc.white = gc.otherWhite()
+
+	// All GCGen0 objects are moved to GCGen1 by sweeping, so barriered
+	// objects are not needed by minor collection any more
+	for e := gc.barriered.Front(); e != nil; e = e.Next() {
+		getGCObjectField(e.Value.(GCObject)).barriered = false
+	}
+	clearList(&gc.barriered)
+
+	// Detach generations for sweeping, new objects are added to the
+	// generations
+	gc.sweeping = [3]GCObject{gc.gen0.gen, gc.gen1.gen, gc.gen2.gen}
+	gc.gen0.gen, gc.gen1.gen, gc.gen2.gen = nil, nil, nil
+	gc.promoted = 0
+	gc.phase = gcPhaseSweep
+}
+
+// Sweep an object, return false when all generations are swept
+func (gc *GC) sweepStep() bool {
+	index := 0
+	for index < len(gc.sweeping) && gc.sweeping[index] == nil {
+		index++
+	}
+	if index == len(gc.sweeping) {
+		return false
+	}
+
+	obj := gc.sweeping[index]
+	field := getGCObjectField(obj)
+	gc.sweeping[index] = field.next
+
+	gen := gc.getGenInfo(field.generation)
+	if field.gc == gc.otherWhite() {
+		gc.objDeleter(obj, field.gcObjType)
+		gen.count--
+		return true
+	}
 
 	// Move all GCGen0 objects to GCGen1
-	for gc.gen0.gen != nil {
-		obj := gc.gen0.gen
-		switch object := obj.(type) {
-		case *Table:
-			gc.gen0.gen = object.next
-
-			object.generation = GCGen1
-			object.next = gc.gen1.gen
-			gc.gen1.gen = object
-		case *Function:
-			gc.gen0.gen = object.next
-
-			object.generation = GCGen1
-			object.next = gc.gen1.gen
-			gc.gen1.gen = object
-		case *Closure:
-			gc.gen0.gen = object.next
-
-			object.generation = GCGen1
-			object.next = gc.gen1.gen
-			gc.gen1.gen = object
-		case *Upvalue:
-			gc.gen0.gen = object.next
-
-			object.generation = GCGen1
-			object.next = gc.gen1.gen
-			gc.gen1.gen = object
-		case *String:
-			gc.gen0.gen = object.next
-
-			object.generation = GCGen1
-			object.next = gc.gen1.gen
-			gc.gen1.gen = object
-		case *UserData:
-			gc.gen0.gen = object.next
-
-			object.generation = GCGen1
-			object.next = gc.gen1.gen
-			gc.gen1.gen = object
-		default:
-			panic("Unrecognizable data type")
-		}
+	field.gc = gc.white
+	if field.generation == GCGen0 {
+		gen.count--
+		field.generation = GCGen1
+		gen = &gc.gen1
+		gen.count++
+		gc.promoted++
 	}
+	field.next = gen.gen
+	gen.gen = obj
+	return true
+}
 
-	// Adjust GCGen0 threshold count
-	gc.adjustThreshold(gc.gen0.count, &gc.gen0, kGen0InitThresholdCount, kGen0MaxThresholdCount)
+// Finish major collection, adjust thresholds and report it to observer
+func (gc *GC) finishCycle() {
+	gc.phase = gcPhasePause
+	gc.majorCount++
 
-	gc.gen1.count += gc.gen0.count
-	gc.gen0.count = 0
+	// Adjust GCGen0 threshold count
+	gc.adjustThreshold(gc.promoted, &gc.gen0, kGen0InitThresholdCount, kGen0MaxThresholdCount)
 
 	// Adjust GCGen1 threshold count
 	gc.adjustThreshold(gc.gen1.count, &gc.gen1, kGen1InitThresholdCount, kGen1MaxThresholdCount)
 	if gc.gen1.count >= kGen1MaxThresholdCount {
 		gc.gen1.thresholdCount = gc.gen1.count + kGen1MaxThresholdCount
 	}
-}
 
-func (gc *GC) sweepGeneration(gen *genInfo) {
-	var alived GCObject
-	for gen.gen != nil {
-		obj := gen.gen
-		switch object := obj.(type) {
-		case *Table:
-			gen.gen = object.next
-
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.next = alived
-				alived = object
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-				gen.count--
-			}
-		case *Function:
-			gen.gen = object.next
+	if gc.observer != nil {
+		gc.observer.OnGC(GCEvent{true, gc.cycleBefore, gc.generations(),
+			gc.cyclePause, gc.cycleSteps})
+	}
+}
 
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.next = alived
-				alived = object
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-				gen.count--
-			}
-		case *Closure:
-			gen.gen = object.next
+// Scan gray object 'obj', mark it black and gray its white members
+func (gc *GC) scan(obj GCObject, marker *markVisitor) {
+	field := getGCObjectField(obj)
+	field.gc = GCFlagBlack
+	if table, ok := obj.(*Table); ok && gc.scanWeakTable(table, marker) {
+		return
+	}
 
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.next = alived
-				alived = object
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-				gen.count--
-			}
-		case *Upvalue:
-			gen.gen = object.next
+	marker.scanning = obj
+	obj.Accept(marker)
+	marker.scanning = nil
 
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.next = alived
-				alived = object
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-				gen.count--
-			}
-		case *String:
-			gen.gen = object.next
+	// Stack of thread is changed without barrier, and values out of
+	// its live parts are not marked, so they are cleared
+	if field.gcObjType == GCObjectTypeThread {
+		obj.(*Thread).clearDeadStack()
+		gc.grayAgain = append(gc.grayAgain, obj)
+	}
+}
 
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.next = alived
-				alived = object
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-				gen.count--
-			}
-		case *UserData:
-			gen.gen = object.next
+// Scan an object in gray list
+func (gc *GC) propagate(marker *markVisitor) {
+	last := len(gc.gray) - 1
+	obj := gc.gray[last]
+	gc.gray[last] = nil
+	gc.gray = gc.gray[:last]
+	gc.scan(obj, marker)
+}
 
-			if object.gc == GCFlagBlack {
-				object.gc = GCFlagWhite
-				object.next = alived
-				alived = object
-			} else {
-				gc.objDeleter(object, object.gcObjType)
-				gen.count--
-			}
-		default:
-			panic("Unrecognizable data type")
-		}
+// Scan objects until gray list is empty
+func (gc *GC) propagateAll(marker *markVisitor) {
+	for len(gc.gray) > 0 {
+		gc.propagate(marker)
 	}
+}
 
-	gen.gen = alived
+// Visit user data which wait for finalization, they are still roots
+// until their finalizers are called
+func (gc *GC) visitFinalizeObjects(marker GCObjectVisitor) {
+	for e := gc.finalized.Front(); e != nil; e = e.Next() {
+		e.Value.(*UserData).Accept(marker)
+	}
 }
 
-// Adjust GenInfo's thresholdCount by alivedCount
-func (gc *GC) adjustThreshold(alivedCount uint, gen *genInfo, minThreshold, maxThreshold uint) {
-	if alivedCount != 0 {
-		for gen.thresholdCount < 2*alivedCount {
-			gen.thresholdCount *= 2
-		}
-		for gen.thresholdCount >= 4*alivedCount {
-			gen.thresholdCount /= 2
+// Find unmarked user data which need finalization, mark them and all
+// objects reachable from them, so they survive this collection, and
+// add them to the finalization list. Unmarked user data are removed
+// from the user data list, because they are finalized or deleted
+func (gc *GC) separateFinalizeObjects(marker *markVisitor) {
+	var separated []*UserData
+	alive := gc.userDatas[:0]
+	for _, userData := range gc.userDatas {
+		if userData.gc != gc.white || marker.minor && userData.generation != GCGen0 {
+			alive = append(alive, userData)
+		} else if gc.finalizeChecker != nil && gc.finalizeChecker(userData) {
+			separated = append(separated, userData)
 		}
 	}
-
-	if gen.thresholdCount < minThreshold {
-		gen.thresholdCount = minThreshold
-	} else if gen.thresholdCount > maxThreshold {
-		gen.thresholdCount = maxThreshold
+	for index := len(alive); index < len(gc.userDatas); index++ {
+		gc.userDatas[index] = nil
+	}
+	gc.userDatas = alive
+
+	// Mark after finding, then user data which reachable from
+	// other separated user data are finalized too. User data are
+	// finalized in reverse order of creation
+	for index := len(separated) - 1; index >= 0; index-- {
+		separated[index].Accept(marker)
+		gc.finalized.PushBack(separated[index])
 	}
+	gc.markAll(marker)
 }
 
-// Delete generation all objects
-func (gc *GC) destroyGeneration(gen *genInfo) {
-	for gen.gen != nil {
-		obj := gen.gen
-		switch object := obj.(type) {
-		case *Table:
-			gen.gen = object.next
-			gc.objDeleter(obj, object.gcObjType)
-		case *Function:
-			gen.gen = object.next
-			gc.objDeleter(obj, object.gcObjType)
-		case *Closure:
-			gen.gen = object.next
-			gc.objDeleter(obj, object.gcObjType)
-		case *Upvalue:
-			gen.gen = object.next
-			gc.objDeleter(obj, object.gcObjType)
-		case *String:
-			gen.gen = object.next
-			gc.objDeleter(obj, object.gcObjType)
-		case *UserData:
-			gen.gen = object.next
-			gc.objDeleter(obj, object.gcObjType)
-		default:
-			panic("Unrecognizable data type")
+// Add all user data which need finalization to the finalization list
+// in reverse order of creation whether they are reachable or not, it
+// is used when the state is closed
+func (gc *GC) separateAllFinalizeObjects() {
+	if gc.phase != gcPhasePause {
+		gc.step(0, 0)
+	}
+	for index := len(gc.userDatas) - 1; index >= 0; index-- {
+		userData := gc.userDatas[index]
+		if gc.finalizeChecker != nil && gc.finalizeChecker(userData) {
+			gc.finalized.PushBack(userData)
 		}
 	}
-	gen.count = 0
+	gc.userDatas = nil
 }
 
-type minorMarkVisitor struct {
+// Delete all GC objects, it is used when the state is closed
+func (gc *GC) destroyAll() {
+	if gc.phase != gcPhasePause {
+		gc.step(0, 0)
+	}
+	gc.destroyGeneration(&gc.gen0)
+	gc.destroyGeneration(&gc.gen1)
+	gc.destroyGeneration(&gc.gen2)
+	gc.userDatas = nil
+	gc.finalized.Init()
+	gc.barriered.Init()
 }
 
-func (minor *minorMarkVisitor) visitObj(obj GCObject) bool {
-	switch object := obj.(type) {
-	case *Table:
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Function:
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Closure:
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Upvalue:
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *String:
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *UserData:
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
+// Scan table 't' when it has weak keys or weak values, only strong
+// members are marked, and the table is added to weak table lists for
+// clearing, return false when 't' is not a weak table
+func (gc *GC) scanWeakTable(t *Table, marker *markVisitor) bool {
+	if t.metaTable == nil || gc.weakModeChecker == nil {
+		return false
+	}
+	weakKey, weakValue := gc.weakModeChecker(t)
+	if !weakKey && !weakValue {
+		return false
+	}
+
+	t.metaTable.Accept(marker)
+	switch {
+	case weakKey && weakValue:
+		gc.allWeak = append(gc.allWeak, t)
+	case weakValue:
+		for i := t.hash.nextNode(0); i >= 0; i = t.hash.nextNode(i + 1) {
+			t.hash.nodes[i].key.Accept(marker)
 		}
+		gc.weakValues = append(gc.weakValues, t)
 	default:
-		panic("Unrecognizable data type")
+		// Keys of array part are integers, so values are strong
+		if t.array != nil {
+			for index := range *t.array {
+				(*t.array)[index].Accept(marker)
+			}
+		}
+		gc.markEphemeron(t, marker)
+		gc.ephemerons = append(gc.ephemerons, t)
 	}
-
-	return false
-}
-
-func (minor *minorMarkVisitor) VisitTable(table *Table) bool {
-	return minor.visitObj(table)
+	return true
 }
 
-func (minor *minorMarkVisitor) VisitFunction(function *Function) bool {
-	return minor.visitObj(function)
-}
-
-func (minor *minorMarkVisitor) VisitClosure(closure *Closure) bool {
-	return minor.visitObj(closure)
+// Mark values of hash part of ephemeron table 't' which keys are marked,
+// return true when some values are marked
+func (gc *GC) markEphemeron(t *Table, marker *markVisitor) bool {
+	marked := false
+	for i := t.hash.nextNode(0); i >= 0; i = t.hash.nextNode(i + 1) {
+		node := &t.hash.nodes[i]
+		if !gc.isCleared(&node.key, marker) && gc.isCleared(&node.value, marker) {
+			node.value.Accept(marker)
+			marked = true
+		}
+	}
+	return marked
 }
 
-func (minor *minorMarkVisitor) VisitUpvalue(value *Upvalue) bool {
-	return minor.visitObj(value)
+// Scan gray objects, and mark values of ephemeron tables which keys are
+// marked until no more object is marked
+func (gc *GC) markAll(marker *markVisitor) {
+	for {
+		gc.propagateAll(marker)
+		marked := false
+		for _, t := range gc.ephemerons {
+			if gc.markEphemeron(t, marker) {
+				marked = true
+			}
+		}
+		if !marked {
+			break
+		}
+	}
 }
 
-func (minor *minorMarkVisitor) VisitString(str *String) bool {
-	return minor.visitObj(str)
-}
+// Whether value 'v' is not marked and will be cleared from weak tables,
+// strings are values and are never cleared, so they are marked here
+func (gc *GC) isCleared(v *Value, marker *markVisitor) bool {
+	obj := v.gcObject()
+	if obj == nil {
+		return false
+	}
 
-func (minor *minorMarkVisitor) VisitUserData(userData *UserData) bool {
-	return minor.visitObj(userData)
+	field := getGCObjectField(obj)
+	if field.gcObjType == GCObjectTypeString {
+		obj.Accept(marker)
+		return false
+	}
+	if field.collector == nil || marker.minor && field.generation != GCGen0 {
+		return false
+	}
+	return field.gc == gc.white
 }
 
-type barrieredMarkVisitor struct {
+// Separate user data which need finalization, and remove entries which
+// are not marked from weak tables. Values referencing user data which
+// wait for finalization are removed before the user data are marked,
+// and keys referencing them are removed in next collection
+func (gc *GC) clearWeakTables(marker *markVisitor) {
+	gc.clearByValues(gc.weakValues, marker)
+	gc.clearByValues(gc.allWeak, marker)
+	gc.separateFinalizeObjects(marker)
+	gc.clearByKeys(gc.ephemerons, marker)
+	gc.clearByKeys(gc.allWeak, marker)
+
+	// Tables which are marked by finalization are cleared by values too
+	gc.clearByValues(gc.weakValues, marker)
+	gc.clearByValues(gc.allWeak, marker)
+	gc.weakValues, gc.ephemerons, gc.allWeak = nil, nil, nil
 }
 
-func (bmv *barrieredMarkVisitor) visitObj(obj GCObject) bool {
-	switch object := obj.(type) {
-	case *Table:
-		// Visit member GC objects of obj when it is barriered object
-		if object.generation == GCGen0 && object.gc == GCFlagBlack {
-			object.gc = GCFlagWhite
-			return true
-		}
-		// Visit GCGen0 generation object
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Function:
-		// Visit member GC objects of obj when it is barriered object
-		if object.generation == GCGen0 && object.gc == GCFlagBlack {
-			object.gc = GCFlagWhite
-			return true
-		}
-		// Visit GCGen0 generation object
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Closure:
-		// Visit member GC objects of obj when it is barriered object
-		if object.generation == GCGen0 && object.gc == GCFlagBlack {
-			object.gc = GCFlagWhite
-			return true
-		}
-		// Visit GCGen0 generation object
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Upvalue:
-		// Visit member GC objects of obj when it is barriered object
-		if object.generation == GCGen0 && object.gc == GCFlagBlack {
-			object.gc = GCFlagWhite
-			return true
-		}
-		// Visit GCGen0 generation object
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *String:
-		// Visit member GC objects of obj when it is barriered object
-		if object.generation == GCGen0 && object.gc == GCFlagBlack {
-			object.gc = GCFlagWhite
-			return true
-		}
-		// Visit GCGen0 generation object
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *UserData:
-		// Visit member GC objects of obj when it is barriered object
-		if object.generation == GCGen0 && object.gc == GCFlagBlack {
-			object.gc = GCFlagWhite
-			return true
+// Remove entries which values are not marked from tables
+func (gc *GC) clearByValues(tables []*Table, marker *markVisitor) {
+	for _, t := range tables {
+		if t.array != nil {
+			for index := range *t.array {
+				if gc.isCleared(&(*t.array)[index], marker) {
+					(*t.array)[index].SetNil()
+				}
+			}
 		}
-		// Visit GCGen0 generation object
-		if object.generation == GCGen0 && object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
+		for i := t.hash.nextNode(0); i >= 0; i = t.hash.nextNode(i + 1) {
+			if gc.isCleared(&t.hash.nodes[i].value, marker) {
+				t.hash.remove(i)
+			}
 		}
-	default:
-		panic("Unrecognizable data type")
 	}
-	return false
 }
 
-func (bmv *barrieredMarkVisitor) VisitTable(table *Table) bool {
-	return bmv.visitObj(table)
-}
-
-func (bmv *barrieredMarkVisitor) VisitFunction(function *Function) bool {
-	return bmv.visitObj(function)
+// Remove entries which keys are not marked from tables
+func (gc *GC) clearByKeys(tables []*Table, marker *markVisitor) {
+	for _, t := range tables {
+		for i := t.hash.nextNode(0); i >= 0; i = t.hash.nextNode(i + 1) {
+			if gc.isCleared(&t.hash.nodes[i].key, marker) {
+				t.hash.remove(i)
+			}
+		}
+	}
 }
 
-func (bmv *barrieredMarkVisitor) VisitClosure(closure *Closure) bool {
-	return bmv.visitObj(closure)
-}
+// Adjust GenInfo's thresholdCount by alivedCount
+func (gc *GC) adjustThreshold(alivedCount uint, gen *genInfo, minThreshold, maxThreshold uint) {
+	if alivedCount != 0 {
+		for gen.thresholdCount < 2*alivedCount {
+			gen.thresholdCount *= 2
+		}
+		for gen.thresholdCount >= 4*alivedCount {
+			gen.thresholdCount /= 2
+		}
+	}
 
-func (bmv *barrieredMarkVisitor) VisitUpvalue(value *Upvalue) bool {
-	return bmv.visitObj(value)
+	if gen.thresholdCount < minThreshold {
+		gen.thresholdCount = minThreshold
+	} else if gen.thresholdCount > maxThreshold {
+		gen.thresholdCount = maxThreshold
+	}
 }
 
-func (bmv *barrieredMarkVisitor) VisitString(str *String) bool {
-	return bmv.visitObj(str)
+// Delete generation all objects
+func (gc *GC) destroyGeneration(gen *genInfo) {
+	for gen.gen != nil {
+		obj := gen.gen
+		field := getGCObjectField(obj)
+		gen.gen = field.next
+		gc.objDeleter(obj, field.gcObjType)
+	}
+	gen.count = 0
 }
 
-func (bmv *barrieredMarkVisitor) VisitUserData(userData *UserData) bool {
-	return bmv.visitObj(userData)
+// Mark visitor of minor and major collections, it grays white objects,
+// and visits members of the object being scanned
+type markVisitor struct {
+	gc       *GC
+	minor    bool     // Only GCGen0 objects and threads are marked by minor collection
+	scanning GCObject // Object being scanned
+	work     int      // Count of visited objects
 }
 
-type majorMarkVisitor struct {
-}
+func (m *markVisitor) visitObj(obj GCObject) bool {
+	if m.scanning != nil && obj == m.scanning {
+		m.scanning = nil
+		return true
+	}
 
-func (major *majorMarkVisitor) visitObj(obj GCObject) bool {
-	switch object := obj.(type) {
-	case *Table:
-		if object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Function:
-		if object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Closure:
-		if object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *Upvalue:
-		if object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *String:
-		if object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-	case *UserData:
-		if object.gc == GCFlagWhite {
-			object.gc = GCFlagBlack
-			return true
-		}
-		panic("Unrecognizable data type")
+	m.work++
+	field := getGCObjectField(obj)
+	if field.collector == nil || field.gc != m.gc.white {
+		return false
+	}
+	if m.minor && field.generation != GCGen0 && field.gcObjType != GCObjectTypeThread {
+		return false
 	}
 
+	// String has no member, mark it black directly
+	if field.gcObjType == GCObjectTypeString {
+		field.gc = GCFlagBlack
+		return false
+	}
+	field.gc = GCFlagGray
+	m.gc.gray = append(m.gc.gray, obj)
 	return false
 }
 
-func (major *majorMarkVisitor) VisitTable(table *Table) bool {
-	return major.visitObj(table)
+func (m *markVisitor) VisitTable(table *Table) bool {
+	return m.visitObj(table)
+}
+
+func (m *markVisitor) VisitFunction(function *Function) bool {
+	return m.visitObj(function)
 }
 
-func (major *majorMarkVisitor) VisitFunction(function *Function) bool {
-	return major.visitObj(function)
+func (m *markVisitor) VisitClosure(closure *Closure) bool {
+	return m.visitObj(closure)
 }
 
-func (major *majorMarkVisitor) VisitClosure(closure *Closure) bool {
-	return major.visitObj(closure)
+func (m *markVisitor) VisitUpvalue(value *Upvalue) bool {
+	return m.visitObj(value)
 }
 
-func (major *majorMarkVisitor) VisitUpvalue(value *Upvalue) bool {
-	return major.visitObj(value)
+func (m *markVisitor) VisitString(str *String) bool {
+	return m.visitObj(str)
 }
 
-func (major *majorMarkVisitor) VisitString(str *String) bool {
-	return major.visitObj(str)
+func (m *markVisitor) VisitUserData(userData *UserData) bool {
+	return m.visitObj(userData)
 }
 
-func (major *majorMarkVisitor) VisitUserData(userData *UserData) bool {
-	return major.visitObj(userData)
+func (m *markVisitor) VisitThread(thread *Thread) bool {
+	return m.visitObj(thread)
 }
 
 func clearList(l *list.List) {
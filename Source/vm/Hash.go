@@ -0,0 +1,201 @@
+package vm
+
+import "math"
+
+// Min count of slots of hash part
+const minHashSize = 4
+
+// Key-value pair of hash part. When the key is removed, the value is set
+// to nil and the key is kept, so the node is still in the probe sequence
+// of other keys and the iteration can continue from it.
+type hashNode struct {
+	key   Value
+	value Value
+}
+
+// Hash part of table. Nodes are stored in insertion order, and slots is
+// an open addressing hash table with linear probing which stores the
+// index + 1 of nodes, 0 means an empty slot. Count of slots is always
+// power of 2. So the iteration order of keys is the insertion order,
+// and position of a node is not changed until the table is resized.
+type hash struct {
+	slots []int
+	nodes []hashNode
+	count int // Count of nodes which value is not nil
+}
+
+// Normalize 'key' for hash part, equal keys are raw equal after
+// normalization, return false when 'key' can not be a key of table.
+func normalizeKey(key Value) (Value, bool) {
+	switch key.Type() {
+	case ValueTNil:
+		return key, false
+	case ValueTNumber:
+		if key.IsInteger() {
+			return key, true
+		}
+		// Float which has integer value is the same key with the
+		// integer, -0 and 0 are the same key too
+		num := key.Num()
+		if i, ok := floatToInteger(num); ok {
+			return NewValueInt(i), true
+		}
+		if math.IsNaN(num) {
+			return key, false
+		}
+	}
+	return key, true
+}
+
+// Hash of normalized 'key'
+func hashOf(key *Value) uint64 {
+	var h uint64
+	switch key.Type() {
+	case ValueTBool, ValueTNumber:
+		h = key.payload
+	case ValueTString:
+		h = uint64(key.Str().GetHash())
+	default:
+		// Objects are identified by address
+		h = uint64(uintptr(key.ptr))
+	}
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
+
+// Whether normalized keys are equal, strings are compared by content
+// when they are not the same object
+func keyEqual(k1, k2 *Value) bool {
+	if *k1 == *k2 {
+		return true
+	}
+
+	s1, s2 := k1.Str(), k2.Str()
+	return s1 != nil && s2 != nil && s1.GetHash() == s2.GetHash() &&
+		s1.GetStdString() == s2.GetStdString()
+}
+
+// Find index of node of normalized 'key', return -1 when not found
+func (h *hash) find(key Value) int {
+	if len(h.slots) == 0 {
+		return -1
+	}
+
+	mask := len(h.slots) - 1
+	for i := int(hashOf(&key)) & mask; ; i = (i + 1) & mask {
+		slot := h.slots[i]
+		if slot == 0 {
+			return -1
+		}
+		if keyEqual(&h.nodes[slot-1].key, &key) {
+			return slot - 1
+		}
+	}
+}
+
+// Get value of 'key', return nil when not found
+func (h *hash) get(key Value) Value {
+	if key, ok := normalizeKey(key); ok {
+		if i := h.find(key); i >= 0 {
+			return h.nodes[i].value
+		}
+	}
+	return Value{}
+}
+
+// Set value of 'key', nil value removes the key.
+// Return false when 'key' is nil or NaN.
+func (h *hash) set(key, value Value) bool {
+	key, ok := normalizeKey(key)
+	if !ok {
+		return false
+	}
+
+	if i := h.find(key); i >= 0 {
+		node := &h.nodes[i]
+		if node.value.IsNil() != value.IsNil() {
+			if value.IsNil() {
+				h.count--
+			} else {
+				// Removed key may be a dead string which has the same
+				// content, so use the new key
+				node.key = key
+				h.count++
+			}
+		}
+		node.value = value
+		return true
+	}
+
+	if value.IsNil() {
+		return true
+	}
+
+	if (len(h.nodes)+1)*4 > len(h.slots)*3 {
+		h.resize(h.count + 1)
+	}
+
+	h.nodes = append(h.nodes, hashNode{key: key, value: value})
+	h.count++
+	h.insertSlot(len(h.nodes) - 1)
+	return true
+}
+
+// Remove key of node 'index', the node is kept as a removed key
+func (h *hash) remove(index int) {
+	if !h.nodes[index].value.IsNil() {
+		h.nodes[index].value = Value{}
+		h.count--
+	}
+}
+
+// Insert node 'index' into slots
+func (h *hash) insertSlot(index int) {
+	mask := len(h.slots) - 1
+	i := int(hashOf(&h.nodes[index].key)) & mask
+	for h.slots[i] != 0 {
+		i = (i + 1) & mask
+	}
+	h.slots[i] = index + 1
+}
+
+// Rebuild the slots to hold 'count' keys at least twice, removed keys
+// are dropped and the insertion order of remaining keys is kept
+func (h *hash) resize(count int) {
+	size := minHashSize
+	for size < count*2 {
+		size <<= 1
+	}
+
+	nodes := make([]hashNode, 0, count)
+	for i := range h.nodes {
+		if !h.nodes[i].value.IsNil() {
+			nodes = append(nodes, h.nodes[i])
+		}
+	}
+
+	h.nodes = nodes
+	h.slots = make([]int, size)
+	for i := range h.nodes {
+		h.insertSlot(i)
+	}
+}
+
+// Return count of keys
+func (h *hash) len() int {
+	return h.count
+}
+
+// Get index of the first node from 'index' which value is not nil,
+// return -1 when there is not
+func (h *hash) nextNode(index int) int {
+	for ; index < len(h.nodes); index++ {
+		if !h.nodes[index].value.IsNil() {
+			return index
+		}
+	}
+	return -1
+}
@@ -44,6 +44,13 @@ func (l *Lexer) normalTokenDetail(detail *TokenDetail, token int) int {
 
 func (l *Lexer) numberTokenDetail(detail *TokenDetail, number float64) int {
 	detail.Number = number
+	detail.IsInteger = false
+	return l.normalTokenDetail(detail, TokenNumber)
+}
+
+func (l *Lexer) integerTokenDetail(detail *TokenDetail, integer int64) int {
+	detail.Integer = integer
+	detail.IsInteger = true
 	return l.normalTokenDetail(detail, TokenNumber)
 }
 
@@ -113,7 +120,7 @@ func (l *Lexer) GetToken(detail *TokenDetail) (int, error) {
 			}
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 			return l.lexNumber(detail)
-		case '+', '*', '/', '%', '^', '#', '(', ')', '{', '}',
+		case '+', '*', '%', '^', '#', '&', '|', '(', ')', '{', '}',
 			']', ';', ':', ',':
 			token := int(l.current)
 			l.current = l.next()
@@ -136,22 +143,19 @@ func (l *Lexer) GetToken(detail *TokenDetail) (int, error) {
 					func(c byte) bool { return unicode.IsDigit(rune(c)) },
 					func(c byte) bool { return c == 'e' || c == 'E' })
 			} else {
-				l.current = l.next()
+				l.current = next
 				return l.normalTokenDetail(detail, '.'), nil
 			}
+		case '/':
+			return l.lexXDouble(detail, TokenIDiv), nil
 		case '~':
-			next := l.next()
-			if next != '=' {
-				return -1, NewLexError(l.module.GetCStr(), l.line, l.column, "expect '=' after '~'")
-			}
-			l.current = l.next()
-			return l.normalTokenDetail(detail, TokenNotEqual), nil
+			return l.lexXEqual(detail, TokenNotEqual), nil
 		case '=':
 			return l.lexXEqual(detail, TokenEqual), nil
 		case '>':
-			return l.lexXEqual(detail, TokenGreaterEqual), nil
+			return l.lexXDoubleOrEqual(detail, TokenShiftRight, TokenGreaterEqual), nil
 		case '<':
-			return l.lexXEqual(detail, TokenLessEqual), nil
+			return l.lexXDoubleOrEqual(detail, TokenShiftLeft, TokenLessEqual), nil
 		case '[':
 			l.current = l.next()
 			if l.current == '[' || l.current == '=' {
@@ -295,7 +299,8 @@ func (l *Lexer) lexNumberXFractional(detail *TokenDetail, integerPart bool, poin
 			"unexpect incomplete number'", l.tokenBuffer, "'")
 	}
 
-	if isExponent(l.current) {
+	exponent := isExponent(l.current)
+	if exponent {
 		l.tokenBuffer = l.tokenBuffer + string(l.current)
 		l.current = l.next()
 		if l.current == '-' || l.current == '+' {
@@ -314,14 +319,49 @@ func (l *Lexer) lexNumberXFractional(detail *TokenDetail, integerPart bool, poin
 		}
 	}
 
-	number, err := strconv.ParseFloat(l.tokenBuffer, 64)
-	if err != nil {
-		i, _ := strconv.ParseInt(l.tokenBuffer, 16, 64)
-		number = float64(i)
+	isHex := len(l.tokenBuffer) > 1 && (l.tokenBuffer[1] == 'x' || l.tokenBuffer[1] == 'X')
+	if !point && !exponent {
+		return l.lexInteger(detail, isHex)
+	}
+
+	buffer := l.tokenBuffer
+	if isHex && !exponent {
+		// Hexadecimal float needs binary exponent in Go
+		buffer = buffer + "p0"
+	}
+	number, err := strconv.ParseFloat(buffer, 64)
+	if err != nil && !isRangeError(err) {
+		return -1, NewLexError(l.module.GetCStr(), l.line, l.column,
+			"malformed number '", l.tokenBuffer, "'")
 	}
 	return l.numberTokenDetail(detail, number), nil
 }
 
+// Integer in token buffer, hexadecimal integer wraps around on overflow,
+// decimal integer is converted to float on overflow
+func (l *Lexer) lexInteger(detail *TokenDetail, isHex bool) (int, error) {
+	if isHex {
+		var integer uint64
+		for _, c := range []byte(l.tokenBuffer[2:]) {
+			digit, _ := strconv.ParseUint(string(c), 16, 8)
+			integer = integer<<4 | digit
+		}
+		return l.integerTokenDetail(detail, int64(integer)), nil
+	}
+
+	integer, err := strconv.ParseInt(l.tokenBuffer, 10, 64)
+	if err != nil {
+		number, _ := strconv.ParseFloat(l.tokenBuffer, 64)
+		return l.numberTokenDetail(detail, number), nil
+	}
+	return l.integerTokenDetail(detail, integer), nil
+}
+
+func isRangeError(err error) bool {
+	e, ok := err.(*strconv.NumError)
+	return ok && e.Err == strconv.ErrRange
+}
+
 func (l *Lexer) lexXEqual(detail *TokenDetail, equalToken int) int {
 	token := int(l.current)
 
@@ -335,6 +375,35 @@ func (l *Lexer) lexXEqual(detail *TokenDetail, equalToken int) int {
 	}
 }
 
+func (l *Lexer) lexXDouble(detail *TokenDetail, doubleToken int) int {
+	token := int(l.current)
+
+	next := l.next()
+	if int(next) == token {
+		l.current = l.next()
+		return l.normalTokenDetail(detail, doubleToken)
+	} else {
+		l.current = next
+		return l.normalTokenDetail(detail, token)
+	}
+}
+
+func (l *Lexer) lexXDoubleOrEqual(detail *TokenDetail, doubleToken int, equalToken int) int {
+	token := int(l.current)
+
+	next := l.next()
+	if int(next) == token {
+		l.current = l.next()
+		return l.normalTokenDetail(detail, doubleToken)
+	} else if next == '=' {
+		l.current = l.next()
+		return l.normalTokenDetail(detail, equalToken)
+	} else {
+		l.current = next
+		return l.normalTokenDetail(detail, token)
+	}
+}
+
 func (l *Lexer) lexMultiLineString(detail *TokenDetail) (int, error) {
 	equals := 0
 	for l.current == '=' {
@@ -403,7 +472,9 @@ func (l *Lexer) lexSingleLineString(detail *TokenDetail) (int, error) {
 			return -1, NewLexError(l.module.GetCStr(), l.line, l.column,
 				"incomplete string at this line")
 		}
-		return -1, l.lexStringChar()
+		if err := l.lexStringChar(); err != nil {
+			return -1, err
+		}
 	}
 
 	l.current = l.next()
@@ -12,7 +12,7 @@ type StackAPI struct {
 }
 
 func NewStackAPI(state *State) *StackAPI {
-	return &StackAPI{state: state, stack: &state.stack}
+	return &StackAPI{state: state, stack: state.stack}
 }
 
 func (s *StackAPI) CheckArgs(index, params int) bool {
@@ -34,7 +34,10 @@ func (s *StackAPI) CheckArgs3(index, params, vType int, valueTypes ...interface{
 
 	// Check remain arguments
 	index++
-	return s.CheckArgs1(index, params, valueTypes)
+	if len(valueTypes) == 0 {
+		return s.CheckArgs(index, params)
+	}
+	return s.CheckArgs3(index, params, valueTypes[0].(int), valueTypes[1:]...)
 }
 
 func (s *StackAPI) CheckArgs1(minCount int, valueTypes ...interface{}) bool {
@@ -45,26 +48,23 @@ func (s *StackAPI) CheckArgs1(minCount int, valueTypes ...interface{}) bool {
 		return false
 	}
 
-	if len(valueTypes) == 2 {
+	if len(valueTypes) == 0 {
 		return s.CheckArgs(0, params)
 	} else {
-		return s.CheckArgs3(0, params, valueTypes[0].(int), valueTypes[1:])
+		return s.CheckArgs3(0, params, valueTypes[0].(int), valueTypes[1:]...)
 	}
 }
 
 // Get count of value in this function stack
 func (s *StackAPI) GetStackSize() int {
-	begin := s.stack.Top
-	end := s.state.calls.Back().Value.(*CallInfo).Register
-	return int((uintptr(unsafe.Pointer(begin)) - uintptr(unsafe.Pointer(end))) /
-		unsafe.Sizeof(Value{}))
+	return s.stack.Top - s.state.calls.Back().Value.(*CallInfo).Register
 }
 
 // Get value type by index of stack
 func (s *StackAPI) GetValueType(index int) int {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.Type
+		return v.Type()
 	} else {
 		return ValueTNil
 	}
@@ -75,6 +75,12 @@ func (s *StackAPI) IsNumber(index int) bool {
 	return s.GetValueType(index) == ValueTNumber
 }
 
+// Check value is a number of integer subtype by index of stack
+func (s *StackAPI) IsInteger(index int) bool {
+	v := s.GetValue(index)
+	return v != nil && v.IsInteger()
+}
+
 // Check value type by index of stack
 func (s *StackAPI) IsString(index int) bool {
 	return s.GetValueType(index) == ValueTString
@@ -87,7 +93,7 @@ func (s *StackAPI) IsBool(index int) bool {
 
 // Check value type by index of stack
 func (s *StackAPI) IsClosure(index int) bool {
-	return s.GetValueType(index) == ValueTCFunction
+	return s.GetValueType(index) == ValueTClosure
 }
 
 // Check value type by index of stack
@@ -105,21 +111,36 @@ func (s *StackAPI) IsCFunction(index int) bool {
 	return s.GetValueType(index) == ValueTCFunction
 }
 
+// Check value type by index of stack
+func (s *StackAPI) IsThread(index int) bool {
+	return s.GetValueType(index) == ValueTThread
+}
+
 // Get value from stack by index
 func (s *StackAPI) GetNumber(index int) float64 {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.Num
+		return v.Num()
 	} else {
 		return 0.0
 	}
 }
 
+// Get value from stack by index, float is truncated to integer
+func (s *StackAPI) GetInteger(index int) int64 {
+	v := s.GetValue(index)
+	if v != nil {
+		return v.Int()
+	} else {
+		return 0
+	}
+}
+
 // Get value from stack by index
 func (s *StackAPI) GetCString(index int) string {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.Str.GetCStr()
+		return v.Str().GetCStr()
 	} else {
 		return ""
 	}
@@ -129,7 +150,7 @@ func (s *StackAPI) GetCString(index int) string {
 func (s *StackAPI) GetString(index int) *String {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.Str
+		return v.Str()
 	} else {
 		return nil
 	}
@@ -139,7 +160,7 @@ func (s *StackAPI) GetString(index int) *String {
 func (s *StackAPI) GetBool(index int) bool {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.BValue
+		return v.Bool()
 	} else {
 		return false
 	}
@@ -149,7 +170,7 @@ func (s *StackAPI) GetBool(index int) bool {
 func (s *StackAPI) GetClosure(index int) *Closure {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.Closure
+		return v.Closure()
 	} else {
 		return nil
 	}
@@ -159,7 +180,7 @@ func (s *StackAPI) GetClosure(index int) *Closure {
 func (s *StackAPI) GetTable(index int) *Table {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.Table
+		return v.Table()
 	} else {
 		return nil
 	}
@@ -169,7 +190,17 @@ func (s *StackAPI) GetTable(index int) *Table {
 func (s *StackAPI) GetUserData(index int) *UserData {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.UserDate
+		return v.UserData()
+	} else {
+		return nil
+	}
+}
+
+// Get value from stack by index
+func (s *StackAPI) GetThread(index int) *Thread {
+	v := s.GetValue(index)
+	if v != nil {
+		return v.Thread()
 	} else {
 		return nil
 	}
@@ -179,7 +210,7 @@ func (s *StackAPI) GetUserData(index int) *UserData {
 func (s *StackAPI) GetCFunction(index int) CFunctionType {
 	v := s.GetValue(index)
 	if v != nil {
-		return v.CFunc
+		return v.CFunc()
 	} else {
 		return nil
 	}
@@ -187,69 +218,71 @@ func (s *StackAPI) GetCFunction(index int) CFunctionType {
 
 // Get value from stack by index
 func (s *StackAPI) GetValue(index int) *Value {
+	if pos, ok := s.getStackIndex(index); ok {
+		return s.stack.Get(pos)
+	}
+	return nil
+}
+
+// Convert index of this function stack to index of the whole stack,
+// return false when the index is out of this function stack
+func (s *StackAPI) getStackIndex(index int) (int, bool) {
 	if s.state.calls.Len() == 0 {
 		panic("assert")
 	}
-	var v *Value
+	register := s.state.calls.Back().Value.(*CallInfo).Register
+	var pos int
 	if index < 0 {
-		v = vPointerAdd(s.stack.Top, index)
+		pos = s.stack.Top + index
 	} else {
-		v = vPointerAdd(s.state.calls.Back().Value.(*CallInfo).Register, index)
-	}
-
-	if (uintptr(unsafe.Pointer(v)) >= uintptr(unsafe.Pointer(s.stack.Top))) ||
-		(uintptr(unsafe.Pointer(v)) < uintptr(unsafe.Pointer(s.state.calls.Back().Value.(*CallInfo).Register))) {
-		return nil
-	} else {
-		return v
+		pos = register + index
 	}
+	return pos, pos < s.stack.Top && pos >= register
 }
 
 // Push value to stack
 func (s *StackAPI) PushNil() {
-	s.pushValue().Type = ValueTNil
+	s.pushValue().SetNil()
 }
 
 // Push value to stack
 func (s *StackAPI) PushNumber(num float64) {
-	v := s.pushValue()
-	v.Type = ValueTNumber
-	v.Num = num
+	*s.pushValue() = NewValueNum(num)
+}
+
+// Push value to stack
+func (s *StackAPI) PushInteger(num int64) {
+	*s.pushValue() = NewValueInt(num)
 }
 
 // Push value to stack
 func (s *StackAPI) PushString(str string) {
-	v := s.pushValue()
-	v.Type = ValueTString
-	v.Str = s.state.GetString(str)
+	*s.pushValue() = NewValueString(s.state.GetString(str))
 }
 
 // Push value to stack
 func (s *StackAPI) PushBool(value bool) {
-	v := s.pushValue()
-	v.Type = ValueTBool
-	v.BValue = value
+	*s.pushValue() = NewValueBValue(value)
 }
 
 // Push value to stack
 func (s *StackAPI) PushTable(table *Table) {
-	v := s.pushValue()
-	v.Type = ValueTTable
-	v.Table = table
+	*s.pushValue() = NewValueTable(table)
 }
 
 // Push value to stack
 func (s *StackAPI) PushUserData(userData *UserData) {
-	v := s.pushValue()
-	v.Type = ValueTUserData
-	v.UserDate = userData
+	*s.pushValue() = NewValueUserData(userData)
 }
 
 // Push value to stack
 func (s *StackAPI) PushCFunction(function CFunctionType) {
-	v := s.pushValue()
-	v.Type = ValueTCFunction
-	v.CFunc = function
+	*s.pushValue() = NewValueCFunction(function)
+}
+
+// Push value to stack
+func (s *StackAPI) PushThread(thread *Thread) {
+	*s.pushValue() = NewValueThread(thread)
 }
 
 // Push value to stack
@@ -257,6 +290,51 @@ func (s *StackAPI) PushValue(value Value) {
 	*s.pushValue() = value
 }
 
+// Yield current coroutine with 'count' values on the top of stack,
+// arguments of resume are the results of the c function
+func (s *StackAPI) Yield(count int) int {
+	s.state.Yield(s.popValues(count))
+	return 0
+}
+
+// Yield current coroutine with 'count' values on the top of stack, and
+// the c function is continued by 'k' with 'ctx' after coroutine resumed,
+// arguments of resume are pushed on the top of stack for 'k'
+func (s *StackAPI) YieldK(count int, ctx interface{}, k CFunctionKType) int {
+	s.state.YieldK(s.popValues(count), ctx, k)
+	return 0
+}
+
+// Call the function at index of stack with 'argCount' arguments above it,
+// results of the call are placed from index. The function can yield the
+// current coroutine, then the c function is continued by 'k' with 'ctx'
+// after the function returned in the resumed coroutine.
+func (s *StackAPI) CallK(index, argCount, expectResult int, ctx interface{}, k CFunctionKType) {
+	s.state.CallK(s.mustGetStackIndex(index), argCount, expectResult, ctx, k)
+}
+
+// Call the function at index of stack with 'argCount' arguments above it,
+// results of the call are placed from index
+func (s *StackAPI) Call(index, argCount, expectResult int) {
+	s.state.Call(s.mustGetStackIndex(index), argCount, expectResult)
+}
+
+// Call the function at index of stack in protected mode like Call, when
+// any error occurred, the error value (or the result of 'handler') is
+// placed at index, and the error is returned
+func (s *StackAPI) ProtectedCall(index, argCount, expectResult int, handler *Value) error {
+	return s.state.ProtectedCall(s.mustGetStackIndex(index), argCount, expectResult, handler)
+}
+
+// Call the function at index of stack in protected mode like ProtectedCall,
+// but the function can yield the current coroutine, then the c function is
+// continued by 'k' with 'ctx' after the function returned or failed in the
+// resumed coroutine.
+func (s *StackAPI) ProtectedCallK(index, argCount, expectResult int, handler *Value,
+	ctx interface{}, k CFunctionPKType) error {
+	return s.state.ProtectedCallK(s.mustGetStackIndex(index), argCount, expectResult, handler, ctx, k)
+}
+
 // For report argument error
 func (s *StackAPI) ArgCountError(expectCount int) {
 	cFuncError := s.state.GetCFunctionErrorData()
@@ -272,32 +350,75 @@ func (s *StackAPI) ArgTypeError(argIndex, expectType int) {
 	cFuncError.ExpectType = expectType
 }
 
+// Insert value at index of stack, values start from index
+// are shifted up by one
+func (s *StackAPI) InsertValue(index int, value Value) {
+	pos, ok := s.getStackIndex(index)
+	if !ok {
+		s.PushValue(value)
+		return
+	}
+
+	s.pushValue()
+	for top := s.stack.Top - 1; top != pos; top-- {
+		*s.stack.Get(top) = *s.stack.Get(top - 1)
+	}
+	*s.stack.Get(pos) = value
+}
+
+// Pop 'count' values on the top of stack, and return them
+func (s *StackAPI) popValues(count int) []Value {
+	values := make([]Value, count)
+	for i := range values {
+		values[i] = *s.GetValue(i - count)
+	}
+	s.stack.SetNewTop(s.stack.Top - count)
+	return values
+}
+
+// Convert index like getStackIndex, panic when the index is out of
+// this function stack
+func (s *StackAPI) mustGetStackIndex(index int) int {
+	pos, ok := s.getStackIndex(index)
+	if !ok {
+		panic("assert")
+	}
+	return pos
+}
+
 // Push value to stack, and return the value
 func (s *StackAPI) pushValue() *Value {
-	res := s.stack.Top
-	s.stack.Top = vPointerAdd(s.stack.Top, 1)
+	s.state.checkStack(s.stack.Top, 1)
+	res := s.stack.Get(s.stack.Top)
+	s.stack.Top++
 	return res
 }
 
 // For register table member
 type TableMemberReg struct {
-	Name   string        // Member name
-	CFunc  CFunctionType // Member value
-	Number float64       // Member value
-	Str    string        // Member value
-	VType  int           // Member value type
+	Name      string        // Member name
+	CFunc     CFunctionType // Member value
+	Number    float64       // Member value
+	Integer   int64         // Member value
+	IsInteger bool          // Whether member value is integer
+	Str       string        // Member value
+	VType     int           // Member value type
 }
 
 func NewTableMemberRegCFunction(name string, cFunc CFunctionType) *TableMemberReg {
-	return &TableMemberReg{Name: name, CFunc: cFunc}
+	return &TableMemberReg{Name: name, CFunc: cFunc, VType: ValueTCFunction}
 }
 
 func NewTableMemberRegNumber(name string, number float64) *TableMemberReg {
-	return &TableMemberReg{Name: name, Number: number}
+	return &TableMemberReg{Name: name, Number: number, VType: ValueTNumber}
+}
+
+func NewTableMemberRegInteger(name string, integer int64) *TableMemberReg {
+	return &TableMemberReg{Name: name, Integer: integer, IsInteger: true, VType: ValueTNumber}
 }
 
 func NewTableMemberRegString(name, str string) *TableMemberReg {
-	return &TableMemberReg{Name: name, Str: str}
+	return &TableMemberReg{Name: name, Str: str, VType: ValueTString}
 }
 
 // This class provide register C function/data to vm
@@ -307,7 +428,7 @@ type Library struct {
 }
 
 func NewLibrary(state *State) *Library {
-	return &Library{state: state, global: state.global.Table}
+	return &Library{state: state, global: state.global.Table()}
 }
 
 // Register global function 'func' as 'name'
@@ -339,7 +460,11 @@ func (l *Library) registerToTable(table *Table, tableReg *TableMemberReg, size i
 		case ValueTCFunction:
 			l.registerFunc(table, tr.Name, tr.CFunc)
 		case ValueTNumber:
-			l.registerNumber(table, tr.Name, tr.Number)
+			if tr.IsInteger {
+				l.registerInteger(table, tr.Name, tr.Integer)
+			} else {
+				l.registerNumber(table, tr.Name, tr.Number)
+			}
 		case ValueTString:
 			l.registerString(table, tr.Name, tr.Str)
 		default:
@@ -359,6 +484,12 @@ func (l *Library) registerNumber(table *Table, name string, number float64) {
 	table.SetValue(k, v)
 }
 
+func (l *Library) registerInteger(table *Table, name string, integer int64) {
+	k := NewValueString(l.state.GetString(name))
+	v := NewValueInt(integer)
+	table.SetValue(k, v)
+}
+
 func (l *Library) registerString(table *Table, name, str string) {
 	k := NewValueString(l.state.GetString(name))
 	v := NewValueString(l.state.GetString(str))
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"InterpreterVM/Source/io/text"
+	"io"
 )
 
 // Load and manager all modules or load string
@@ -22,8 +23,28 @@ func (mm *ModuleManager) load(lexer *Lexer) {
 	// Semantic analysis
 	SemanticAnalysis(ast, mm.state)
 
+	// Fold constant expressions
+	if mm.state.optimize {
+		FoldConstants(ast, mm.state)
+	}
+
 	// Generate code
 	CodeGenerate(ast, mm.state)
+
+	// Optimize generated code
+	if mm.state.optimize {
+		OptimizeFunction(mm.state.topPrototype())
+	}
+}
+
+// Load binary chunk from 'r', when loaded success, push the closure of
+// the chunk onto stack, 'name' is used to report error
+func (mm *ModuleManager) LoadBinary(r io.Reader, name string) {
+	closure := mm.state.NewClosure()
+	closure.SetPrototype(loadFunction(mm.state, r, name))
+
+	mm.state.checkStack(mm.state.stack.Top, 1)
+	mm.state.stack.Push(NewValueClosure(closure))
 }
 
 // Check module loaded or not
@@ -46,14 +67,19 @@ func (mm *ModuleManager) LoadModule(moduleName string) error {
 		return NewOpenFileFail(moduleName)
 	}
 
-	lexer := NewLexer(mm.state, mm.state.GetString(moduleName),
-		func() byte { return is.GetChar() })
-	mm.load(&lexer)
+	// Module file may be a binary chunk dumped by DumpFunction
+	if IsBinaryChunk(is.PeekChar()) {
+		mm.LoadBinary(is, moduleName)
+	} else {
+		lexer := NewLexer(mm.state, mm.state.GetString(moduleName),
+			func() byte { return is.GetChar() })
+		mm.load(&lexer)
+	}
 
 	// Add to modules' table
 	key := NewValueString(mm.state.GetString(moduleName))
 
-	value := mm.state.stack.ValueStack[len(mm.state.stack.ValueStack)-1]
+	value := *mm.state.stack.Get(mm.state.stack.Top - 1)
 	mm.modules.SetValue(key, value)
 
 	return nil
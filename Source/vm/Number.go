@@ -0,0 +1,153 @@
+package vm
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 2^63 as float, floats in [-2^63, 2^63) can be converted to int64
+const twoPow63 = 9223372036854775808.0
+
+// Convert float to integer, return false when 'f' has no exact
+// integer representation
+func floatToInteger(f float64) (int64, bool) {
+	if math.Floor(f) != f || f < -twoPow63 || f >= twoPow63 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// Convert number to string, it is used by concat, tostring and print.
+// Floats are formatted as "%.14g" with ".0" appended when they look like
+// integers, so 2.0 is "2.0" and 2^63 is "9.2233720368548e+18".
+func NumberToString(num *Value) string {
+	if num.IsInteger() {
+		return strconv.FormatInt(num.Int(), 10)
+	}
+	f := num.Num()
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	str := strconv.FormatFloat(f, 'g', 14, 64)
+	if !strings.ContainsAny(str, ".e") {
+		str += ".0"
+	}
+	return str
+}
+
+// Compare numbers 'x' == 'y', integer and float are compared exactly
+func numberEqual(x, y *Value) bool {
+	if x.IsInteger() && y.IsInteger() {
+		return x.Int() == y.Int()
+	}
+	if x.IsFloat() && y.IsFloat() {
+		return x.Num() == y.Num()
+	}
+
+	// Integer and float
+	if x.IsFloat() {
+		x, y = y, x
+	}
+	i, ok := floatToInteger(y.Num())
+	return ok && i == x.Int()
+}
+
+// Compare numbers 'x' < 'y', integer and float are compared exactly
+func numberLess(x, y *Value) bool {
+	switch {
+	case x.IsInteger() && y.IsInteger():
+		return x.Int() < y.Int()
+	case x.IsInteger():
+		// i < f <=> i < ceil(f)
+		f := y.Num()
+		if f >= -twoPow63 && f < twoPow63 {
+			return x.Int() < int64(math.Ceil(f))
+		}
+		return f > 0
+	case y.IsInteger():
+		// f < i <=> floor(f) < i
+		f := x.Num()
+		if f >= -twoPow63 && f < twoPow63 {
+			return int64(math.Floor(f)) < y.Int()
+		}
+		return f < 0
+	default:
+		return x.Num() < y.Num()
+	}
+}
+
+// Compare numbers 'x' <= 'y', integer and float are compared exactly
+func numberLessEqual(x, y *Value) bool {
+	switch {
+	case x.IsInteger() && y.IsInteger():
+		return x.Int() <= y.Int()
+	case x.IsInteger():
+		// i <= f <=> i <= floor(f)
+		f := y.Num()
+		if f >= -twoPow63 && f < twoPow63 {
+			return x.Int() <= int64(math.Floor(f))
+		}
+		return f > 0
+	case y.IsInteger():
+		// f <= i <=> ceil(f) <= i
+		f := x.Num()
+		if f >= -twoPow63 && f < twoPow63 {
+			return int64(math.Ceil(f)) <= y.Int()
+		}
+		return f < 0
+	default:
+		return x.Num() <= y.Num()
+	}
+}
+
+// Floor division of integers, 'y' must not be 0
+func intFloorDiv(x, y int64) int64 {
+	q := x / y
+	if x%y != 0 && (x < 0) != (y < 0) {
+		q--
+	}
+	return q
+}
+
+// Modulo of integers, result has the same sign as 'y',
+// 'y' must not be 0
+func intMod(x, y int64) int64 {
+	r := x % y
+	if r != 0 && (r < 0) != (y < 0) {
+		r += y
+	}
+	return r
+}
+
+// Floor division of floats
+func floatFloorDiv(x, y float64) float64 {
+	return math.Floor(x / y)
+}
+
+// Modulo of floats, result has the same sign as 'y'
+func floatMod(x, y float64) float64 {
+	r := math.Mod(x, y)
+	if r != 0 && (r < 0) != (y < 0) {
+		r += y
+	}
+	return r
+}
+
+// Shift 'x' left by 'n' bits, shift right when 'n' is negative,
+// vacant bits are filled with 0
+func shiftLeft(x, n int64) int64 {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n >= 0:
+		return int64(uint64(x) << uint(n))
+	default:
+		return int64(uint64(x) >> uint(-n))
+	}
+}
@@ -22,26 +22,148 @@ const (
 	OpTypeNeg                     // A    A: operand register and dst register
 	OpTypeNot                     // A    A: operand register and dst register
 	OpTypeLen                     // A    A: operand register and dst register
-	OpTypeAdd                     // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeSub                     // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeMul                     // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeDiv                     // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypePow                     // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeMod                     // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeConcat                  // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeLess                    // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeGreater                 // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeEqual                   // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeUnEqual                 // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeLessEqual               // ABC  A: dst register B: operand1 register C: operand2 register
-	OpTypeGreaterEqual            // ABC  A: dst register B: operand1 register C: operand2 register
+	OpTypeAdd                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeSub                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeMul                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeDiv                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypePow                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeMod                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeConcat                  // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeLess                    // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeGreater                 // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeEqual                   // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeUnEqual                 // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeLessEqual               // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeGreaterEqual            // ABC  A: dst register B: operand1 RK C: operand2 RK
 	OpTypeNewTable                // A    A: register of table
 	OpTypeSetTable                // ABC  A: register of table B: key register C: value register
 	OpTypeGetTable                // ABC  A: register of table B: key register C: value register
 	OpTypeForInit                 // ABC  A: var register B: limit register    C: step register
 	OpTypeForStep                 // ABC  ABC same with OpType_ForInit, next instruction sBx: diff of instruction index
+	OpTypeIDiv                    // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeBAnd                    // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeBOr                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeBXor                    // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeShl                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeShr                     // ABC  A: dst register B: operand1 RK C: operand2 RK
+	OpTypeBNot                    // A    A: operand register and dst register
+	OpTypeTailCall                // AB   A: register B: arg value count + 1, results are returned by next Ret
 )
 
+// Operand modes of instruction
+const (
+	OpModeA     = iota // A
+	OpModeAB           // A B
+	OpModeABC          // A B C
+	OpModeABx          // A Bx
+	OpModeAsBx         // A sBx
+	OpModesBx          // sBx
+	OpModeABCRK        // A RK(B) RK(C)
+)
+
+// Operand B and C of OpModeABCRK instruction are RK operands, the RK
+// operand is a const index when rkConstBit is set, otherwise a register
+const (
+	rkConstBit      = 1 << 8
+	MaxRKConstIndex = rkConstBit - 1
+)
+
+// Get RK operand of const index
+func RKConst(index int) int {
+	return index | rkConstBit
+}
+
+// Whether RK operand is a const index
+func IsRKConst(rk int) bool {
+	return rk&rkConstBit != 0
+}
+
+// Get const index of RK operand
+func GetRKConstIndex(rk int) int {
+	return rk &^ rkConstBit
+}
+
+// Name and operand mode of each OpType
+var opCodeInfos = [...]struct {
+	name string
+	mode int
+}{
+	OpTypeLoadNil:      {"LoadNil", OpModeA},
+	OpTypeFillNil:      {"FillNil", OpModeAB},
+	OpTypeLoadBool:     {"LoadBool", OpModeAB},
+	OpTypeLoadInt:      {"LoadInt", OpModeA},
+	OpTypeLoadConst:    {"LoadConst", OpModeABx},
+	OpTypeMove:         {"Move", OpModeAB},
+	OpTypeGetUpvalue:   {"GetUpvalue", OpModeAB},
+	OpTypeSetUpvalue:   {"SetUpvalue", OpModeAB},
+	OpTypeGetGlobal:    {"GetGlobal", OpModeABx},
+	OpTypeSetGlobal:    {"SetGlobal", OpModeABx},
+	OpTypeClosure:      {"Closure", OpModeABx},
+	OpTypeCall:         {"Call", OpModeABC},
+	OpTypeVarArg:       {"VarArg", OpModeAsBx},
+	OpTypeRet:          {"Ret", OpModeAsBx},
+	OpTypeJmpFalse:     {"JmpFalse", OpModeAsBx},
+	OpTypeJmpTrue:      {"JmpTrue", OpModeAsBx},
+	OpTypeJmpNil:       {"JmpNil", OpModeAsBx},
+	OpTypeJmp:          {"Jmp", OpModesBx},
+	OpTypeNeg:          {"Neg", OpModeA},
+	OpTypeNot:          {"Not", OpModeA},
+	OpTypeLen:          {"Len", OpModeA},
+	OpTypeAdd:          {"Add", OpModeABCRK},
+	OpTypeSub:          {"Sub", OpModeABCRK},
+	OpTypeMul:          {"Mul", OpModeABCRK},
+	OpTypeDiv:          {"Div", OpModeABCRK},
+	OpTypePow:          {"Pow", OpModeABCRK},
+	OpTypeMod:          {"Mod", OpModeABCRK},
+	OpTypeConcat:       {"Concat", OpModeABCRK},
+	OpTypeLess:         {"Less", OpModeABCRK},
+	OpTypeGreater:      {"Greater", OpModeABCRK},
+	OpTypeEqual:        {"Equal", OpModeABCRK},
+	OpTypeUnEqual:      {"UnEqual", OpModeABCRK},
+	OpTypeLessEqual:    {"LessEqual", OpModeABCRK},
+	OpTypeGreaterEqual: {"GreaterEqual", OpModeABCRK},
+	OpTypeNewTable:     {"NewTable", OpModeA},
+	OpTypeSetTable:     {"SetTable", OpModeABC},
+	OpTypeGetTable:     {"GetTable", OpModeABC},
+	OpTypeForInit:      {"ForInit", OpModeABC},
+	OpTypeForStep:      {"ForStep", OpModeABC},
+	OpTypeIDiv:         {"IDiv", OpModeABCRK},
+	OpTypeBAnd:         {"BAnd", OpModeABCRK},
+	OpTypeBOr:          {"BOr", OpModeABCRK},
+	OpTypeBXor:         {"BXor", OpModeABCRK},
+	OpTypeShl:          {"Shl", OpModeABCRK},
+	OpTypeShr:          {"Shr", OpModeABCRK},
+	OpTypeBNot:         {"BNot", OpModeA},
+	OpTypeTailCall:     {"TailCall", OpModeAB},
+}
+
+// Whether 'opType' is a valid OpType
+func IsValidOpType(opType int) bool {
+	return opType > 0 && opType < len(opCodeInfos)
+}
+
+// Get name of 'opType', "Unknown" if it is not a valid OpType
+func GetOpTypeName(opType int) string {
+	if !IsValidOpType(opType) {
+		return "Unknown"
+	}
+	return opCodeInfos[opType].name
+}
+
+// Get operand mode of 'opType', OpModeA if it is not a valid OpType
+func GetOpTypeMode(opType int) int {
+	if !IsValidOpType(opType) {
+		return OpModeA
+	}
+	return opCodeInfos[opType].mode
+}
+
+// Instruction is encoded in 32 bits as
+// ABC:  OpType(6) A(8) B(9) C(9)
+// ABx:  OpType(6) A(8) 0(2) Bx(16)
+// AsBx: OpType(6) A(8) 0(2) sBx(16)
+// B and C of instructions other than OpModeABCRK are registers
+// or counts, which are less than 256.
 type Instruction struct {
 	OpCode int
 }
@@ -51,38 +173,42 @@ func newInstruction1() Instruction {
 }
 
 func newInstruction2(opType, a, b, c int) Instruction {
-	opCode := (opType << 24) | ((a & 0xFF) << 16) | ((b & 0xFF) << 8) | (c & 0xFF)
+	opCode := (opType << 26) | ((a & 0xFF) << 18) | ((b & 0x1FF) << 9) | (c & 0x1FF)
 	return Instruction{opCode}
 }
 
 func newInstruction3(opType, a int, b int16) Instruction {
-	opCode := (opType << 24) | ((a & 0xFF) << 16) | (int(b) & 0xFFFF)
+	opCode := (opType << 26) | ((a & 0xFF) << 18) | (int(b) & 0xFFFF)
 	return Instruction{opCode}
 }
 
 func newInstruction4(opType, a int, b uint16) Instruction {
-	opCode := (opType << 24) | ((a & 0xFF) << 16) | (int(b) & 0xFFFF)
+	opCode := (opType << 26) | ((a & 0xFF) << 18) | (int(b) & 0xFFFF)
 	return Instruction{opCode}
 }
 
-func (i Instruction) RefillsBx(b int) {
-	i.OpCode = (i.OpCode & 0xFFFF0000) | (b & 0xFFFF)
+func (i *Instruction) RefillsBx(b int) {
+	i.OpCode = (i.OpCode &^ 0x3FFFF) | (b & 0xFFFF)
+}
+
+func (i *Instruction) RefillA(a int) {
+	i.OpCode = (i.OpCode &^ (0xFF << 18)) | ((a & 0xFF) << 18)
 }
 
 func GetOpCode(i Instruction) int {
-	return (i.OpCode >> 24) & 0xFF
+	return (i.OpCode >> 26) & 0x3F
 }
 
 func GetParamA(i Instruction) int {
-	return (i.OpCode >> 16) & 0xFF
+	return (i.OpCode >> 18) & 0xFF
 }
 
 func GetParamB(i Instruction) int {
-	return (i.OpCode >> 8) & 0xFF
+	return (i.OpCode >> 9) & 0x1FF
 }
 
 func GetParamC(instruction Instruction) int {
-	return instruction.OpCode & 0xFF
+	return instruction.OpCode & 0x1FF
 }
 
 func GetParamsBx(i Instruction) int16 {
@@ -0,0 +1,333 @@
+package vm
+
+// Max rounds of peephole passes over the instructions of a function
+const maxOptimizeRounds = 8
+
+// Count of instructions at 'pc', the instructions which take the next
+// instruction as data are 2
+func (f *Function) instructionSize(pc int) int {
+	switch GetOpCode(f.opCodes[pc]) {
+	case OpTypeLoadInt, OpTypeForStep:
+		if pc+1 < len(f.opCodes) {
+			return 2
+		}
+	}
+	return 1
+}
+
+// Get destination of jump instruction at 'pc', return false when the
+// instruction does not jump
+func (f *Function) jumpTarget(pc int) (int, bool) {
+	i := f.opCodes[pc]
+	switch GetOpCode(i) {
+	case OpTypeJmpFalse, OpTypeJmpTrue, OpTypeJmpNil, OpTypeJmp:
+		return pc + int(GetParamsBx(i)), true
+	case OpTypeForStep:
+		if pc+1 < len(f.opCodes) {
+			return pc + 1 + int(GetParamsBx(f.opCodes[pc+1])), true
+		}
+	}
+	return 0, false
+}
+
+// Set destination of jump instruction at 'pc' to 'target'
+func (f *Function) setJumpTarget(pc, target int) {
+	if GetOpCode(f.opCodes[pc]) == OpTypeForStep {
+		f.opCodes[pc+1].RefillsBx(target - pc - 1)
+	} else {
+		f.opCodes[pc].RefillsBx(target - pc)
+	}
+}
+
+// Get all destinations of jump instructions
+func (f *Function) jumpTargets() map[int]bool {
+	targets := make(map[int]bool)
+	for pc := 0; pc < len(f.opCodes); pc += f.instructionSize(pc) {
+		if target, ok := f.jumpTarget(pc); ok {
+			targets[target] = true
+		}
+	}
+	return targets
+}
+
+// Jump to the final destination directly when a jump instruction
+// jumps to an unconditional jump instruction
+func (f *Function) threadJumps() bool {
+	changed := false
+	for pc := 0; pc < len(f.opCodes); pc += f.instructionSize(pc) {
+		target, ok := f.jumpTarget(pc)
+		if !ok {
+			continue
+		}
+
+		// Jumps may be a loop, so follow limited times
+		final := target
+		for n := 0; n < len(f.opCodes) && final < len(f.opCodes) &&
+			GetOpCode(f.opCodes[final]) == OpTypeJmp; n++ {
+			final, _ = f.jumpTarget(final)
+		}
+		if final != target {
+			f.setJumpTarget(pc, final)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Whether register 'r' is a local variable from 'beginPc' to 'endPc'
+func (f *Function) isLocalRegister(r, beginPc, endPc int) bool {
+	for _, v := range f.localVars {
+		if v.RegisterId == r && v.BeginPc <= endPc && beginPc < v.EndPc {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether register 'r' may be read before it is written when executing
+// from 'pc', the unknown instructions are treated as reading 'r'
+func (f *Function) isRegisterLive(pc, r int, visited []bool) bool {
+	for pc < len(f.opCodes) {
+		if visited[pc] {
+			return false
+		}
+		visited[pc] = true
+
+		i := f.opCodes[pc]
+		a, b, c := GetParamA(i), GetParamB(i), GetParamC(i)
+		switch GetOpCode(i) {
+		case OpTypeLoadNil, OpTypeLoadBool, OpTypeLoadInt, OpTypeLoadConst,
+			OpTypeGetUpvalue, OpTypeGetGlobal, OpTypeNewTable:
+			if a == r {
+				return false
+			}
+		case OpTypeFillNil:
+			if r >= a && r < b {
+				return false
+			}
+		case OpTypeMove:
+			if b == r {
+				return true
+			}
+			if a == r {
+				return false
+			}
+		case OpTypeSetUpvalue, OpTypeSetGlobal,
+			OpTypeNeg, OpTypeNot, OpTypeLen, OpTypeBNot:
+			if a == r {
+				return true
+			}
+		case OpTypeClosure:
+			child := f.childFuncs[GetParamBx(i)]
+			for _, upvalue := range child.upvalues {
+				if upvalue.ParentLocal && upvalue.RegisterIndex == r {
+					return true
+				}
+			}
+			if a == r {
+				return false
+			}
+		case OpTypeCall, OpTypeTailCall, OpTypeVarArg:
+			if r >= a {
+				return true
+			}
+		case OpTypeRet:
+			return r >= a
+		case OpTypeJmpFalse, OpTypeJmpTrue, OpTypeJmpNil:
+			target, _ := f.jumpTarget(pc)
+			if a == r || f.isRegisterLive(target, r, visited) {
+				return true
+			}
+		case OpTypeJmp:
+			pc, _ = f.jumpTarget(pc)
+			continue
+		case OpTypeAdd, OpTypeSub, OpTypeMul, OpTypeDiv, OpTypePow, OpTypeMod,
+			OpTypeIDiv, OpTypeBAnd, OpTypeBOr, OpTypeBXor, OpTypeShl, OpTypeShr,
+			OpTypeConcat, OpTypeLess, OpTypeGreater, OpTypeEqual, OpTypeUnEqual,
+			OpTypeLessEqual, OpTypeGreaterEqual:
+			if b == r || c == r {
+				return true
+			}
+			if a == r {
+				return false
+			}
+		case OpTypeGetTable:
+			if a == r || b == r {
+				return true
+			}
+			if c == r {
+				return false
+			}
+		case OpTypeSetTable, OpTypeForInit:
+			if a == r || b == r || c == r {
+				return true
+			}
+		case OpTypeForStep:
+			target, _ := f.jumpTarget(pc)
+			if a == r || b == r || c == r || f.isRegisterLive(target, r, visited) {
+				return true
+			}
+		default:
+			return true
+		}
+		pc += f.instructionSize(pc)
+	}
+	return false
+}
+
+// Whether instruction 'i' writes its result to register A through
+// upvalue, and reads other operands before writing A
+func isMoveCoalescible(i Instruction) bool {
+	switch GetOpCode(i) {
+	case OpTypeLoadNil, OpTypeLoadBool, OpTypeLoadConst, OpTypeMove,
+		OpTypeGetUpvalue, OpTypeGetGlobal,
+		OpTypeAdd, OpTypeSub, OpTypeMul, OpTypeDiv, OpTypePow, OpTypeMod,
+		OpTypeIDiv, OpTypeBAnd, OpTypeBOr, OpTypeBXor, OpTypeShl, OpTypeShr,
+		OpTypeConcat, OpTypeLess, OpTypeGreater, OpTypeEqual, OpTypeUnEqual,
+		OpTypeLessEqual, OpTypeGreaterEqual:
+		return true
+	}
+	return false
+}
+
+// Calculate into the destination of move instruction directly when
+// the result is calculated into a temp register and moved to another
+// register, e.g. 'Add t a b; Move x t' becomes 'Add x a b; Move x x'
+func (f *Function) coalesceMoves() bool {
+	changed := false
+	targets := f.jumpTargets()
+	for pc := 0; pc+1 < len(f.opCodes); pc += f.instructionSize(pc) {
+		i := f.opCodes[pc]
+		move := f.opCodes[pc+1]
+		if GetOpCode(move) != OpTypeMove || targets[pc+1] || !isMoveCoalescible(i) {
+			continue
+		}
+
+		dst, temp := GetParamA(move), GetParamB(move)
+		if dst == temp || GetParamA(i) != temp || f.isLocalRegister(temp, pc, pc+1) {
+			continue
+		}
+		if f.isRegisterLive(pc+2, temp, make([]bool, len(f.opCodes))) {
+			continue
+		}
+
+		f.opCodes[pc].RefillA(dst)
+		f.opCodes[pc+1].RefillA(temp)
+		changed = true
+	}
+	return changed
+}
+
+// Get reachable instructions from the entry of function
+func (f *Function) reachableInstructions() []bool {
+	reachable := make([]bool, len(f.opCodes))
+	pending := []int{0}
+	for len(pending) > 0 {
+		pc := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if pc >= len(f.opCodes) || reachable[pc] {
+			continue
+		}
+
+		size := f.instructionSize(pc)
+		for n := 0; n < size; n++ {
+			reachable[pc+n] = true
+		}
+
+		op := GetOpCode(f.opCodes[pc])
+		if target, ok := f.jumpTarget(pc); ok {
+			pending = append(pending, target)
+		}
+		if op != OpTypeJmp && op != OpTypeRet {
+			pending = append(pending, pc+size)
+		}
+	}
+	return reachable
+}
+
+// Remove dead instructions which are unreachable, and the instructions
+// take no effect, such as 'Move x x' and jumps to the next instruction
+func (f *Function) removeDeadInstructions() bool {
+	reachable := f.reachableInstructions()
+	remove := make([]bool, len(f.opCodes))
+	changed := false
+	for pc := 0; pc < len(f.opCodes); pc++ {
+		i := f.opCodes[pc]
+		switch {
+		case !reachable[pc]:
+			remove[pc] = true
+		case GetOpCode(i) == OpTypeMove && GetParamA(i) == GetParamB(i):
+			remove[pc] = true
+		case GetOpCode(i) == OpTypeJmp && GetParamsBx(i) == 1:
+			remove[pc] = true
+		}
+		changed = changed || remove[pc]
+
+		// Skip the data of instruction
+		if size := f.instructionSize(pc); reachable[pc] && size > 1 {
+			pc += size - 1
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	// New index of instructions, removed instruction is mapped to
+	// the next remaining instruction
+	newPc := make([]int, len(f.opCodes)+1)
+	count := 0
+	for pc := range f.opCodes {
+		newPc[pc] = count
+		if !remove[pc] {
+			count++
+		}
+	}
+	newPc[len(f.opCodes)] = count
+
+	// Refill jumps by new index before moving instructions
+	for pc := 0; pc < len(f.opCodes); pc += f.instructionSize(pc) {
+		if target, ok := f.jumpTarget(pc); ok && !remove[pc] {
+			if GetOpCode(f.opCodes[pc]) == OpTypeForStep {
+				f.opCodes[pc+1].RefillsBx(newPc[target] - newPc[pc+1])
+			} else {
+				f.opCodes[pc].RefillsBx(newPc[target] - newPc[pc])
+			}
+		}
+	}
+
+	opCodes := f.opCodes[:0]
+	opCodeLines := f.opCodeLines[:0]
+	for pc := range f.opCodes {
+		if !remove[pc] {
+			opCodes = append(opCodes, f.opCodes[pc])
+			opCodeLines = append(opCodeLines, f.opCodeLines[pc])
+		}
+	}
+	f.opCodes = opCodes
+	f.opCodeLines = opCodeLines
+
+	for index := range f.localVars {
+		v := &f.localVars[index]
+		v.BeginPc = newPc[v.BeginPc]
+		v.EndPc = newPc[v.EndPc]
+	}
+	return true
+}
+
+// Optimize instructions of function prototype 'f' and all its child
+// functions by peephole passes: thread jumps to jumps, remove redundant
+// moves and remove dead code after return and break
+func OptimizeFunction(f *Function) {
+	for _, child := range f.childFuncs {
+		OptimizeFunction(child)
+	}
+
+	for round := 0; round < maxOptimizeRounds; round++ {
+		changed := f.threadJumps()
+		changed = f.coalesceMoves() || changed
+		changed = f.removeDeadInstructions() || changed
+		if !changed {
+			break
+		}
+	}
+}
@@ -1,7 +1,5 @@
 package vm
 
-import "fmt"
-
 const (
 	prefixExpTypeNormal = iota
 	prefixExpTypeVar
@@ -13,10 +11,11 @@ type parserImpl struct {
 	current     TokenDetail
 	lookAhead_  TokenDetail
 	lookAhead2_ TokenDetail
+	parenExp    SyntaxTree // Last expression in parentheses, e.g. '(exp)'
 }
 
 func newParserImpl(lexer *Lexer) *parserImpl {
-	return &parserImpl{lexer, *NewTokenDetail(), *NewTokenDetail(), *NewTokenDetail()}
+	return &parserImpl{lexer, *NewTokenDetail(), *NewTokenDetail(), *NewTokenDetail(), nil}
 }
 
 func (p *parserImpl) parse() SyntaxTree {
@@ -43,7 +42,8 @@ func (p *parserImpl) parseExp(left SyntaxTree, op TokenDetail, leftPriority int)
 	var err error
 	p.lookAhead()
 
-	if p.lookAhead_.Token == '-' || p.lookAhead_.Token == '#' || p.lookAhead_.Token == TokenNot {
+	if p.lookAhead_.Token == '-' || p.lookAhead_.Token == '#' ||
+		p.lookAhead_.Token == '~' || p.lookAhead_.Token == TokenNot {
 		p.nextToken()
 		unexp := &UnaryExpression{}
 		unexp.OpToken = p.current
@@ -176,9 +176,9 @@ func (p *parserImpl) parseParamList() (SyntaxTree, error) {
 			} else {
 				return nil, NewParseError("unexpect token in param list", p.lookAhead_)
 			}
-
-			nameList = names
 		}
+
+		nameList = names
 	} else if p.lookAhead().Token == TokenVarArg {
 		p.nextToken() // skip Token_VarArg
 		vararg = true
@@ -208,7 +208,7 @@ func (p *parserImpl) parseBlock() (SyntaxTree, error) {
 		} else {
 			statement, err := p.parseStatement()
 			if err != nil {
-				fmt.Println(err)
+				return nil, err
 			}
 			if statement != nil {
 				block.Statements = append(block.Statements, statement)
@@ -237,6 +237,7 @@ func (p *parserImpl) parseReturnStatement() SyntaxTree {
 
 	if p.lookAhead().Token != ';' {
 		returnStmt.ExpList = p.parseExpList()
+		returnStmt.TailCall = p.isTailCallExpList(returnStmt.ExpList)
 	} else {
 		p.nextToken()
 	}
@@ -244,6 +245,20 @@ func (p *parserImpl) parseReturnStatement() SyntaxTree {
 	return returnStmt
 }
 
+// Whether the expression list of return statement is a single function
+// call, call in parentheses such as 'return (f(args))' is not a tail call
+func (p *parserImpl) isTailCallExpList(expList SyntaxTree) bool {
+	list, ok := expList.(*ExpressionList)
+	if !ok || len(list.ExpList) != 1 || list.ExpList[0] == p.parenExp {
+		return false
+	}
+	switch list.ExpList[0].(type) {
+	case *NormalFuncCall, *MemberFuncCall:
+		return true
+	}
+	return false
+}
+
 func (p *parserImpl) parseStatement() (SyntaxTree, error) {
 	switch p.lookAhead().Token {
 	case ';':
@@ -378,7 +393,7 @@ func (p *parserImpl) parseIfStatement() (SyntaxTree, error) {
 
 func (p *parserImpl) parseElseIfStatement() (SyntaxTree, error) {
 	p.nextToken() // skip 'elseif'
-	if p.current.Token == TokenElseif {
+	if p.current.Token != TokenElseif {
 		panic("assert")
 	}
 	line := p.current.Line
@@ -498,7 +513,7 @@ func (p *parserImpl) parseForStatement() (SyntaxTree, error) {
 }
 
 func (p *parserImpl) parseNumericForStatement() (SyntaxTree, error) {
-	name := p.nextToken()
+	name := *p.nextToken()
 	if p.current.Token != TokenId {
 		panic("assert")
 	}
@@ -541,7 +556,7 @@ func (p *parserImpl) parseNumericForStatement() (SyntaxTree, error) {
 	if p.nextToken().Token != TokenEnd {
 		return nil, NewParseError("expect 'end' to complete numeric-for", p.current)
 	}
-	return NewNumericForStatement(*name, exp1, exp2, exp3, block), nil
+	return NewNumericForStatement(name, exp1, exp2, exp3, block), nil
 }
 
 func (p *parserImpl) parseGenericForStatement() (SyntaxTree, error) {
@@ -582,7 +597,7 @@ func (p *parserImpl) parseLocalStatement() (SyntaxTree, error) {
 	if p.lookAhead().Token == TokenFunction {
 		return p.parseLocalFunction()
 	} else if p.lookAhead().Token == TokenId {
-		return p.parseNameList()
+		return p.parseLocalNameList(), nil
 	} else {
 		return nil, NewParseError("unexpect token after 'local'", p.lookAhead_)
 	}
@@ -661,7 +676,7 @@ func (p *parserImpl) parseOtherStatement() (SyntaxTree, error) {
 			p.nextToken() // skip ','
 			exp, err := p.parsePrefixExp(&prefixExpType)
 			if err != nil {
-				fmt.Println(err)
+				return nil, err
 			}
 			if prefixExpType != prefixExpTypeVar {
 				return nil, NewParseError("expect var here", p.current)
@@ -696,6 +711,7 @@ func (p *parserImpl) parsePrefixExp(prefixExpType *int) (SyntaxTree, error) {
 		if p.nextToken().Token != ')' {
 			return nil, NewParseError("expect ')'", p.current)
 		}
+		p.parenExp = exp
 		if prefixExpType != nil {
 			*prefixExpType = prefixExpTypeNormal
 		}
@@ -901,7 +917,7 @@ func (p *parserImpl) parseTableIndexField() (SyntaxTree, error) {
 }
 
 func (p *parserImpl) parseTableNameField() SyntaxTree {
-	name := p.nextToken()
+	name := *p.nextToken()
 
 	p.nextToken()
 	if p.current.Token != '=' {
@@ -913,7 +929,7 @@ func (p *parserImpl) parseTableNameField() SyntaxTree {
 		panic(err)
 	}
 
-	return NewTableNameField(*name, value)
+	return NewTableNameField(name, value)
 }
 
 func (p *parserImpl) parseTableArrayField() SyntaxTree {
@@ -982,12 +998,20 @@ func (p *parserImpl) getOpPriority(t TokenDetail) int {
 	switch t.Token {
 	case '^':
 		return 100
-	case '*', '/', '%':
+	case '*', '/', TokenIDiv, '%':
 		return 80
 	case '+', '-':
 		return 70
 	case TokenConcat:
 		return 60
+	case TokenShiftLeft, TokenShiftRight:
+		return 58
+	case '&':
+		return 56
+	case '~':
+		return 54
+	case '|':
+		return 52
 	case '>', '<', TokenGreaterEqual, TokenLessEqual, TokenNotEqual, TokenEqual:
 		return 50
 	case TokenAnd:
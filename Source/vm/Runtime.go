@@ -1,53 +1,83 @@
 package vm
 
-import (
-	"unsafe"
+// Initial and max count of values in stack
+const (
+	KBaseStackSize int = 1024
+	KMaxStackSize  int = 1000000
 )
 
-// Used for Value pointer addition operations
-func vPointerAdd(v *Value, i int) *Value {
-	return (*Value)(unsafe.Pointer(uintptr(unsafe.Pointer(v)) + uintptr(i)*unsafe.Sizeof(Value{})))
-}
-
-// Used for Instruction pointer addition operations
-func iPointerAdd(v *Instruction, i int) *Instruction {
-	return (*Instruction)(unsafe.Pointer(uintptr(unsafe.Pointer(v)) + uintptr(i)*unsafe.Sizeof(Instruction{})))
-}
-
-const KBaseStackSize int = 10000
+// Count of values in each chunk of stack
+const (
+	stackChunkShift = 10
+	stackChunkSize  = 1 << stackChunkShift
+	stackChunkMask  = stackChunkSize - 1
+)
 
 // Runtime stack, registers of each function is one part of stack.
+// Values are stored in fixed size chunks, so the stack grows on demand
+// without moving any value, and values are accessed by index.
 type Stack struct {
-	ValueStack []Value
-	Top        *Value
+	chunks [][]Value // Chunks of values
+	Top    int       // Index of stack top
 }
 
 func NewStack() *Stack {
 	s := new(Stack)
-	s.ValueStack = make([]Value, 1, KBaseStackSize)
-	s.Top = &s.ValueStack[0]
+	s.Grow(KBaseStackSize)
 	return s
 }
 
-// Set new top pointer, and [new top, old top) will be set nil
-func (s *Stack) SetNewTop(top *Value) {
+// Get value by index
+func (s *Stack) Get(index int) *Value {
+	return &s.chunks[index>>stackChunkShift][index&stackChunkMask]
+}
+
+// Get count of values which can be used without growing
+func (s *Stack) Size() int {
+	return len(s.chunks) * stackChunkSize
+}
+
+// Grow the stack to hold 'size' values at least,
+// return false when 'size' is larger than KMaxStackSize
+func (s *Stack) Grow(size int) bool {
+	if size > KMaxStackSize {
+		return false
+	}
+	for s.Size() < size {
+		s.chunks = append(s.chunks, make([]Value, stackChunkSize))
+	}
+	return true
+}
+
+// Push value on the top, the stack must have been grown to hold it
+func (s *Stack) Push(value Value) {
+	*s.Get(s.Top) = value
+	s.Top++
+}
+
+// Set new top index, and [new top, old top] will be set nil
+func (s *Stack) SetNewTop(top int) {
 	old := s.Top
 	s.Top = top
 
 	// Clear values between new top to old
-	for uintptr(unsafe.Pointer(top)) <= uintptr(unsafe.Pointer(old)) {
-		top.SetNil()
-		top = vPointerAdd(top, 1)
+	for ; top <= old && top < s.Size(); top++ {
+		s.Get(top).SetNil()
 	}
 }
 
 // Function call stack info
 type CallInfo struct {
-	Register     *Value       // register base pointer which points to Stack
-	Func         *Value       // current closure, pointer to stack Value
-	Instruction  *Instruction // current Instruction
-	End          *Instruction // Instruction end
-	ExpectResult int          // expect result of this function call
+	Register     int            // register base index of Stack
+	Func         int            // index of current function in Stack
+	Instruction  int            // index of current Instruction of the prototype
+	End          int            // Instruction end index
+	ExpectResult int            // expect result of this function call
+	Continuation CFunctionKType // continuation of c function after coroutine resumed
+	Context      interface{}    // context passed to the continuation
+
+	protected  *protectedCall // yieldable protected call of c function, nil when not in it
+	finishMeta func()         // finish of instruction which called a metamethod, nil when not in it
 }
 
 func NewCallInfo() *CallInfo {
@@ -14,7 +14,7 @@ type lexicalBlock struct {
 }
 
 func newLexicalBlock() *lexicalBlock {
-	return &lexicalBlock{}
+	return &lexicalBlock{Names: make(map[*String]bool)}
 }
 
 // Lexical function data for name finding
@@ -273,7 +273,8 @@ func (sav *semanticAnalysisVisitor) VisitBinaryExpression(binaryExp *BinaryExpre
 
 	parentExpVarData := (*expVarData)(data)
 	switch binaryExp.OpToken.Token {
-	case '+', '-', '*', '/', '^', '%':
+	case '+', '-', '*', '/', '^', '%', TokenIDiv,
+		'&', '|', '~', TokenShiftLeft, TokenShiftRight:
 		if lExpVarData.ExpType != ExpTypeUnknown && lExpVarData.ExpType != ExpTypeNumber {
 			panic(NewSemanticError("left expression of binary operator is not number",
 				binaryExp.OpToken))
@@ -320,7 +321,7 @@ func (sav *semanticAnalysisVisitor) VisitUnaryExpression(unaryExp *UnaryExpressi
 	// Expression type
 	if eVarData.ExpType != ExpTypeUnknown {
 		switch unaryExp.OpToken.Token {
-		case '-':
+		case '-', '~':
 			if eVarData.ExpType != ExpTypeNumber {
 				panic(NewSemanticError("operand is not number", unaryExp.OpToken))
 			}
@@ -333,7 +334,8 @@ func (sav *semanticAnalysisVisitor) VisitUnaryExpression(unaryExp *UnaryExpressi
 	}
 
 	parentExpVarData := (*expVarData)(data)
-	if unaryExp.OpToken.Token == '-' || unaryExp.OpToken.Token == '#' {
+	if unaryExp.OpToken.Token == '-' || unaryExp.OpToken.Token == '#' ||
+		unaryExp.OpToken.Token == '~' {
 		parentExpVarData.ExpType = ExpTypeNumber
 	} else if unaryExp.OpToken.Token == TokenNot {
 		parentExpVarData.ExpType = ExpTypeBool
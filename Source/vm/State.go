@@ -2,8 +2,12 @@ package vm
 
 import (
 	"container/list"
+	"context"
+	"errors"
+	"io"
 	"math"
-	"unsafe"
+	"runtime"
+	"strings"
 )
 
 // Error type reported by called c function
@@ -37,45 +41,79 @@ type State struct {
 
 	cFuncError CFunctionError // Error of call c function
 
-	stack  Stack     // Stack data
-	calls  list.List // Stack frames, and its element.value is CallInfo
-	global Value     // Global table
+	mainThread *Thread    // The main thread
+	thread     *Thread    // Current running thread
+	stack      *Stack     // Stack data of current running thread
+	calls      *list.List // Stack frames of current running thread, and its element.value is CallInfo
+	global     Value      // Global table
+
+	finalizing bool // Finalizers are running, they are not called recursively
+
+	ctx          context.Context // Context of current execution, nil when not set
+	ctxCountdown int             // Count of instructions before next check of ctx
+
+	limits           Limits // Resource limits
+	instructionCount int    // Count of instructions executed in current call
+
+	optimize bool // Optimize code when loading module or string
+}
+
+// Resource limits of State, zero means no limit. Limit error
+// is raised when any limit is exceeded.
+type Limits struct {
+	MaxInstructions int // Max count of instructions executed in each call of module or string
+	MaxCallDepth    int // Max count of stack frames of a thread
+	MaxStackSize    int // Max count of values in stack of a thread
+	MaxObjects      int // Max count of live GC objects
 }
 
+// Count of instructions executed between two checks of the context
+const contextCheckInterval = 1024
+
 func NewState() *State {
 	var s State
 
 	s.stringPool = NewStringPool()
+	s.cFuncError = NewCFunctionError()
+	s.optimize = true
 
 	// Init GC
 	deleter := func(obj GCObject, objType int) {
-		if objType == GCObjectTypeString {
+		switch objType {
+		case GCObjectTypeString:
 			s.stringPool.DeleteString(obj.(*String))
+		case GCObjectTypeUserData:
+			obj.(*UserData).destroy()
 		}
 		obj = nil
 	}
-	s.gc = NewGC(deleter, false)
+	s.gc = NewGC(deleter)
 	root := s.fullGCRoot
 	s.gc.SetRootTraveller(root, root)
+	s.gc.SetFinalizeChecker(s.needFinalize)
+	s.gc.SetWeakModeChecker(s.getWeakMode)
+
+	// Init main thread
+	s.mainThread = s.NewThread()
+	s.mainThread.isMain = true
+	s.mainThread.status = ThreadStatusRunning
+	s.switchThread(s.mainThread)
 
 	// New global table
-	s.global.Table = s.NewTable()
-	s.global.Type = ValueTTable
+	s.global = NewValueTable(s.NewTable())
 
 	// New table for store metaTables
 	k := NewValueString(s.GetString(metaTables))
 	v := NewValueTable(s.NewTable())
-	s.global.Table.SetValue(k, v)
+	s.global.Table().SetValue(k, v)
 
 	// New table for store modules
 	k = NewValueString(s.GetString(modulesTable))
 	v = NewValueTable(s.NewTable())
-	s.global.Table.SetValue(k, v)
+	s.global.Table().SetValue(k, v)
 
 	// Init module manager
-	s.moduleManager = NewModuleManager(&s, v.Table)
-
-	s.stack = *NewStack()
+	s.moduleManager = NewModuleManager(&s, v.Table())
 
 	return &s
 }
@@ -85,66 +123,58 @@ func (s *State) fullGCRoot(v GCObjectVisitor) {
 	// Visit global table
 	s.global.Accept(v)
 
-	// Visit stack values
-	for index := range s.stack.ValueStack {
-		s.stack.ValueStack[index].Accept(v)
-	}
-
-	// Visit call info
-	for e := s.calls.Front(); e != nil; e = e.Next() {
-		call := e.Value.(*CallInfo)
-		call.Register.Accept(v)
-		if call.Func != nil {
-			call.Func.Accept(v)
-		}
-	}
+	// Visit main thread and current running thread, other running
+	// threads are reachable from them
+	s.mainThread.Accept(v)
+	s.thread.Accept(v)
 }
 
 // For CallFunction
-func (s *State) callClosure(f *Value, expectResult int) {
+func (s *State) callClosure(f int, expectResult int) {
+	s.checkCallDepth()
+
 	var callee CallInfo
-	calleeProto := f.Closure.GetPrototype()
-	callee.Func = f
-	callee.Instruction = calleeProto.GetOpCodes()
-	callee.End = iPointerAdd(callee.Instruction, calleeProto.OpCodeSize())
-	callee.ExpectResult = expectResult
+	s.setupClosureCall(&callee, f, expectResult)
+	s.calls.PushBack(&callee)
+}
 
-	arg := vPointerAdd(f, 1)
+// Setup CallInfo 'callee' to execute closure 'f' with the args above it
+func (s *State) setupClosureCall(callee *CallInfo, f int, expectResult int) {
+	calleeProto := s.stack.Get(f).Closure().GetPrototype()
+	*callee = CallInfo{Func: f, End: calleeProto.OpCodeSize(), ExpectResult: expectResult}
+
+	arg := f + 1
 	fixedArgs := calleeProto.FixedArgCount()
 
 	// Fixed arg start from base register
 	if calleeProto.HasVararg() {
-		top := s.stack.Top
-		callee.Register = top
-		count := int((uintptr(unsafe.Pointer(top)) - uintptr(unsafe.Pointer(arg))) /
-			unsafe.Sizeof(Value{}))
-		for i := 0; i < count && i < int(fixedArgs); i++ {
-			*top = *arg
-			top = vPointerAdd(top, 1)
-			arg = vPointerAdd(arg, 1)
+		callee.Register = s.stack.Top
+		s.checkStack(callee.Register, frameRegisterCount)
+		count := callee.Register - arg
+		for i := 0; i < count && i < fixedArgs; i++ {
+			*s.stack.Get(callee.Register + i) = *s.stack.Get(arg + i)
 		}
 	} else {
 		callee.Register = arg
+		s.checkStack(callee.Register, frameRegisterCount)
 		// fill nil for overflow args
-		newTop := vPointerAdd(callee.Register, fixedArgs)
-		arg := s.stack.Top
-		for uintptr(unsafe.Pointer(arg)) < uintptr(unsafe.Pointer(newTop)) {
-			arg.SetNil()
-			arg = vPointerAdd(arg, 1)
+		for arg := s.stack.Top; arg < callee.Register+fixedArgs; arg++ {
+			s.stack.Get(arg).SetNil()
 		}
 	}
 
-	s.stack.SetNewTop(vPointerAdd(callee.Register, fixedArgs))
-	s.calls.PushBack(&callee)
+	s.stack.SetNewTop(callee.Register + fixedArgs)
 }
 
-func (s *State) callCFunction(f *Value, expectResult int) {
+func (s *State) callCFunction(f int, expectResult int) {
+	s.checkCallDepth()
+
 	// Push the c function CallInfo
-	callee := CallInfo{Register: vPointerAdd(f, 1), Func: f, ExpectResult: expectResult}
+	callee := CallInfo{Register: f + 1, Func: f, ExpectResult: expectResult}
 	s.calls.PushBack(&callee)
 
 	// Call c function
-	cfunc := f.CFunc
+	cfunc := s.stack.Get(f).CFunc()
 	if err := s.checkCFunctionError(); err != nil {
 		panic(err)
 	}
@@ -153,24 +183,33 @@ func (s *State) callCFunction(f *Value, expectResult int) {
 		panic(err)
 	}
 
-	var src *Value
-	if resCount > 0 {
-		src = vPointerAdd(s.stack.Top, resCount)
-	}
+	s.postCallCFunction(f, expectResult, resCount)
+}
+
+// Copy 'resCount' results on the top of stack to the position of c function
+// 'f' by 'expectResult', then pop the c function CallInfo
+func (s *State) postCallCFunction(f int, expectResult, resCount int) {
+	src := s.stack.Top - resCount
 
 	// Copy c function result to caller stack
 	dst := f
 	if expectResult == ExpValueCountAny {
-		for i := 0; i < int(resCount); i++ {
-			*dst = *src
-			dst = vPointerAdd(dst, 1)
-			src = vPointerAdd(src, 1)
+		for i := 0; i < resCount; i++ {
+			*s.stack.Get(dst) = *s.stack.Get(src)
+			dst++
+			src++
 		}
 	} else {
 		count := int(math.Min(float64(expectResult), float64(resCount)))
 		for i := 0; i < count; i++ {
-			dst.SetNil()
-			dst = vPointerAdd(dst, 1)
+			*s.stack.Get(dst) = *s.stack.Get(src)
+			dst++
+			src++
+		}
+		// Set all remain expect results to nil
+		for i := count; i < expectResult; i++ {
+			s.stack.Get(dst).SetNil()
+			dst++
 		}
 	}
 
@@ -193,11 +232,10 @@ func (s *State) checkCFunctionError() error {
 		exp = NewCallCFuncError("expect ", e.ExpectArgCount, " arguments")
 	} else if e.eType == CFunctionErrorTypeArgType {
 		call := s.calls.Back().Value.(*CallInfo)
-		arg := vPointerAdd(call.Register, e.ArgIndex)
+		arg := s.stack.Get(call.Register + e.ArgIndex)
 		exp = NewCallCFuncError("argument #", e.ArgIndex+1,
 			" is a ", arg.TypeName(), " value, expect a ",
-			(e.ExpectType), " value")
-		// TODO
+			arg.GetTypeName(e.ExpectType), " value")
 	}
 
 	// Pop the c function CallInfo
@@ -208,11 +246,11 @@ func (s *State) checkCFunctionError() error {
 // Get the table which stores all metaTables
 func (s *State) getMetaTables() *Table {
 	k := NewValueString(s.GetString(metaTables))
-	v := s.global.Table.GetValue(k)
-	if v.Type != ValueTTable {
+	v := s.global.Table().GetValue(k)
+	if v.Type() != ValueTTable {
 		panic("assert")
 	}
-	return v.Table
+	return v.Table()
 }
 
 // Check module loaded or not
@@ -223,65 +261,791 @@ func (s *State) IsModuleLoaded(moduleName string) bool {
 // Load module, if load success, then push a module closure on stack,
 // otherwise throw Exception
 func (s *State) LoadModule(moduleName string) {
-	value := s.moduleManager.GetModuleClosure(moduleName)
-	if value.IsNil() {
-		panic(s.moduleManager.LoadModule(moduleName))
-	} else {
-		*s.stack.Top = value
-		s.stack.Top = vPointerAdd(s.stack.Top, 1)
+	if err := s.TryLoadModule(moduleName); err != nil {
+		panic(err)
 	}
 }
 
+// Load module, if load success, then push a module closure on stack,
+// otherwise return the error
+func (s *State) TryLoadModule(moduleName string) error {
+	return s.runProtected(func() {
+		value := s.moduleManager.GetModuleClosure(moduleName)
+		if value.IsNil() {
+			if err := s.moduleManager.LoadModule(moduleName); err != nil {
+				panic(err)
+			}
+		} else {
+			s.checkStack(s.stack.Top, 1)
+			s.stack.Push(value)
+		}
+	})
+}
+
 // Load module and call the module function when the module loaded success.
 func (s *State) DoModule(moduleName string) {
-	s.LoadModule(moduleName)
-	isTrue, err := s.CallFunction(vPointerAdd(s.stack.Top, -1), 0, 0)
-	if err != nil {
+	if err := s.TryDoModule(moduleName); err != nil {
 		panic(err)
 	}
-	if isTrue {
-		vm := NewVM(s)
-		vm.Execute()
+}
+
+// Load module and call the module function when the module loaded success,
+// return the error when load or call failed.
+func (s *State) TryDoModule(moduleName string) error {
+	if err := s.TryLoadModule(moduleName); err != nil {
+		return err
 	}
+	return s.callLoaded()
 }
 
 // Load string and call the string function when the string loaded success.
 func (s *State) DoString(str, name string) {
-	s.moduleManager.LoadString(str, name)
-	isTrue, err := s.CallFunction(vPointerAdd(s.stack.Top, -1), 0, 0)
-	if err != nil {
+	if err := s.TryDoString(str, name); err != nil {
 		panic(err)
 	}
-	if isTrue {
-		vm := NewVM(s)
-		vm.Execute()
+}
+
+// Load string and call the string function when the string loaded success,
+// return the error when load or call failed.
+func (s *State) TryDoString(str, name string) error {
+	if err := s.TryLoadString(str, name); err != nil {
+		return err
+	}
+	return s.callLoaded()
+}
+
+// Load string, if load success, then push the string closure on stack,
+// otherwise return the error
+func (s *State) TryLoadString(str, name string) error {
+	return s.runProtected(func() {
+		s.moduleManager.LoadString(str, name)
+	})
+}
+
+// Load binary chunk from 'r', if load success, then push the chunk
+// closure on stack, otherwise return the error
+func (s *State) TryLoadBinary(r io.Reader, name string) error {
+	return s.runProtected(func() {
+		s.moduleManager.LoadBinary(r, name)
+	})
+}
+
+// Load binary chunk and call the chunk function when the chunk loaded
+// success, return the error when load or call failed.
+func (s *State) TryDoBinary(r io.Reader, name string) error {
+	if err := s.TryLoadBinary(r, name); err != nil {
+		return err
+	}
+	return s.callLoaded()
+}
+
+// Get prototype of the closure on the top of stack, nil if there is not
+func (s *State) topPrototype() *Function {
+	if s.stack.Top == 0 || s.stack.Get(s.stack.Top-1).Closure() == nil {
+		return nil
+	}
+	return s.stack.Get(s.stack.Top - 1).Closure().GetPrototype()
+}
+
+// Dump prototype of the closure on the top of stack to 'w' as a binary
+// chunk, the closure is not popped
+func (s *State) Dump(w io.Writer) error {
+	f := s.topPrototype()
+	if f == nil {
+		return NewBinaryChunkError("", "no closure on the top of stack")
+	}
+	return DumpFunction(w, f)
+}
+
+// Write listing of the closure on the top of stack to 'w',
+// the closure is not popped
+func (s *State) Disassemble(w io.Writer) error {
+	f := s.topPrototype()
+	if f == nil {
+		return errors.New("no closure on the top of stack")
+	}
+	return Disassemble(w, f)
+}
+
+// Load module and call the module function like TryDoModule, the execution
+// is aborted with ErrCanceled or ErrDeadlineExceeded when 'ctx' is done.
+func (s *State) TryDoModuleContext(ctx context.Context, moduleName string) error {
+	return s.runWithContext(ctx, func() error { return s.TryDoModule(moduleName) })
+}
+
+// Load string and call the string function like TryDoString, the execution
+// is aborted with ErrCanceled or ErrDeadlineExceeded when 'ctx' is done.
+func (s *State) TryDoStringContext(ctx context.Context, str, name string) error {
+	return s.runWithContext(ctx, func() error { return s.TryDoString(str, name) })
+}
+
+// Run 'f' with the context 'ctx', the context is checked before
+// executing the first instruction and periodically after that
+func (s *State) runWithContext(ctx context.Context, f func() error) error {
+	prevCtx, prevCountdown := s.ctx, s.ctxCountdown
+	s.ctx, s.ctxCountdown = ctx, 0
+	defer func() { s.ctx, s.ctxCountdown = prevCtx, prevCountdown }()
+	return f()
+}
+
+// Check the context of current execution, return the cause
+// when the execution should be aborted
+func (s *State) checkContext() error {
+	if s.ctx == nil {
+		return nil
+	}
+	if s.ctxCountdown--; s.ctxCountdown > 0 {
+		return nil
+	}
+	s.ctxCountdown = contextCheckInterval
+
+	switch s.ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrDeadlineExceeded
+	default:
+		return ErrCanceled
+	}
+}
+
+// Set resource limits of State
+func (s *State) SetLimits(limits Limits) {
+	s.limits = limits
+	if limits.MaxObjects > 0 {
+		s.gc.SetObjectLimit(uint(limits.MaxObjects))
+	} else {
+		s.gc.SetObjectLimit(0)
 	}
 }
 
+func (s *State) GetLimits() Limits {
+	return s.limits
+}
+
+// Enable or disable the optimizer which folds constant expressions,
+// references consts and locals by RK operands and removes redundant
+// instructions when loading module or string, it is enabled by default
+// and can be disabled for debugging
+func (s *State) SetOptimize(optimize bool) {
+	s.optimize = optimize
+}
+
+func (s *State) IsOptimize() bool {
+	return s.optimize
+}
+
+// Check limits of instruction count and object count before
+// executing an instruction, return the cause when exceeded
+func (s *State) checkLimits() error {
+	s.instructionCount++
+	if s.limits.MaxInstructions > 0 && s.instructionCount > s.limits.MaxInstructions {
+		return ErrInstructionLimit
+	}
+	if s.gc.ObjectLimitExceeded() && !s.collectForObjectLimit() {
+		return ErrObjectLimit
+	}
+	return nil
+}
+
+// Run full GC after an allocation exceeded the object count limit, return
+// false when the limit is still exceeded. Finalizers of unreachable user
+// data are called first, then objects released by them are collected.
+func (s *State) collectForObjectLimit() bool {
+	s.gc.FullGC()
+	if s.gc.finalized.Len() != 0 {
+		s.runFinalizers()
+		s.gc.FullGC()
+	}
+	s.runFinalizers()
+
+	// Allocations of finalizers are checked by this call
+	s.gc.ObjectLimitExceeded()
+	return s.gc.GetObjectCount() <= uint(s.limits.MaxObjects)
+}
+
+// Grow the stack to hold 'count' values from index 'base', report
+// stack overflow when the size exceeded the limit or KMaxStackSize
+func (s *State) checkStack(base, count int) {
+	size := base + count
+	if s.limits.MaxStackSize > 0 && size > s.limits.MaxStackSize {
+		panic(s.newLimitError(ErrStackSizeLimit))
+	}
+	if !s.stack.Grow(size) {
+		panic(s.newLimitError(ErrStackOverflow))
+	}
+}
+
+// Check a new stack frame can be pushed
+func (s *State) checkCallDepth() {
+	if s.limits.MaxCallDepth > 0 && s.calls.Len() >= s.limits.MaxCallDepth {
+		panic(s.newLimitError(ErrCallDepthLimit))
+	}
+}
+
+// New limit error with the position of the innermost closure call
+func (s *State) newLimitError(cause error) error {
+	for level := 0; level < s.calls.Len(); level++ {
+		if module, line, ok := s.GetCallPos(level); ok {
+			return NewLimitError(module, line, cause)
+		}
+	}
+	return NewLimitError("", 0, cause)
+}
+
+// Call the loaded module or string function on the top of stack,
+// the function is popped when error occurred
+func (s *State) callLoaded() error {
+	s.instructionCount = 0
+	f := s.stack.Top - 1
+	err := s.runProtected(func() { s.Call(f, 0, 0) })
+	if err != nil {
+		s.stack.SetNewTop(f)
+	}
+	return err
+}
+
 // Call an in stack function
 // If f is a closure, then create a stack frame and return true,
 // call VM::Execute() to execute the closure instructions.
 // Return false when f is a c function.
-func (s *State) CallFunction(f *Value, argCount int, expectResult int) (bool, error) {
-	if f.Type != ValueTClosure && f.Type != ValueTCFunction {
-		panic("assert")
+// Return error when f is not callable or the c function failed,
+// stack frames pushed by the c function are unwound.
+func (s *State) CallFunction(f int, argCount int, expectResult int) (isClosure bool, err error) {
+	// Set stack top when argCount is fixed, otherwise the args are
+	// the values up to the stack top above 'f'
+	if argCount != ExpValueCountAny {
+		s.stack.Top = f + 1 + argCount
+	} else if s.stack.Top <= f {
+		return false, NewCallCFuncError("no open values to call with")
 	}
 
-	// Set stack top when argCount is fixed
-	if argCount != ExpValueCountAny {
-		s.stack.Top = vPointerAdd(f, 1+argCount)
+	if v := s.stack.Get(f); v.Type() != ValueTClosure && v.Type() != ValueTCFunction {
+		if !s.prepareCallMetaMethod(f) {
+			return false, NewCallCFuncError("attempt to call a ", v.TypeName(), " value")
+		}
 	}
 
-	if f.Type == ValueTClosure {
+	if s.stack.Get(f).Type() == ValueTClosure {
 		// We need enter next ExecuteFrame
 		s.callClosure(f, expectResult)
 		return true, nil
 	} else {
+		depth := s.calls.Len()
+		defer func() {
+			if r := recover(); r != nil {
+				err = s.recoverError(r)
+				s.unwind(depth)
+			}
+		}()
 		s.callCFunction(f, expectResult)
 		return false, nil
 	}
 }
 
+// Create a coroutine which runs function 'f' when it is resumed first time
+func (s *State) NewCoroutine(f Value) *Thread {
+	co := s.NewThread()
+	co.stack.Push(f)
+	return co
+}
+
+// Resume the suspended coroutine 'co' with 'args', return values yielded by
+// the coroutine or returned by its function. Return error when the coroutine
+// can not be resumed or any error occurred in it, and the coroutine is dead
+// after error occurred in it.
+func (s *State) Resume(co *Thread, args []Value) ([]Value, error) {
+	if co.status == ThreadStatusDead {
+		return nil, NewCallCFuncError("cannot resume dead coroutine")
+	}
+	if co.status != ThreadStatusSuspended {
+		return nil, NewCallCFuncError("cannot resume non-suspended coroutine")
+	}
+
+	prev := s.thread
+	prev.status = ThreadStatusNormal
+	co.status = ThreadStatusRunning
+	s.switchThread(co)
+	defer func() {
+		s.switchThread(prev)
+		prev.status = ThreadStatusRunning
+	}()
+
+	yielded, err := s.runCoroutine(co, args)
+	if err != nil {
+		co.status = ThreadStatusDead
+		co.calls.Init()
+		if isInterruptError(err) {
+			panic(err)
+		}
+		return nil, err
+	}
+
+	var results []Value
+	if yielded {
+		co.status = ThreadStatusSuspended
+		results, co.transfer = co.transfer, nil
+	} else {
+		// Function of coroutine returned, results are placed from the bottom of stack
+		co.status = ThreadStatusDead
+		for i := 0; i < co.stack.Top; i++ {
+			results = append(results, *co.stack.Get(i))
+		}
+		co.stack.SetNewTop(0)
+	}
+	return results, nil
+}
+
+// Start or continue the coroutine 'co' which is current running thread,
+// return true when the coroutine yielded, or false when it returned.
+// Errors are caught by the innermost yieldable protected call which
+// was interrupted by yield, then the coroutine continues from it.
+func (s *State) runCoroutine(co *Thread, args []Value) (bool, error) {
+	yielded, err := s.runUntilYield(func() { s.startCoroutine(co, args) })
+	for err != nil {
+		call := s.findProtectedCall()
+		if call == nil || isInterruptError(err) {
+			return false, err
+		}
+
+		s.recoverProtectedCall(call.protected, err)
+		yielded, err = s.runUntilYield(func() {
+			s.continueCFunction(call)
+			s.executeCoroutine()
+		})
+	}
+	return yielded, nil
+}
+
+// Run 'f' until it returned or the coroutine yielded, return true when
+// the coroutine yielded, return the error when any error occurred
+func (s *State) runUntilYield(f func()) (yielded bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(yieldSignal); ok {
+				yielded = true
+				return
+			}
+			err = s.recoverError(r)
+		}
+	}()
+
+	f()
+	return false, nil
+}
+
+// Start or continue the coroutine 'co', then execute it until its
+// function returned
+func (s *State) startCoroutine(co *Thread, args []Value) {
+	s.checkStack(s.stack.Top, len(args))
+	for _, arg := range args {
+		s.stack.Push(arg)
+	}
+
+	if co.calls.Len() == 0 {
+		// Start the coroutine, function is at the bottom of stack
+		if _, err := s.CallFunction(0, len(args), ExpValueCountAny); err != nil {
+			panic(err)
+		}
+	} else {
+		// Continue from yield, args are results of the yielded c function,
+		// or pushed for the continuation of the c function
+		call := co.calls.Back().Value.(*CallInfo)
+		if call.Continuation == nil {
+			s.postCallCFunction(call.Func, call.ExpectResult, len(args))
+		} else {
+			s.continueCFunction(call)
+		}
+	}
+	s.executeCoroutine()
+}
+
+// Execute the running coroutine until its function returned
+func (s *State) executeCoroutine() {
+	vm := NewVM(s)
+	for {
+		vm.executeUntil(0)
+		if s.calls.Len() == 0 {
+			return
+		}
+
+		// Function called by CallK returned to the c function
+		s.continueCFunction(s.calls.Back().Value.(*CallInfo))
+	}
+}
+
+// Find the innermost call which is in a yieldable protected call,
+// return nil when there is no one
+func (s *State) findProtectedCall() *CallInfo {
+	for e := s.calls.Back(); e != nil; e = e.Prev() {
+		if call := e.Value.(*CallInfo); call.protected != nil {
+			return call
+		}
+	}
+	return nil
+}
+
+// Call the continuation of the c function of 'call' which is the current
+// call, then return results of the continuation to its caller
+func (s *State) continueCFunction(call *CallInfo) {
+	k, ctx := call.Continuation, call.Context
+	if k == nil {
+		panic("assert")
+	}
+	call.Continuation = nil
+	call.Context = nil
+	call.protected = nil
+
+	resCount := k(s, ctx)
+	if err := s.checkCFunctionError(); err != nil {
+		panic(err)
+	}
+	s.postCallCFunction(call.Func, call.ExpectResult, resCount)
+}
+
+// Signal of yield, it is panicked by Yield and recovered by Resume
+type yieldSignal struct{}
+
+// Yield current running coroutine with 'values' to its resumer, it must be
+// called by c function which called by closure directly. The call of c
+// function is not returned, and when the coroutine is resumed, the
+// arguments of resume are the results of the c function.
+func (s *State) Yield(values []Value) {
+	s.yield(values, nil, nil)
+}
+
+// Yield current running coroutine like Yield, and the c function which
+// calls YieldK is continued by 'k' with 'ctx' when the coroutine resumed,
+// arguments of resume are pushed on the top of stack for 'k'.
+func (s *State) YieldK(values []Value, ctx interface{}, k CFunctionKType) {
+	s.yield(values, ctx, k)
+}
+
+func (s *State) yield(values []Value, ctx interface{}, k CFunctionKType) {
+	if s.thread.isMain {
+		panic(NewCallCFuncError("attempt to yield from outside a coroutine"))
+	}
+	if !s.thread.IsYieldable() {
+		panic(NewCallCFuncError("attempt to yield across a C-call boundary"))
+	}
+
+	call := s.GetCurrentCall()
+	call.Continuation = k
+	call.Context = ctx
+	s.thread.transfer = values
+	panic(yieldSignal{})
+}
+
+// Switch current running thread to 't'
+func (s *State) switchThread(t *Thread) {
+	// Stack of thread is changed without barrier, so barrier it
+	// when it stops running
+	if s.thread != nil {
+		s.thread.barrier(s.thread)
+	}
+	s.thread = t
+	s.stack = t.stack
+	s.calls = t.calls
+}
+
+// Get current running thread
+func (s *State) GetCurrentThread() *Thread {
+	return s.thread
+}
+
+// Replace the non-function value 'f' by its __call metamethod, 'f' and
+// all values above it are shifted up by one, so 'f' is the first argument.
+// Return false when 'f' has no callable __call metamethod.
+func (s *State) prepareCallMetaMethod(f int) bool {
+	metaMethod := s.GetMetaMethod(s.stack.Get(f), "__call")
+	if metaMethod.Type() != ValueTClosure && metaMethod.Type() != ValueTCFunction {
+		return false
+	}
+
+	s.checkStack(s.stack.Top, 1)
+	for top := s.stack.Top; top != f; top-- {
+		*s.stack.Get(top) = *s.stack.Get(top - 1)
+	}
+	*s.stack.Get(f) = metaMethod
+	s.stack.Top++
+	return true
+}
+
+// Call an in stack function and execute it until it returns, results are
+// placed from the position of 'f'. Errors are not caught, they are passed
+// to the caller, e.g. the ProtectedCall which is below this call.
+func (s *State) Call(f int, argCount, expectResult int) {
+	thread := s.thread
+	thread.nonYieldable++
+	defer func() { thread.nonYieldable-- }()
+
+	depth := s.calls.Len()
+	isClosure, err := s.CallFunction(f, argCount, expectResult)
+	if err != nil {
+		panic(err)
+	}
+	if isClosure {
+		vm := NewVM(s)
+		vm.executeUntil(depth)
+	}
+}
+
+// Call an in stack function like Call, but the called function can yield
+// the current coroutine. When it yielded, the c function which calls CallK
+// is continued by 'k' with 'ctx' after the called function returned in the
+// resumed coroutine, and results of the call are on the top of stack.
+func (s *State) CallK(f int, argCount, expectResult int, ctx interface{}, k CFunctionKType) {
+	call := s.GetCurrentCall()
+	call.Continuation = k
+	call.Context = ctx
+	defer func() {
+		// Keep 'k' for the coroutine resumed only when the function yielded
+		if r := recover(); r != nil {
+			if _, ok := r.(yieldSignal); !ok {
+				call.Continuation = nil
+				call.Context = nil
+			}
+			panic(r)
+		}
+	}()
+
+	depth := s.calls.Len()
+	isClosure, err := s.CallFunction(f, argCount, expectResult)
+	if err != nil {
+		panic(err)
+	}
+	if isClosure {
+		vm := NewVM(s)
+		vm.executeUntil(depth)
+	}
+
+	call.Continuation = nil
+	call.Context = nil
+}
+
+// Call an in stack function in protected mode, 'handler' is the error
+// handler which can be nil. When any error occurred in the call, all stack
+// frames above the protected call are unwound, the error value (or the result
+// of 'handler' called with the error value) is placed at the position of 'f'
+// as the only result, and the error is returned. Interrupt error is not
+// caught, it is panicked again.
+func (s *State) ProtectedCall(f int, argCount, expectResult int, handler *Value) error {
+	thread := s.thread
+	thread.nonYieldable++
+	defer func() { thread.nonYieldable-- }()
+
+	return s.protectedCall(newProtectedCall(f, s.calls.Len(), handler), argCount, expectResult)
+}
+
+// Call an in stack function in protected mode like ProtectedCall, but the
+// called function can yield the current coroutine. When it yielded, the c
+// function which calls ProtectedCallK is continued by 'k' with 'ctx' after
+// the called function returned or failed in the resumed coroutine, and
+// results of the call or the error value are on the top of stack.
+func (s *State) ProtectedCallK(f int, argCount, expectResult int, handler *Value,
+	ctx interface{}, k CFunctionPKType) error {
+	pc := newProtectedCall(f, s.calls.Len(), handler)
+	call := s.GetCurrentCall()
+	call.protected = pc
+	call.Continuation = func(state *State, ctx interface{}) int { return k(state, pc.err, ctx) }
+	call.Context = ctx
+	defer func() {
+		// Keep 'k' for the coroutine resumed only when the function yielded
+		if r := recover(); r != nil {
+			if _, ok := r.(yieldSignal); !ok {
+				call.protected = nil
+				call.Continuation = nil
+				call.Context = nil
+			}
+			panic(r)
+		}
+	}()
+
+	err := s.protectedCall(pc, argCount, expectResult)
+	call.protected = nil
+	call.Continuation = nil
+	call.Context = nil
+	return err
+}
+
+// Protected call of c function
+type protectedCall struct {
+	f       int   // Index of the called function in stack
+	depth   int   // Count of calls when the protected call started
+	handler Value // Error handler, nil when it is not set
+	err     error // Error caught by the protected call
+}
+
+func newProtectedCall(f, depth int, handler *Value) *protectedCall {
+	pc := &protectedCall{f: f, depth: depth}
+	if handler != nil {
+		pc.handler = *handler
+	}
+	return pc
+}
+
+// Call the function of 'pc' in protected mode, see ProtectedCall
+func (s *State) protectedCall(pc *protectedCall, argCount, expectResult int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recoverError(r)
+			if isInterruptError(err) {
+				panic(err)
+			}
+			s.recoverProtectedCall(pc, err)
+		}
+	}()
+
+	isClosure, err := s.CallFunction(pc.f, argCount, expectResult)
+	if err != nil {
+		panic(err)
+	}
+	if isClosure {
+		vm := NewVM(s)
+		vm.executeUntil(pc.depth)
+	}
+	return nil
+}
+
+// Recover from error 'err' caught by protected call 'pc', all stack frames
+// above the protected call are unwound, and the error value (or the result
+// of error handler) is placed at the position of the called function
+func (s *State) recoverProtectedCall(pc *protectedCall, err error) {
+	errValue := s.ErrorToValue(err)
+	if !pc.handler.IsNil() {
+		errValue = s.callErrorHandler(&pc.handler, errValue)
+	}
+
+	s.unwind(pc.depth)
+	*s.stack.Get(pc.f) = errValue
+	s.stack.SetNewTop(pc.f + 1)
+	pc.err = err
+}
+
+// Run 'f' in protected mode, return the error when any error occurred,
+// and stack frames and stack top are restored.
+func (s *State) runProtected(f func()) (err error) {
+	depth := s.calls.Len()
+	top := s.stack.Top
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recoverError(r)
+			s.unwind(depth)
+			s.stack.SetNewTop(top)
+		}
+	}()
+
+	f()
+	return nil
+}
+
+// Get the error from the recovered value, only errors reported by vm can
+// be recovered, others will be panicked again
+func (s *State) recoverError(r interface{}) error {
+	err, ok := r.(error)
+	if _, isRuntime := r.(runtime.Error); !ok || isRuntime {
+		panic(r)
+	}
+	return err
+}
+
+// Unwind stack frames to 'depth', then State can be used continually
+func (s *State) unwind(depth int) {
+	for s.calls.Len() > depth {
+		s.calls.Remove(s.calls.Back())
+	}
+	s.ClearCFunctionError()
+}
+
+// Throw error value with stack traceback of current calls,
+// the error can be caught by ProtectedCall
+func (s *State) ThrowError(value Value) {
+	panic(ScriptError{value: value, Traceback: s.GetTraceback(0)})
+}
+
+// Convert error to Value which can be used by script
+func (s *State) ErrorToValue(err error) Value {
+	if e, ok := err.(ScriptError); ok {
+		return e.GetValue()
+	}
+	return NewValueString(s.GetString(err.Error()))
+}
+
+// Call error handler with the error value, return the result of handler,
+// return the error value of handler when the handler failed
+func (s *State) callErrorHandler(handler *Value, errValue Value) Value {
+	f := s.stack.Top
+	s.checkStack(f, 2)
+	s.stack.Push(*handler)
+	s.stack.Push(errValue)
+	s.ProtectedCall(f, 1, 1, nil)
+	return *s.stack.Get(f)
+}
+
+// Get module name and line of the current instruction of the closure call
+// which is 'level' levels below the current call, level 0 is the current call.
+// Return false when the call is not existed or it is a c function call.
+func (s *State) GetCallPos(level int) (string, int, bool) {
+	e := s.calls.Back()
+	for ; e != nil && level > 0; level-- {
+		e = e.Prev()
+	}
+	if e == nil {
+		return "", 0, false
+	}
+
+	call := e.Value.(*CallInfo)
+	if s.getCallFunc(call).Type() != ValueTClosure {
+		return "", 0, false
+	}
+	module, line := s.getCallInstructionPos(call)
+	return module, line, true
+}
+
+// Get stack traceback from the call which is 'level' levels below the
+// current call, level 0 is the current call.
+func (s *State) GetTraceback(level int) []TraceFrame {
+	e := s.calls.Back()
+	for ; e != nil && level > 0; level-- {
+		e = e.Prev()
+	}
+
+	var frames []TraceFrame
+	for ; e != nil; e = e.Prev() {
+		call := e.Value.(*CallInfo)
+		f := s.getCallFunc(call)
+		if f.Type() != ValueTClosure {
+			frames = append(frames, TraceFrame{IsGoFunction: true})
+			continue
+		}
+
+		proto := f.Closure().GetPrototype()
+		module, line := s.getCallInstructionPos(call)
+		frames = append(frames, TraceFrame{
+			IsMainChunk: proto.GetSuperior() == nil,
+			Module:      module,
+			Line:        line,
+			FuncLine:    proto.GetLine(),
+		})
+	}
+	return frames
+}
+
+// Get module name and line of the current instruction of closure call
+func (s *State) getCallInstructionPos(call *CallInfo) (string, int) {
+	proto := s.getCallFunc(call).Closure().GetPrototype()
+	index := call.Instruction
+	if index > 0 {
+		index--
+	}
+	return proto.GetModule().GetCStr(), proto.GetInstructionLine(index)
+}
+
+// Get function value of the call in current stack
+func (s *State) getCallFunc(call *CallInfo) *Value {
+	return s.stack.Get(call.Func)
+}
+
 // New GCObjects
 func (s *State) GetString(str string) *String {
 	str2 := s.stringPool.GetString(str)
@@ -289,6 +1053,8 @@ func (s *State) GetString(str string) *String {
 		str2 = s.gc.NewString(GCGen0)
 		str2.SetValue(str)
 		s.stringPool.AddString(str2)
+	} else {
+		s.gc.reviveString(str2)
 	}
 	return str2
 }
@@ -323,6 +1089,18 @@ func (s *State) NewUserData() *UserData {
 	return s.gc.NewUserData(GCGen0)
 }
 
+// New user data which holds Go value 'value' with metaTable 'metaTable'
+func (s *State) NewUserDataValue(value interface{}, metaTable *Table) *UserData {
+	userData := s.gc.NewUserData(GCGen0)
+	userData.SetValue(value, metaTable)
+	return userData
+}
+
+// New GCObjects
+func (s *State) NewThread() *Thread {
+	return s.gc.NewThread(GCGen0)
+}
+
 // Get current CallInfo
 func (s *State) GetCurrentCall() *CallInfo {
 	if s.calls.Len() == 0 {
@@ -343,16 +1121,37 @@ func (s *State) GetMetaTable(metaTableName string) *Table {
 	metaTable := metaTables.GetValue(k)
 
 	// Create table when metaTable not existed
-	if metaTable.Type == ValueTNil {
-		metaTable.Type = ValueTTable
-		metaTable.Table = s.NewTable()
+	if metaTable.Type() == ValueTNil {
+		metaTable = NewValueTable(s.NewTable())
 		metaTables.SetValue(k, metaTable)
 	}
 
-	if metaTable.Type != ValueTTable {
+	if metaTable.Type() != ValueTTable {
 		panic("assert")
 	}
-	return metaTable.Table
+	return metaTable.Table()
+}
+
+// Get metaTable of the value, return nil when the value has no metaTable
+func (s *State) GetValueMetaTable(v *Value) *Table {
+	switch v.Type() {
+	case ValueTTable:
+		return v.Table().GetMetaTable()
+	case ValueTUserData:
+		return v.UserData().GetMetaTable()
+	default:
+		return nil
+	}
+}
+
+// Get metamethod of the value by name, e.g. "__index",
+// return nil value when the metamethod is not existed
+func (s *State) GetMetaMethod(v *Value, name string) Value {
+	metaTable := s.GetValueMetaTable(v)
+	if metaTable == nil {
+		return Value{}
+	}
+	return metaTable.GetValue(NewValueString(s.GetString(name)))
 }
 
 // Erase metaTable
@@ -381,4 +1180,103 @@ func (s *State) GetGC() *GC {
 // Check and run GC
 func (s *State) CheckRunGC() {
 	s.gc.CheckGC()
+	s.runFinalizers()
+}
+
+// Run a full GC, then call finalizers of unreachable user data
+func (s *State) FullGC() {
+	s.gc.FullGC()
+	s.runFinalizers()
+}
+
+// Run a GC step, then call finalizers of unreachable user data, return
+// true when the collection is finished
+func (s *State) StepGC() bool {
+	finished := s.gc.Step()
+	s.runFinalizers()
+	return finished
+}
+
+// Close the state, call __gc metamethods of all user data which are
+// not finalized, then delete all GC objects and call destroyers of
+// user data, the state can not be used after closing
+func (s *State) Close() {
+	s.gc.separateAllFinalizeObjects()
+	s.runFinalizers()
+	s.gc.destroyAll()
+}
+
+// Check the unreachable user data need finalization or not, __gc
+// metamethod of user data is called once at most, destroyer of user
+// data is called when it is swept, so it is not finalization
+func (s *State) needFinalize(userData *UserData) bool {
+	if userData.finalized || userData.destroyed {
+		return false
+	}
+	v := NewValueUserData(userData)
+	metaMethod := s.GetMetaMethod(&v, "__gc")
+	return !metaMethod.IsNil()
+}
+
+// Get weak mode of table by __mode field of its metaTable, keys are
+// weak when it contains 'k', and values are weak when it contains 'v'
+func (s *State) getWeakMode(t *Table) (weakKey, weakValue bool) {
+	// Look up the pool without allocating, no table has "__mode"
+	// key when it is not in the pool
+	name := s.stringPool.GetString("__mode")
+	if name == nil {
+		return false, false
+	}
+
+	mode := t.GetMetaTable().GetValue(NewValueString(name))
+	if mode.Type() != ValueTString {
+		return false, false
+	}
+	str := mode.Str().GetStdString()
+	return strings.ContainsRune(str, 'k'), strings.ContainsRune(str, 'v')
+}
+
+// Call __gc metamethod of all unreachable user data which wait for
+// finalization, errors of __gc metamethod are ignored. The user data
+// may be resurrected by __gc metamethod, it is destroyed when it is
+// unreachable and swept again
+func (s *State) runFinalizers() {
+	if s.finalizing {
+		return
+	}
+	s.finalizing = true
+	defer func() { s.finalizing = false }()
+
+	for userData := s.gc.PopFinalizeObject(); userData != nil; userData = s.gc.PopFinalizeObject() {
+		userData.finalized = true
+
+		v := NewValueUserData(userData)
+		metaMethod := s.GetMetaMethod(&v, "__gc")
+		if metaMethod.Type() == ValueTClosure || metaMethod.Type() == ValueTCFunction {
+			top := s.stack.Top
+			f := s.getFreeTop()
+			s.checkStack(f, 2)
+			*s.stack.Get(f) = metaMethod
+			*s.stack.Get(f + 1) = v
+			s.ProtectedCall(f, 1, 0, nil)
+			s.stack.SetNewTop(f)
+			s.stack.Top = top
+		}
+	}
+}
+
+// Get the stack position above all values in use, registers of
+// the current closure may be above the stack top
+func (s *State) getFreeTop() int {
+	top := s.stack.Top
+	if s.calls.Len() != 0 {
+		call := s.calls.Back().Value.(*CallInfo)
+		if s.getCallFunc(call).Type() == ValueTClosure {
+			registerEnd := call.Register + frameRegisterCount
+			if registerEnd > top {
+				top = registerEnd
+			}
+		}
+	}
+	return top
 }
@@ -94,6 +94,6 @@ func (s *String) IsLess(s1 String) bool {
 	if s_ == s1_ {
 		return s.length < s1.length
 	} else {
-		return s1_ < s_
+		return s_ < s1_
 	}
 }
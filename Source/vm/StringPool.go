@@ -1,31 +1,27 @@
 package vm
 
 type StringPool struct {
-	temp    String
-	strings map[*String]bool // as set[*String]
+	strings map[string]*String // as set[*String] indexed by content
 }
 
 func NewStringPool() *StringPool {
-	return &StringPool{temp: *NewString(""), strings: make(map[*String]bool)}
+	return &StringPool{strings: make(map[string]*String)}
 }
 
 // Get string from pool when string is existed,
 // otherwise return nil
 func (s *StringPool) GetString(str string) *String {
-	s.temp.SetValue(str)
-	if _, ok := s.strings[&s.temp]; ok {
-		return &s.temp
-	} else {
-		return nil
-	}
+	return s.strings[str]
 }
 
 // Add string to pool
 func (s *StringPool) AddString(str *String) {
-	s.strings[str] = true
+	s.strings[str.GetStdString()] = str
 }
 
 // Delete string from pool
 func (s *StringPool) DeleteString(str *String) {
-	delete(s.strings, str)
+	if s.strings[str.GetStdString()] == str {
+		delete(s.strings, str.GetStdString())
+	}
 }
@@ -55,6 +55,7 @@ type ReturnStatement struct {
 	ExpList       SyntaxTree
 	Line          int
 	ExpValueCount int
+	TailCall      bool // Return a function call, e.g. 'return f(args)'
 }
 
 func NewReturnStatement(line int) *ReturnStatement {
@@ -1,24 +1,18 @@
 package vm
 
-import "math"
-
-func isInt(x float64) bool {
-	return math.Floor(x) == x
-}
-
 // Table has array part and hash table part.
 type Table struct {
 	gcObjectField
-	array *array // array part of table
-	hash  hash   // hash table of table
+	array     *array // array part of table
+	hash      hash   // hash table of table
+	metaTable *Table // metaTable of table
 }
 
 func NewTable() *Table {
-	return &Table{hash: make(hash)}
+	return &Table{}
 }
 
 type array []Value
-type hash map[string]Value // as map[Value]Value
 
 // Combine AppendToArray and MergeFromHashToArray
 func (t *Table) appendAndMergeFromHashToArray(value Value) {
@@ -39,28 +33,24 @@ func (t *Table) appendToArray(value Value) {
 func (t *Table) mergeFromHashToArray() {
 	index := t.ArraySize()
 	index++
-	key := Value{Num: float64(index), Type: ValueTNumber}
+	key := NewValueInt(int64(index))
 
 	for t.moveHashToArray(key) {
 		index++
-		key.Num = float64(index)
+		key.SetInt(int64(index))
 	}
 }
 
 // Move hash table key-value pair to array which key is number and key
 // fit with array, return true if move success.
 func (t *Table) moveHashToArray(key Value) bool {
-	if t.hash == nil {
-		return false
-	}
-
-	value, ok := (t.hash)[EnValue(key)]
-	if !ok {
+	value := t.hash.get(key)
+	if value.IsNil() {
 		return false
 	}
 
 	t.appendToArray(value)
-	delete(t.hash, EnValue(value))
+	t.hash.set(key, Value{})
 	return true
 }
 
@@ -74,16 +64,28 @@ func (t *Table) Accept(v GCObjectVisitor) {
 		}
 
 		// Visit all keys and values in hash table.
-		if t.hash != nil {
-			for key, value := range t.hash {
-				t := DeValue(key)
-				t.Accept(v)
-				value.Accept(v)
-			}
+		for i := t.hash.nextNode(0); i >= 0; i = t.hash.nextNode(i + 1) {
+			t.hash.nodes[i].key.Accept(v)
+			t.hash.nodes[i].value.Accept(v)
+		}
+
+		if t.metaTable != nil {
+			t.metaTable.Accept(v)
 		}
 	}
 }
 
+// Get metaTable of table, return nil when table has no metaTable
+func (t *Table) GetMetaTable() *Table {
+	return t.metaTable
+}
+
+// Set metaTable of table, nil to remove metaTable
+func (t *Table) SetMetaTable(metaTable *Table) {
+	t.metaTable = metaTable
+	t.barrier(t)
+}
+
 // Set array value by index, return true if success.
 // 'index' start from 1, if 'index' == ArraySize() + 1,
 // then append value to array.
@@ -103,6 +105,7 @@ func (t *Table) SetArrayValue(index int, value Value) bool {
 		(*t.array)[index-1] = value
 	}
 
+	t.barrier(t)
 	return true
 }
 
@@ -131,6 +134,7 @@ func (t *Table) InsertArrayValue(index int, value Value) bool {
 		t.mergeFromHashToArray()
 	}
 
+	t.barrier(t)
 	return true
 }
 
@@ -151,36 +155,15 @@ func (t *Table) EraseArrayValue(index int) bool {
 // otherwise insert into hash table.
 func (t *Table) SetValue(key, value Value) {
 	// Try array part
-	if key.Type == ValueTNumber && isInt(key.Num) {
-		if t.SetArrayValue(int(key.Num), value) {
+	if index, ok := key.ToInteger(); ok {
+		if t.SetArrayValue(int(index), value) {
 			return
 		}
 	}
 
-	// Hash part
-	if t.hash == nil {
-		// If value is nil and hash part is not existed, then do nothing
-		if value.IsNil() {
-			return
-		}
-		t.hash = make(hash)
-	}
-
-	v, ok := (t.hash)[EnValue(key)]
-	if ok {
-		// If value is nil, then just erase the element
-		if value.IsNil() {
-			delete(t.hash, EnValue(v))
-		} else {
-			(t.hash)[EnValue(key)] = value
-		}
-	} else {
-		// If key is not existed and value is not nil, then insert it
-		if !value.IsNil() {
-			(t.hash)[EnValue(key)] = value
-		}
-	}
-
+	// Hash part, nil and NaN keys are ignored
+	t.hash.set(key, value)
+	t.barrier(t)
 }
 
 // Get Value of key from array first,
@@ -189,83 +172,88 @@ func (t *Table) SetValue(key, value Value) {
 // Return value is 'nil' if 'key' is not existed.
 func (t *Table) GetValue(key Value) Value {
 	// Get from array first
-	if key.Type == ValueTNumber && isInt(key.Num) {
-		index := int(key.Num)
-		if index >= 1 && index <= t.ArraySize() {
+	if index, ok := key.ToInteger(); ok {
+		if index >= 1 && index <= int64(t.ArraySize()) {
 			return (*t.array)[index-1]
 		}
 	}
 
 	// Get from hash table
-	if t.hash != nil {
-		v, ok := (t.hash)[EnValue(key)]
-		if ok {
-			return v
-		}
-	}
-
-	// key not exist
-	return Value{}
+	return t.hash.get(key)
 }
 
 // Get first key-value pair of table, return true if table is not empty.
 func (t *Table) FirstKeyValue(key, value *Value) bool {
-	// array part
-	if t.ArraySize() > 0 {
-		key.Num = 1 // first element index
-		key.Type = ValueTNumber
-		*value = (*t.array)[0]
-		return true
-	}
+	return t.keyValueFrom(0, key, value)
+}
 
-	// hash part
-	if t.hash != nil && len(t.hash) == 0 {
-		for k, v := range t.hash {
-			*key = DeValue(k)
-			*value = v
-			return true
+// Get the next key-value pair by current 'key', return false if there
+// is no key-value pair any more.
+func (t *Table) NextKeyValue(key, nextKey, nextValue *Value) bool {
+	position := t.positionAfter(key)
+	return position >= 0 && t.keyValueFrom(position, nextKey, nextValue)
+}
+
+// Get the key-value pair after 'key' for iteration, nil 'key' gets the
+// first pair, and 'nextKey' is set to nil when there is no pair any more.
+// Keys are iterated in the array part by index and then in the hash part
+// by insertion order. Changing or removing values of existing keys does
+// not affect the iteration, so the key is a resumable cursor.
+// Return false when 'key' is not existed in table.
+func (t *Table) Next(key Value, nextKey, nextValue *Value) bool {
+	position := 0
+	if !key.IsNil() {
+		if position = t.positionAfter(&key); position < 0 {
+			return false
 		}
 	}
 
-	return false
+	if !t.keyValueFrom(position, nextKey, nextValue) {
+		nextKey.SetNil()
+		nextValue.SetNil()
+	}
+	return true
 }
 
-// Get the next key-value pair by current 'key', return false if there
-// is no key-value pair any more.
-func (t *Table) NextKeyValue(key, nextKey, nextValue *Value) bool {
+// Get the position after 'key' for iteration, return -1 when 'key' is
+// not existed in table.
+func (t *Table) positionAfter(key *Value) int {
 	// array part
-	if key.Type == ValueTNumber && isInt(key.Num) {
-		index := int(key.Num) + 1
-		if index >= 1 && index <= t.ArraySize() {
-			nextValue.Num = float64(index)
-			nextValue.Type = ValueTNumber
-			*nextValue = (*t.array)[index-1]
-			return true
+	if index, ok := key.ToInteger(); ok {
+		if index >= 1 && index <= int64(t.ArraySize()) {
+			return int(index)
 		}
 	}
 
 	// hash part
-	v, ok := (t.hash)[EnValue(*key)]
-	if ok {
-		isV := false
-		for nk, nv := range t.hash {
-			if nv.IsEqual(&v) {
-				isV = true
-			}
-			if isV == true {
-				*nextKey = DeValue(nk)
-				*nextValue = nv
-				return true
-			}
+	if key, ok := normalizeKey(*key); ok {
+		if i := t.hash.find(key); i >= 0 {
+			return t.ArraySize() + i + 1
 		}
-	} else if !ok && len(t.hash) != 0 {
-		for k1, v1 := range t.hash {
-			*nextKey = DeValue(k1)
-			*nextValue = v1
+	}
+
+	return -1
+}
+
+// Get the first key-value pair which value is not nil from 'position',
+// positions of array part are [0, ArraySize()), and then are the nodes
+// of hash part.
+func (t *Table) keyValueFrom(position int, key, value *Value) bool {
+	arraySize := t.ArraySize()
+	for ; position < arraySize; position++ {
+		if v := (*t.array)[position]; !v.IsNil() {
+			key.SetInt(int64(position + 1))
+			*value = v
 			return true
 		}
 	}
 
+	if i := t.hash.nextNode(position - arraySize); i >= 0 {
+		*key = t.hash.nodes[i].key
+		*value = t.hash.nodes[i].value
+		return true
+	}
+
 	return false
 }
 
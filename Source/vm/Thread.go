@@ -0,0 +1,108 @@
+package vm
+
+import "container/list"
+
+// Status of thread
+const (
+	ThreadStatusSuspended = iota // Coroutine is not started or yielded
+	ThreadStatusRunning          // Thread is running
+	ThreadStatusNormal           // Thread resumed another coroutine
+	ThreadStatusDead             // Coroutine finished or stopped with an error
+)
+
+// Thread of execution, the main thread and each coroutine has
+// its own stack and stack frames.
+type Thread struct {
+	gcObjectField
+	stack        *Stack     // Stack data
+	calls        *list.List // Stack frames, and its element.value is CallInfo
+	status       int        // ThreadStatus
+	isMain       bool       // Whether the thread is main thread
+	nonYieldable int        // Count of nested Go calls which can not be yielded across
+	transfer     []Value    // Values transferred by yield
+}
+
+func NewThread() *Thread {
+	return &Thread{stack: NewStack(), calls: list.New(), status: ThreadStatusSuspended}
+}
+
+func (t *Thread) Accept(visitor GCObjectVisitor) {
+	if visitor.VisitThread(t) {
+		// Functions of calls are in the live parts of the stack too
+		t.liveStack(func(begin, end int) {
+			for index := begin; index < end; index++ {
+				t.stack.Get(index).Accept(visitor)
+			}
+		})
+
+		for index := range t.transfer {
+			t.transfer[index].Accept(visitor)
+		}
+	}
+}
+
+// Call 'visit' with the live parts [begin, end) of the stack in order. Values
+// below the first call and the stack top are live, each frame is live from
+// its function to the end of its registers, registers of closure above the
+// function of the next frame are not used until the next frame returns,
+// and c function uses the values below the next frame or the stack top.
+func (t *Thread) liveStack(visit func(begin, end int)) {
+	begin, end := 0, t.stack.Top
+	if t.calls.Len() != 0 {
+		end = t.calls.Front().Value.(*CallInfo).Func
+	}
+
+	for e := t.calls.Front(); e != nil; e = e.Next() {
+		call := e.Value.(*CallInfo)
+		closure := t.stack.Get(call.Func).Closure()
+		frameEnd := t.stack.Top
+		if closure != nil {
+			frameEnd = call.Register + closure.GetPrototype().RegisterCount()
+		}
+		if next := e.Next(); next != nil {
+			if nextFunc := next.Value.(*CallInfo).Func; closure == nil || nextFunc < frameEnd {
+				frameEnd = nextFunc
+			}
+		} else if t.stack.Top > frameEnd {
+			frameEnd = t.stack.Top
+		}
+
+		// Join the frame to the last part when they overlap
+		if call.Func > end {
+			visit(begin, end)
+			begin = call.Func
+		}
+		if frameEnd > end {
+			end = frameEnd
+		}
+	}
+	visit(begin, end)
+}
+
+// Clear values out of the live parts of the stack, so they do not keep
+// objects alive which are collected without marking them
+func (t *Thread) clearDeadStack() {
+	dead := 0
+	t.liveStack(func(begin, end int) {
+		for ; dead < begin; dead++ {
+			t.stack.Get(dead).SetNil()
+		}
+		dead = end
+	})
+	for ; dead < t.stack.Size(); dead++ {
+		t.stack.Get(dead).SetNil()
+	}
+}
+
+func (t *Thread) GetStatus() int {
+	return t.status
+}
+
+func (t *Thread) IsMain() bool {
+	return t.isMain
+}
+
+// Whether the running thread can yield
+func (t *Thread) IsYieldable() bool {
+	return !t.isMain && t.nonYieldable == 0
+}
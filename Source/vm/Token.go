@@ -35,6 +35,9 @@ const (
 	TokenGreaterEqual
 	TokenConcat
 	TokenVarArg
+	TokenIDiv
+	TokenShiftLeft
+	TokenShiftRight
 	TokenEOF
 )
 
@@ -44,12 +47,15 @@ var tokenStr = []string{
 	"local", "nil", "not", "or", "repeat",
 	"return", "then", "true", "until", "while",
 	"<id>", "<string>", "<number>",
-	"==", "~=", "<=", ">=", "..", "...", "<EOF>",
+	"==", "~=", "<=", ">=", "..", "...",
+	"//", "<<", ">>", "<EOF>",
 }
 
 type TokenDetail struct {
-	Number float64 // number for TokenNumber
-	Str    *String // string for TokenId, TokenKeyWord and TokenString
+	Number    float64 // number for TokenNumber of float
+	Integer   int64   // number for TokenNumber of integer
+	IsInteger bool    // whether TokenNumber is integer
+	Str       *String // string for TokenId, TokenKeyWord and TokenString
 
 	Module *String // module name of this token belongs to
 	Line   int     // token line number in module
@@ -65,7 +71,9 @@ func GetTokenStr(t TokenDetail) string {
 	var str string
 
 	token := t.Token
-	if token == TokenNumber {
+	if token == TokenNumber && t.IsInteger {
+		str = strconv.FormatInt(t.Integer, 10)
+	} else if token == TokenNumber {
 		str = strconv.FormatFloat(t.Number, 'f', 6, 64)
 	} else if (token == TokenId) || (token == TokenString) {
 		str = t.Str.GetStdString()
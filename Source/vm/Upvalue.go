@@ -17,8 +17,15 @@ func (u *Upvalue) Accept(v GCObjectVisitor) {
 
 func (u *Upvalue) SetValue(value *Value) {
 	u.value = *value
+	u.barrier(u)
 }
 
 func (u *Upvalue) GetValue() *Value {
 	return &u.value
 }
+
+// Get value pointer for changing the value
+func (u *Upvalue) GetMutableValue() *Value {
+	u.barrier(u)
+	return &u.value
+}
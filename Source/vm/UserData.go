@@ -1,14 +1,22 @@
 package vm
 
-import "unsafe"
+import (
+	"io"
+	"unsafe"
+)
 
+// Destroyer of user data, it is called once when the user data is
+// swept by GC or the state is closed. It is called during collection,
+// so it must not call into the state
 type Destroyer func(unsafe.Pointer)
 
 type UserData struct {
 	gcObjectField
 	userData  unsafe.Pointer // Point to user data
+	value     interface{}    // Go value of user data
 	metaTable *Table         // MetaTable of user data
 	destroyer Destroyer      // User data destroyer, call it when user data destroy
+	finalized bool           // Whether __gc metamethod of user data called
 	destroyed bool           // Whether user data destroyed
 }
 
@@ -17,7 +25,7 @@ func NewUserData() *UserData {
 }
 
 func (u *UserData) Accept(visitor GCObjectVisitor) {
-	if visitor.VisitUserData(u) {
+	if visitor.VisitUserData(u) && u.metaTable != nil {
 		u.metaTable.Accept(visitor)
 	}
 }
@@ -25,20 +33,55 @@ func (u *UserData) Accept(visitor GCObjectVisitor) {
 func (u *UserData) Set(userData unsafe.Pointer, metaTable *Table) {
 	u.userData = userData
 	u.metaTable = metaTable
+	u.barrier(u)
+}
+
+// Set Go value of user data and its metaTable, the value is closed
+// when user data destroyed if it is an io.Closer and no destroyer set
+func (u *UserData) SetValue(value interface{}, metaTable *Table) {
+	u.value = value
+	u.metaTable = metaTable
+	u.barrier(u)
 }
 
 func (u *UserData) SetDestroyer(destroyer Destroyer) {
 	u.destroyer = destroyer
 }
 
+// Mark user data destroyed when its resource released by user, then
+// destroyer is not called
 func (u *UserData) MarkDestroyed() {
 	u.destroyed = true
 }
 
+func (u *UserData) IsDestroyed() bool {
+	return u.destroyed
+}
+
 func (u *UserData) GetData() unsafe.Pointer {
 	return u.userData
 }
 
+// Get Go value of user data
+func (u *UserData) Value() interface{} {
+	return u.value
+}
+
 func (u *UserData) GetMetaTable() *Table {
 	return u.metaTable
 }
+
+// Call destroyer of user data, or close its Go value when it is an
+// io.Closer, it does nothing when user data destroyed already
+func (u *UserData) destroy() {
+	if u.destroyed {
+		return
+	}
+	u.destroyed = true
+
+	if u.destroyer != nil {
+		u.destroyer(u.userData)
+	} else if closer, ok := u.value.(io.Closer); ok {
+		closer.Close()
+	}
+}
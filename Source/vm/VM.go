@@ -3,34 +3,22 @@ package vm
 import (
 	"fmt"
 	"math"
-	"unsafe"
 )
 
-func numberToStr(num *Value) string {
-	if num.Type != ValueTNumber {
-		panic("assert")
-	}
-	if math.Floor(num.Num) == num.Num {
-		return fmt.Sprintf("%d", int64(num.Num))
-	} else {
-		return fmt.Sprintf("%G", num.Num)
-	}
-}
-
 func getConstValue(i Instruction, proto *Function) *Value {
 	return proto.GetConstValue(int(GetParamBx(i)))
 }
 
-func getRegisterA(i Instruction, call *CallInfo) *Value {
-	return vPointerAdd(call.Register, GetParamA(i))
+func getRegisterA(i Instruction, call *CallInfo, stack *Stack) *Value {
+	return stack.Get(call.Register + GetParamA(i))
 }
 
-func getRegisterB(i Instruction, call *CallInfo) *Value {
-	return vPointerAdd(call.Register, GetParamB(i))
+func getRegisterB(i Instruction, call *CallInfo, stack *Stack) *Value {
+	return stack.Get(call.Register + GetParamB(i))
 }
 
-func getRegisterC(i Instruction, call *CallInfo) *Value {
-	return vPointerAdd(call.Register, GetParamC(i))
+func getRegisterC(i Instruction, call *CallInfo, stack *Stack) *Value {
+	return stack.Get(call.Register + GetParamC(i))
 }
 
 func getUpvalueB(i Instruction, cl *Closure) *Upvalue {
@@ -38,8 +26,8 @@ func getUpvalueB(i Instruction, cl *Closure) *Upvalue {
 }
 
 func getRealValue(a *Value) *Value {
-	if a.Type == ValueTUpvalue {
-		return a.Upvalue.GetValue()
+	if a.Type() == ValueTUpvalue {
+		return a.Upvalue().GetMutableValue()
 	} else {
 		return a
 	}
@@ -50,17 +38,39 @@ func getCallInfoAndProto(vm *VM) (*CallInfo, *Function) {
 		panic("assert")
 	}
 	call := vm.state.calls.Back().Value.(*CallInfo)
-	if call.Func == nil && call.Func.Closure == nil {
+	f := vm.state.getCallFunc(call)
+	if f.Type() != ValueTClosure {
 		panic("assert")
 	}
-	proto := call.Func.Closure.GetPrototype()
+	proto := f.Closure().GetPrototype()
 	return call, proto
 }
 
-func getRegisterABC(i Instruction, call *CallInfo) (a, b, c *Value) {
-	return getRegisterA(i, call), getRegisterB(i, call), getRegisterC(i, call)
+func getRegisterABC(i Instruction, call *CallInfo, stack *Stack) (a, b, c *Value) {
+	return getRegisterA(i, call, stack), getRegisterB(i, call, stack), getRegisterC(i, call, stack)
 }
 
+// Get register or const value of RK operand
+func getRealRK(rk int, call *CallInfo, stack *Stack, proto *Function) *Value {
+	if IsRKConst(rk) {
+		return proto.GetConstValue(GetRKConstIndex(rk))
+	}
+	return getRealValue(stack.Get(call.Register + rk))
+}
+
+// Get register A and values of RK operand B and C of OpModeABCRK instruction
+func getRealRegisterARK(i Instruction, call *CallInfo, stack *Stack, proto *Function) (a, b, c *Value) {
+	return getRealValue(getRegisterA(i, call, stack)),
+		getRealRK(GetParamB(i), call, stack, proto), getRealRK(GetParamC(i), call, stack, proto)
+}
+
+// Register count of a frame, registers of any frame are
+// in [Register, Register + frameRegisterCount)
+const frameRegisterCount = 256
+
+// Max loop count of __index and __newindex metamethod chain
+const maxMetaLoop = 100
+
 type VM struct {
 	state *State
 }
@@ -71,47 +81,61 @@ func NewVM(state *State) VM {
 
 func (vm *VM) executeFrame() error {
 	call := vm.state.calls.Back().Value.(*CallInfo)
-	cl := call.Func.Closure
+	stack := vm.state.stack
+	cl := stack.Get(call.Func).Closure()
 	proto := cl.GetPrototype()
+	code := proto.GetOpCodes()
 	var a, b, c *Value
 
-	for uintptr(unsafe.Pointer(call.Instruction)) < uintptr(unsafe.Pointer(call.End)) {
+	for call.Instruction < call.End {
 		vm.state.CheckRunGC()
-		i := *call.Instruction
-		call.Instruction = iPointerAdd(call.Instruction, 1)
+		i := code[call.Instruction]
+		call.Instruction++
+		if cause := vm.state.checkContext(); cause != nil {
+			module, line := vm.getCurrentInstructionPos()
+			return NewInterruptError(module, line, cause)
+		}
+		if cause := vm.state.checkLimits(); cause != nil {
+			module, line := vm.getCurrentInstructionPos()
+			return NewLimitError(module, line, cause)
+		}
 
 		switch GetOpCode(i) {
 		case OpTypeLoadNil:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			getRealValue(a).SetNil()
 		case OpTypeFillNil:
-			a = getRegisterA(i, call)
-			b = getRegisterB(i, call)
-			for uintptr(unsafe.Pointer(a)) < uintptr(unsafe.Pointer(b)) {
-				a.SetNil()
-				a = vPointerAdd(a, 1)
+			for r := call.Register + GetParamA(i); r < call.Register+GetParamB(i); r++ {
+				stack.Get(r).SetNil()
 			}
 		case OpTypeLoadBool:
-			a = getRegisterA(i, call)
-			getRealValue(a).SetBool(GetParamB(i) == 0)
+			a = getRegisterA(i, call, stack)
+			getRealValue(a).SetBool(GetParamB(i) != 0)
 		case OpTypeLoadInt:
-			a = getRegisterA(i, call)
-			if uintptr(unsafe.Pointer(call.Instruction)) > uintptr(unsafe.Pointer(call.End)) {
+			a = getRegisterA(i, call, stack)
+			if call.Instruction >= call.End {
 				panic("assert")
 			}
-			a.Num = (float64)((*call.Instruction).OpCode)
-			a.Type = ValueTNumber
+			a.SetInt(int64(code[call.Instruction].OpCode))
+			call.Instruction++
 		case OpTypeLoadConst:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			b = getConstValue(i, proto)
 			*getRealValue(a) = *b
 		case OpTypeMove:
-			a = getRegisterA(i, call)
-			b = getRegisterB(i, call)
+			a = getRegisterA(i, call, stack)
+			b = getRegisterB(i, call, stack)
 			*getRealValue(a) = *getRealValue(b)
 		case OpTypeCall:
-			a = getRegisterA(i, call)
-			res, err := vm.call(a, i)
+			res, err := vm.call(call.Register+GetParamA(i), i)
+			if err != nil {
+				panic(err)
+			}
+			if res {
+				return nil
+			}
+		case OpTypeTailCall:
+			res, err := vm.tailCall(call.Register+GetParamA(i), i)
 			if err != nil {
 				panic(err)
 			}
@@ -119,208 +143,209 @@ func (vm *VM) executeFrame() error {
 				return nil
 			}
 		case OpTypeGetUpvalue:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			b = getUpvalueB(i, cl).GetValue()
 			*getRealValue(a) = *b
 		case OpTypeSetUpvalue:
-			a = getRegisterA(i, call)
-			b = getConstValue(i, proto)
-			*getRealValue(a) = vm.state.global.Table.GetValue(*b)
+			a = getRegisterA(i, call, stack)
+			b = getUpvalueB(i, cl).GetMutableValue()
+			*b = *getRealValue(a)
 		case OpTypeGetGlobal:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			b = getConstValue(i, proto)
-			*getRealValue(a) = vm.state.global.Table.GetValue(*b)
+			*getRealValue(a) = vm.state.global.Table().GetValue(*b)
 		case OpTypeSetGlobal:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			b = getConstValue(i, proto)
-			vm.state.global.Table.SetValue(*b, *a)
+			vm.state.global.Table().SetValue(*b, *getRealValue(a))
 		case OpTypeClosure:
-			a = getRegisterA(i, call)
-			b = getConstValue(i, proto)
-			vm.state.global.Table.SetValue(*b, *a)
+			a = getRegisterA(i, call, stack)
+			vm.generateClosure(getRealValue(a), i)
 		case OpTypeVarArg:
-			a = getRegisterA(i, call)
-			vm.copyVarArg(a, i)
+			vm.copyVarArg(call.Register+GetParamA(i), i)
 		case OpTypeRet:
-			a = getRegisterA(i, call)
-			vm.return_(a, i)
+			vm.return_(call.Register+GetParamA(i), i)
 			return nil
 		case OpTypeJmpFalse:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			if getRealValue(a).IsFalse() {
-				call.Instruction = iPointerAdd(call.Instruction, -1+int(GetParamBx(i)))
+				call.Instruction += -1 + int(GetParamsBx(i))
 			}
 		case OpTypeJmpTrue:
-			a = getRegisterA(i, call)
+			a = getRegisterA(i, call, stack)
 			if !getRealValue(a).IsFalse() {
-				call.Instruction = iPointerAdd(call.Instruction, -1+int(GetParamBx(i)))
+				call.Instruction += -1 + int(GetParamsBx(i))
 			}
 		case OpTypeJmpNil:
-			a = getRegisterA(i, call)
-			if a.Type == ValueTNil {
-				call.Instruction = iPointerAdd(call.Instruction, -1+int(GetParamBx(i)))
+			a = getRegisterA(i, call, stack)
+			if a.Type() == ValueTNil {
+				call.Instruction += -1 + int(GetParamsBx(i))
 			}
 		case OpTypeJmp:
-			call.Instruction = iPointerAdd(call.Instruction, -1+int(GetParamBx(i)))
+			call.Instruction += -1 + int(GetParamsBx(i))
 		case OpTypeNeg:
-			a = getRegisterA(i, call)
-			if err := vm.checkType(a, ValueTNumber, "neg"); err != nil {
-				panic(err)
+			a = getRealValue(getRegisterA(i, call, stack))
+			if a.IsInteger() {
+				a.SetInt(-a.Int())
+			} else if a.IsFloat() {
+				a.SetNum(-a.Num())
+			} else if !vm.callUnaryMetaMethod(a, "__unm") {
+				panic(vm.checkType(a, ValueTNumber, "neg"))
 			}
-			a.Num = -a.Num
 		case OpTypeNot:
-			a = getRegisterA(i, call)
+			a = getRealValue(getRegisterA(i, call, stack))
 			a.SetBool(a.IsFalse())
 		case OpTypeLen:
-			a = getRegisterA(i, call)
-			if a.Type == ValueTTable {
-				a.Num = float64(a.Table.ArraySize())
-			} else if a.Type == ValueTString {
-				a.Num = float64(a.Str.GetLength())
-			} else {
-				return vm.reportTypeError(a, "length of")
+			a = getRealValue(getRegisterA(i, call, stack))
+			if err := vm.len(a); err != nil {
+				panic(err)
 			}
-			a.Type = ValueTNumber
 		case OpTypeAdd:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkArithType(*b, *c, "add"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.arith(a, b, c, "__add", "add",
+				func(x, y int64) int64 { return x + y }, func(x, y float64) float64 { return x + y }); err != nil {
 				panic(err)
 			}
-			if a.Type == ValueTTable {
-				a.Num = float64(a.Table.ArraySize())
-				a.Type = ValueTNumber
-			}
 		case OpTypeSub:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkArithType(*b, *c, "sub"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.arith(a, b, c, "__sub", "sub",
+				func(x, y int64) int64 { return x - y }, func(x, y float64) float64 { return x - y }); err != nil {
 				panic(err)
 			}
-			a.Num = b.Num - c.Num
-			a.Type = ValueTNumber
 		case OpTypeMul:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkArithType(*b, *c, "multiply"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.arith(a, b, c, "__mul", "multiply",
+				func(x, y int64) int64 { return x * y }, func(x, y float64) float64 { return x * y }); err != nil {
 				panic(err)
 			}
-			a.Num = b.Num * c.Num
-			a.Type = ValueTNumber
 		case OpTypeDiv:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkArithType(*b, *c, "div"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.arith(a, b, c, "__div", "div", nil, func(x, y float64) float64 { return x / y }); err != nil {
 				panic(err)
 			}
-			a.Num = b.Num / c.Num
-			a.Type = ValueTNumber
 		case OpTypePow:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkArithType(*b, *c, "power"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.arith(a, b, c, "__pow", "power", nil, math.Pow); err != nil {
 				panic(err)
 			}
-			a.Num = math.Pow(b.Num, c.Num)
 		case OpTypeMod:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkArithType(*b, *c, "mod"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.checkDivisor(b, c, "n%0"); err != nil {
+				panic(err)
+			}
+			if err := vm.arith(a, b, c, "__mod", "mod", intMod, floatMod); err != nil {
+				panic(err)
+			}
+		case OpTypeIDiv:
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.checkDivisor(b, c, "n//0"); err != nil {
+				panic(err)
+			}
+			if err := vm.arith(a, b, c, "__idiv", "floor div", intFloorDiv, floatFloorDiv); err != nil {
+				panic(err)
+			}
+		case OpTypeBAnd:
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.bitwise(a, b, c, "__band", "bitwise and", func(x, y int64) int64 { return x & y }); err != nil {
+				panic(err)
+			}
+		case OpTypeBOr:
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.bitwise(a, b, c, "__bor", "bitwise or", func(x, y int64) int64 { return x | y }); err != nil {
+				panic(err)
+			}
+		case OpTypeBXor:
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.bitwise(a, b, c, "__bxor", "bitwise xor", func(x, y int64) int64 { return x ^ y }); err != nil {
 				panic(err)
 			}
-			a.Num = math.Mod(b.Num, c.Num)
-			a.Type = ValueTNumber
+		case OpTypeShl:
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.bitwise(a, b, c, "__shl", "shift left", shiftLeft); err != nil {
+				panic(err)
+			}
+		case OpTypeShr:
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.bitwise(a, b, c, "__shr", "shift right",
+				func(x, y int64) int64 { return shiftLeft(x, -y) }); err != nil {
+				panic(err)
+			}
+		case OpTypeBNot:
+			a = getRealValue(getRegisterA(i, call, stack))
+			if x, ok := a.ToInteger(); ok {
+				a.SetInt(^x)
+			} else if !vm.callUnaryMetaMethod(a, "__bnot") {
+				if a.IsNumber() {
+					pos1, pos2 := vm.getCurrentInstructionPos()
+					panic(NewRuntimeError1(pos1, pos2, "number has no integer representation"))
+				}
+				panic(vm.reportTypeError(a, "bitwise not"))
+			}
 		case OpTypeConcat:
-			a, b, c = getRegisterABC(i, call)
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
 			if err := vm.concat(a, b, c); err != nil {
 				panic(err)
 			}
 		case OpTypeLess:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkInequalityType(*b, *c, "compare(<)"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.less(a, b, c, "compare(<)"); err != nil {
 				panic(err)
 			}
-			if b.Type == ValueTNumber {
-				a.SetBool(b.Num < c.Num)
-			} else {
-				a.SetBool(b.Str.IsLess(*c.Str))
-			}
 		case OpTypeGreater:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkInequalityType(*b, *c, "compare(>)"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.less(a, c, b, "compare(>)"); err != nil {
 				panic(err)
 			}
-			if b.Type == ValueTNumber {
-				a.SetBool(b.Num > c.Num)
-			} else {
-				a.SetBool(c.Str.IsLess(*b.Str))
-			}
 		case OpTypeEqual:
-			a, b, c = getRegisterABC(i, call)
-			a.SetBool(b.IsEqual(c))
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			vm.equal(a, b, c, false)
 		case OpTypeUnEqual:
-			a, b, c = getRegisterABC(i, call)
-			a.SetBool(!b.IsEqual(c))
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			vm.equal(a, b, c, true)
 		case OpTypeLessEqual:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkInequalityType(*b, *c, "compare(<=)"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.lessEqual(a, b, c, "compare(<=)"); err != nil {
 				panic(err)
 			}
-			if b.Type == ValueTNumber {
-				a.SetBool(b.Num <= c.Num)
-			} else {
-				a.SetBool(b.Str.IsLess(*c.Str))
-			}
 		case OpTypeGreaterEqual:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkInequalityType(*b, *c, "compare(>=)"); err != nil {
+			a, b, c = getRealRegisterARK(i, call, stack, proto)
+			if err := vm.lessEqual(a, c, b, "compare(>=)"); err != nil {
 				panic(err)
 			}
-			if b.Type == ValueTNumber {
-				a.SetBool(b.Num >= c.Num)
-			} else {
-				a.SetBool(!b.Str.IsLess(*c.Str))
-			}
 		case OpTypeNewTable:
-			a = getRegisterA(i, call)
-			a.Table = vm.state.NewTable()
-			a.Type = ValueTTable
+			a = getRegisterA(i, call, stack)
+			*a = NewValueTable(vm.state.NewTable())
 		case OpTypeSetTable:
-			a, b, c = getRegisterABC(i, call)
-			if err := vm.checkTableType(*a, *b, "set", "to"); err != nil {
+			a, b, c = getRegisterABC(i, call, stack)
+			if err := vm.setTable(getRealValue(a), getRealValue(b), getRealValue(c)); err != nil {
 				panic(err)
 			}
-			if a.Type == ValueTTable {
-				a.Table.SetValue(*b, *c)
-			} else if a.Type == ValueTUserData {
-				a.UserDate.GetMetaTable().SetValue(*b, *c)
-			} else {
-				panic("assert")
-			}
 		case OpTypeGetTable:
-			a, b, c = getRegisterABC(i, call)
-			if a.Type == ValueTTable {
-				*c = a.Table.GetValue(*b)
-			} else if a.Type == ValueTUserData {
-				*c = a.UserDate.GetMetaTable().GetValue(*b)
-			} else {
-				panic("assert")
+			a, b, c = getRegisterABC(i, call, stack)
+			if err := vm.getTable(getRealValue(a), getRealValue(b), getRealValue(c)); err != nil {
+				panic(err)
 			}
 		case OpTypeForInit:
-			a, b, c = getRegisterABC(i, call)
+			a, b, c = getRegisterABC(i, call, stack)
 			if err := vm.forInit(a, b, c); err != nil {
 				panic(err)
 			}
 		case OpTypeForStep:
-			a, b, c = getRegisterABC(i, call)
-			i = *call.Instruction
-			call.Instruction = iPointerAdd(call.Instruction, 1)
-			if (c.Num > 0.0 && a.Num > b.Num) || (c.Num <= 0.0 && a.Num < b.Num) {
-				call.Instruction = iPointerAdd(call.Instruction, -1+int(GetParamBx(i)))
+			a, b, c = getRegisterABC(i, call, stack)
+			i = code[call.Instruction]
+			call.Instruction++
+			if (c.Num() > 0.0 && numberLess(b, a)) || (c.Num() <= 0.0 && numberLess(a, b)) {
+				call.Instruction += -1 + int(GetParamsBx(i))
 			}
 		}
 	}
 
 	newTop := call.Func
 	// Reset top value
-	vm.state.stack.SetNewTop(newTop)
+	stack.SetNewTop(newTop)
 	// Set expect results
 	if call.ExpectResult != ExpValueCountAny {
-		vm.state.stack.SetNewTop(vPointerAdd(newTop, call.ExpectResult))
+		stack.SetNewTop(newTop + call.ExpectResult)
 	}
 	// Pop current CallInfo, and return to last CallInfo
 	vm.state.calls.Remove(vm.state.calls.Back())
@@ -328,46 +353,259 @@ func (vm *VM) executeFrame() error {
 }
 
 // Execute next frame if return true
-func (vm *VM) call(a *Value, i Instruction) (bool, error) {
-	if a.Type != ValueTClosure && a.Type != ValueTCFunction {
-		panic(vm.reportTypeError(a, "call"))
-		return true, nil
+func (vm *VM) call(a int, i Instruction) (bool, error) {
+	if f := vm.state.stack.Get(a); f.Type() != ValueTClosure && f.Type() != ValueTCFunction {
+		// Callable table and user data are called by CallFunction
+		metaMethod := vm.state.GetMetaMethod(f, "__call")
+		if metaMethod.Type() != ValueTClosure && metaMethod.Type() != ValueTCFunction {
+			return false, vm.reportTypeError(f, "call")
+		}
 	}
 
 	argCount := GetParamB(i) - 1
 	expectResult := GetParamC(i) - 1
 	res, err := vm.state.CallFunction(a, argCount, expectResult)
-	if e, ok := err.(*CallCFuncError); ok {
-		// Calculate line number of the call
-		pos1, pos2 := vm.getCurrentInstructionPos()
-		return false, NewRuntimeError1(pos1, pos2, e.what)
+	if err != nil {
+		return false, vm.convertCallError(err)
 	}
 	return res, nil
 }
 
+// Reuse current CallInfo and register window to execute the callee when
+// it is a closure, so tail calls run in constant stack. Other callee is
+// called normally, and its results are returned by the next instruction.
+// Execute next frame if return true
+func (vm *VM) tailCall(a int, i Instruction) (bool, error) {
+	stack := vm.state.stack
+	if stack.Get(a).Type() != ValueTClosure {
+		// C of TailCall is 0, so all results are expected
+		return vm.call(a, i)
+	}
+
+	argCount := GetParamB(i) - 1
+	if argCount == ExpValueCountAny {
+		if stack.Top <= a {
+			module, line := vm.getCurrentInstructionPos()
+			return false, NewRuntimeError1(module, line, "no open values to call with")
+		}
+		argCount = stack.Top - a - 1
+	}
+
+	// Move callee and args to the position of current function, registers
+	// of current frame are overwritten or cleared above the new top, the
+	// upvalues held by registers are replaced rather than written
+	call := vm.state.calls.Back().Value.(*CallInfo)
+	stack.Top = a + 1 + argCount
+	for n := 0; n <= argCount; n++ {
+		*stack.Get(call.Func + n) = *stack.Get(a + n)
+	}
+	stack.SetNewTop(call.Func + 1 + argCount)
+
+	vm.state.setupClosureCall(call, call.Func, call.ExpectResult)
+	return true, nil
+}
+
+// Convert error reported by called c function to RuntimeError
+// with the position of current instruction
+func (vm *VM) convertCallError(err error) error {
+	if e, ok := err.(CallCFuncError); ok {
+		// Calculate line number of the call
+		module, line := vm.getCurrentInstructionPos()
+		return RuntimeError{Module: module, Line: line,
+			Kind: RuntimeErrorKindCFunction, Desc: e.Desc}
+	}
+	return err
+}
+
+// Call metamethod 'f' with args, then call 'finish' with the first result,
+// the call is placed above all registers of current frame. The metamethod
+// can yield the current coroutine, then 'finish' is called before the
+// current frame continues in the resumed coroutine.
+func (vm *VM) callMetaMethod(finish func(result Value), f *Value, args ...Value) {
+	call := vm.state.GetCurrentCall()
+	stack := vm.state.stack
+	base := call.Register + frameRegisterCount
+	top := stack.Top
+
+	vm.state.checkStack(base, 1+len(args))
+	*stack.Get(base) = *f
+	for i := range args {
+		*stack.Get(base + 1 + i) = args[i]
+	}
+
+	call.finishMeta = func() {
+		result := *stack.Get(base)
+		stack.SetNewTop(base)
+		stack.Top = top
+		finish(result)
+	}
+	defer func() {
+		// Keep 'finishMeta' for the coroutine resumed only when the
+		// metamethod yielded
+		if r := recover(); r != nil {
+			if _, ok := r.(yieldSignal); !ok {
+				call.finishMeta = nil
+			}
+			panic(r)
+		}
+	}()
+
+	depth := vm.state.calls.Len()
+	isClosure, err := vm.state.CallFunction(base, len(args), 1)
+	if err != nil {
+		panic(vm.convertCallError(err))
+	}
+	if isClosure {
+		vm.executeUntil(depth)
+	}
+	vm.finishMetaMethod(call)
+}
+
+// Finish the instruction of frame 'call' which called a metamethod
+func (vm *VM) finishMetaMethod(call *CallInfo) {
+	finish := call.finishMeta
+	call.finishMeta = nil
+	finish()
+}
+
+// Finish of metamethod which stores the result into 'dst'
+func storeResult(dst *Value) func(result Value) {
+	return func(result Value) { *dst = result }
+}
+
+// Get value of table by key into 'value', try the __index metamethod
+// when the key is not existed in table
+func (vm *VM) getTable(t, key, value *Value) error {
+	current := *t
+	for loop := 0; loop < maxMetaLoop; loop++ {
+		switch current.Type() {
+		case ValueTTable:
+			v := current.Table().GetValue(*key)
+			if !v.IsNil() {
+				*value = v
+				return nil
+			}
+		case ValueTUserData:
+			// Members of user data are stored in its metaTable
+			if metaTable := current.UserData().GetMetaTable(); metaTable != nil {
+				v := metaTable.GetValue(*key)
+				if !v.IsNil() {
+					*value = v
+					return nil
+				}
+			}
+		default:
+			return vm.indexError(loop, current, *key, "get", "from")
+		}
+
+		index := vm.state.GetMetaMethod(&current, "__index")
+		switch index.Type() {
+		case ValueTNil:
+			value.SetNil()
+			return nil
+		case ValueTClosure, ValueTCFunction:
+			vm.callMetaMethod(storeResult(value), &index, current, *key)
+			return nil
+		default:
+			current = index
+		}
+	}
+
+	module, line := vm.getCurrentInstructionPos()
+	return NewRuntimeError1(module, line, "loop in gettable")
+}
+
+// Set value of table by key, try the __newindex metamethod
+// when the key is not existed in table
+func (vm *VM) setTable(t, key, value *Value) error {
+	current := *t
+	for loop := 0; loop < maxMetaLoop; loop++ {
+		switch current.Type() {
+		case ValueTTable:
+			if v := current.Table().GetValue(*key); !v.IsNil() {
+				current.Table().SetValue(*key, *value)
+				return nil
+			}
+		case ValueTUserData:
+			if current.UserData().GetMetaTable() == nil {
+				return vm.indexError(loop, current, *key, "set", "to")
+			}
+		default:
+			return vm.indexError(loop, current, *key, "set", "to")
+		}
+
+		newIndex := vm.state.GetMetaMethod(&current, "__newindex")
+		switch newIndex.Type() {
+		case ValueTNil:
+			if err := vm.checkTableKey(key); err != nil {
+				return err
+			}
+			if current.Type() == ValueTTable {
+				current.Table().SetValue(*key, *value)
+			} else {
+				// Members of user data are stored in its metaTable
+				current.UserData().GetMetaTable().SetValue(*key, *value)
+			}
+			return nil
+		case ValueTClosure, ValueTCFunction:
+			vm.callMetaMethod(func(Value) {}, &newIndex, current, *key, *value)
+			return nil
+		default:
+			current = newIndex
+		}
+	}
+
+	module, line := vm.getCurrentInstructionPos()
+	return NewRuntimeError1(module, line, "loop in settable")
+}
+
+// Report error of indexing value 't' which can not be indexed,
+// 'loop' is the loop count of metamethod chain
+func (vm *VM) indexError(loop int, t, k Value, op, desc string) error {
+	if loop == 0 {
+		return vm.checkTableType(t, k, op, desc)
+	}
+
+	module, line := vm.getCurrentInstructionPos()
+	return NewRuntimeError2(module, line, t, "metamethod value", "table or function")
+}
+
+// Check 'key' can be stored into table, nil and NaN can not be a key
+func (vm *VM) checkTableKey(key *Value) error {
+	var desc string
+	if key.IsNil() {
+		desc = "table index is nil"
+	} else if key.IsNumber() && math.IsNaN(key.Num()) {
+		desc = "table index is NaN"
+	} else {
+		return nil
+	}
+
+	module, line := vm.getCurrentInstructionPos()
+	return NewRuntimeError1(module, line, desc)
+}
+
 func (vm *VM) generateClosure(a *Value, i Instruction) {
 	call, proto := getCallInfoAndProto(vm)
 	aProto := proto.GetChildFunction(int(GetParamBx(i)))
-	a.Type = ValueTClosure
-	a.Closure = vm.state.NewClosure()
-	a.Closure.SetPrototype(aProto)
+	newClosure := vm.state.NewClosure()
+	newClosure.SetPrototype(aProto)
+	*a = NewValueClosure(newClosure)
 
 	// Prepare all upvalues
-	newClosure := a.Closure
-	closure := call.Func.Closure
+	closure := vm.state.getCallFunc(call).Closure()
 	count := aProto.GetUpvalueCount()
 	for i := 0; i < count; i++ {
 		upvalueInfo := aProto.GetUpvalue(i)
 		if upvalueInfo.ParentLocal {
-			reg := vPointerAdd(call.Register, upvalueInfo.RegisterIndex)
-			if reg.Type != ValueTUpvalue {
+			reg := vm.state.stack.Get(call.Register + upvalueInfo.RegisterIndex)
+			if reg.Type() != ValueTUpvalue {
 				upvalue := vm.state.NewUpvalue()
 				upvalue.SetValue(reg)
-				reg.Type = ValueTUpvalue
-				reg.Upvalue = upvalue
+				*reg = NewValueUpvalue(upvalue)
 				newClosure.AddUpvalue(upvalue)
 			} else {
-				newClosure.AddUpvalue(reg.Upvalue)
+				newClosure.AddUpvalue(reg.Upvalue())
 			}
 		} else {
 			// Get upvalue from parent upvalue list
@@ -377,40 +615,39 @@ func (vm *VM) generateClosure(a *Value, i Instruction) {
 	}
 }
 
-func (vm *VM) copyVarArg(a *Value, i Instruction) {
+func (vm *VM) copyVarArg(a int, i Instruction) {
 	call, proto := getCallInfoAndProto(vm)
-	arg := vPointerAdd(call.Func, 1)
+	stack := vm.state.stack
+	arg := call.Func + 1
 	// totalArgs represents the number of Value between call.Register and arg
-	totalArgs := int((uintptr(unsafe.Pointer(call.Register)) - uintptr(unsafe.Pointer(arg))) /
-		unsafe.Sizeof(Value{}))
+	totalArgs := call.Register - arg
 	varargCount := totalArgs - proto.FixedArgCount()
 
-	arg = vPointerAdd(arg, proto.FixedArgCount())
+	arg += proto.FixedArgCount()
 	expectCount := int(GetParamsBx(i))
 	if expectCount == ExpValueCountAny {
+		vm.state.checkStack(a, varargCount)
 		for i := 0; i < varargCount; i++ {
-			*a = *arg
-			arg = vPointerAdd(arg, 1)
+			*stack.Get(a + i) = *stack.Get(arg + i)
 		}
-		vm.state.stack.SetNewTop(a)
+		stack.SetNewTop(a + varargCount)
 	} else {
 		i := 0
 		for ; i < varargCount && i < expectCount; i++ {
-			*a = *arg
-			arg = vPointerAdd(arg, 1)
+			*stack.Get(a + i) = *stack.Get(arg + i)
 		}
 		for ; i < expectCount; i++ {
-			a.SetNil()
-			a = vPointerAdd(a, 1)
+			stack.Get(a + i).SetNil()
 		}
 	}
 }
 
-func (vm *VM) return_(a *Value, i Instruction) {
+func (vm *VM) return_(a int, i Instruction) {
+	stack := vm.state.stack
 	// Set stack top when return value count i is fixed
 	retValueCount := int(GetParamsBx(i))
 	if retValueCount != ExpValueCountAny {
-		vm.state.stack.Top = vPointerAdd(a, retValueCount)
+		stack.Top = a + retValueCount
 	}
 
 	if vm.state.calls.Len() == 0 {
@@ -422,41 +659,44 @@ func (vm *VM) return_(a *Value, i Instruction) {
 	dst := call.Func
 
 	expectResult := call.ExpectResult
-	resultCount := int(uintptr(unsafe.Pointer(vm.state.stack.Top)) - uintptr(unsafe.Pointer(a)))
+	resultCount := stack.Top - a
 	if expectResult == ExpValueCountAny {
 		for i := 0; i < resultCount; i++ {
-			*dst = *src
-			src = vPointerAdd(src, 1)
+			*stack.Get(dst) = *stack.Get(src)
+			dst++
+			src++
 		}
 	} else {
 		i := 0
 		count := int(math.Min(float64(expectResult), float64(resultCount)))
 		for i < count {
-			*dst = *src
-			dst = vPointerAdd(dst, 1)
-			src = vPointerAdd(src, i)
+			*stack.Get(dst) = *stack.Get(src)
+			dst++
+			src++
 			i++
 		}
 		// No enough results for expect results, set remain as nil
 		for i < expectResult {
-			dst.SetNil()
-			dst = vPointerAdd(dst, 1)
+			stack.Get(dst).SetNil()
+			dst++
 			i++
 		}
 	}
 
 	// Set new top and pop current CallInfo
-	vm.state.stack.SetNewTop(dst)
+	stack.SetNewTop(dst)
 	vm.state.calls.Remove(vm.state.calls.Back())
 }
 
 func (vm *VM) concat(dst, op1, op2 *Value) error {
-	if op1.Type == ValueTString && op2.Type == ValueTString {
-		dst.Str = vm.state.GetString(op1.Str.GetStdString() + op2.Str.GetCStr())
-	} else if op1.Type == ValueTString && op2.Type == ValueTNumber {
-		dst.Str = vm.state.GetString(op1.Str.GetCStr() + numberToStr(op2))
-	} else if op1.Type == ValueTNumber && op2.Type == ValueTString {
-		dst.Str = vm.state.GetString(numberToStr(op2) + op2.Str.GetCStr())
+	if op1.Type() == ValueTString && op2.Type() == ValueTString {
+		*dst = NewValueString(vm.state.GetString(op1.Str().GetStdString() + op2.Str().GetCStr()))
+	} else if op1.Type() == ValueTString && op2.Type() == ValueTNumber {
+		*dst = NewValueString(vm.state.GetString(op1.Str().GetCStr() + NumberToString(op2)))
+	} else if op1.Type() == ValueTNumber && op2.Type() == ValueTString {
+		*dst = NewValueString(vm.state.GetString(NumberToString(op1) + op2.Str().GetCStr()))
+	} else if vm.callBinaryMetaMethod(op1, op2, "__concat", storeResult(dst)) {
+		return nil
 	} else {
 		pos1, pos2 := vm.getCurrentInstructionPos()
 		return NewRuntimeError4(pos1, pos2, *op1, *op2, "concat")
@@ -464,20 +704,168 @@ func (vm *VM) concat(dst, op1, op2 *Value) error {
 	return nil
 }
 
+// Calculate 'op1' and 'op2' into 'dst', by 'fi' when both operands are
+// integers and 'fi' is not nil, otherwise by 'ff' as floats, try the
+// metamethod 'event' when any operand is not a number
+func (vm *VM) arith(dst, op1, op2 *Value, event, op string,
+	fi func(x, y int64) int64, ff func(x, y float64) float64) error {
+	if fi != nil && op1.IsInteger() && op2.IsInteger() {
+		dst.SetInt(fi(op1.Int(), op2.Int()))
+		return nil
+	}
+	if op1.IsNumber() && op2.IsNumber() {
+		dst.SetNum(ff(op1.Num(), op2.Num()))
+		return nil
+	}
+
+	if vm.callBinaryMetaMethod(op1, op2, event, storeResult(dst)) {
+		return nil
+	}
+	return vm.checkArithType(*op1, *op2, op)
+}
+
+// Calculate integers of 'op1' and 'op2' by 'f' into 'dst', try the
+// metamethod 'event' when any operand can not be converted to integer
+func (vm *VM) bitwise(dst, op1, op2 *Value, event, op string, f func(x, y int64) int64) error {
+	x, ok1 := op1.ToInteger()
+	y, ok2 := op2.ToInteger()
+	if ok1 && ok2 {
+		dst.SetInt(f(x, y))
+		return nil
+	}
+
+	if vm.callBinaryMetaMethod(op1, op2, event, storeResult(dst)) {
+		return nil
+	}
+	if op1.IsNumber() && op2.IsNumber() {
+		pos1, pos2 := vm.getCurrentInstructionPos()
+		return NewRuntimeError1(pos1, pos2, "number has no integer representation")
+	}
+	return vm.checkArithType(*op1, *op2, op)
+}
+
+// Report error when integer 'op1' is divided by integer 0
+func (vm *VM) checkDivisor(op1, op2 *Value, op string) error {
+	if op1.IsInteger() && op2.IsInteger() && op2.Int() == 0 {
+		pos1, pos2 := vm.getCurrentInstructionPos()
+		return NewRuntimeError1(pos1, pos2, fmt.Sprintf("attempt to perform '%s'", op))
+	}
+	return nil
+}
+
+// Get length of 'a' into 'a', try the __len metamethod
+// when 'a' is not a string
+func (vm *VM) len(a *Value) error {
+	if a.Type() == ValueTString {
+		a.SetInt(int64(a.Str().GetLength()))
+	} else if vm.callUnaryMetaMethod(a, "__len") {
+		return nil
+	} else if a.Type() == ValueTTable {
+		a.SetInt(int64(a.Table().ArraySize()))
+	} else {
+		return vm.reportTypeError(a, "length of")
+	}
+	return nil
+}
+
+// Compare 'op1' < 'op2' into 'dst', try the __lt metamethod
+// when operands are not both numbers or strings
+func (vm *VM) less(dst, op1, op2 *Value, op string) error {
+	if op1.Type() == ValueTNumber && op2.Type() == ValueTNumber {
+		dst.SetBool(numberLess(op1, op2))
+	} else if op1.Type() == ValueTString && op2.Type() == ValueTString {
+		dst.SetBool(op1.Str().IsLess(*op2.Str()))
+	} else if vm.callBinaryMetaMethod(op1, op2, "__lt",
+		func(result Value) { dst.SetBool(!result.IsFalse()) }) {
+		return nil
+	} else {
+		return vm.checkInequalityType(*op1, *op2, op)
+	}
+	return nil
+}
+
+// Compare 'op1' <= 'op2' into 'dst', try the __le metamethod, or
+// not 'op2' < 'op1' by __lt metamethod, when operands are not both
+// numbers or strings
+func (vm *VM) lessEqual(dst, op1, op2 *Value, op string) error {
+	if op1.Type() == ValueTNumber && op2.Type() == ValueTNumber {
+		dst.SetBool(numberLessEqual(op1, op2))
+	} else if op1.Type() == ValueTString && op2.Type() == ValueTString {
+		dst.SetBool(!op2.Str().IsLess(*op1.Str()))
+	} else if vm.callBinaryMetaMethod(op1, op2, "__le",
+		func(result Value) { dst.SetBool(!result.IsFalse()) }) {
+		return nil
+	} else if vm.callBinaryMetaMethod(op2, op1, "__lt",
+		func(result Value) { dst.SetBool(result.IsFalse()) }) {
+		return nil
+	} else {
+		return vm.checkInequalityType(*op1, *op2, op)
+	}
+	return nil
+}
+
+// Compare 'op1' == 'op2' into 'dst', or 'op1' ~= 'op2' when 'negate' is
+// true, try the __eq metamethod when operands are different tables or
+// different user data
+func (vm *VM) equal(dst, op1, op2 *Value, negate bool) {
+	if op1.IsEqual(op2) {
+		dst.SetBool(!negate)
+		return
+	}
+	if op1.Type() != op2.Type() ||
+		(op1.Type() != ValueTTable && op1.Type() != ValueTUserData) {
+		dst.SetBool(negate)
+		return
+	}
+
+	if !vm.callBinaryMetaMethod(op1, op2, "__eq",
+		func(result Value) { dst.SetBool(result.IsFalse() == negate) }) {
+		dst.SetBool(negate)
+	}
+}
+
+// Call metamethod 'event' of 'op1' or 'op2' with both operands,
+// then call 'finish' with the result, return false when neither
+// operand has the metamethod
+func (vm *VM) callBinaryMetaMethod(op1, op2 *Value, event string, finish func(result Value)) bool {
+	metaMethod := vm.state.GetMetaMethod(op1, event)
+	if metaMethod.IsNil() {
+		metaMethod = vm.state.GetMetaMethod(op2, event)
+	}
+	if metaMethod.IsNil() {
+		return false
+	}
+
+	vm.callMetaMethod(finish, &metaMethod, *op1, *op2)
+	return true
+}
+
+// Call metamethod 'event' of 'a' and store the result into 'a',
+// return false when 'a' has no the metamethod
+func (vm *VM) callUnaryMetaMethod(a *Value, event string) bool {
+	metaMethod := vm.state.GetMetaMethod(a, event)
+	if metaMethod.IsNil() {
+		return false
+	}
+
+	vm.callMetaMethod(storeResult(a), &metaMethod, *a, *a)
+	return true
+}
+
 func (vm *VM) forInit(var_, limit, step *Value) error {
-	if var_.Type != ValueTNumber {
+	if var_.Type() != ValueTNumber {
 		pos1, pos2 := vm.getCurrentInstructionPos()
 		return NewRuntimeError2(pos1, pos2, *var_, "'for' init", "number")
 	}
 
-	if limit.Type != ValueTNumber {
+	if limit.Type() != ValueTNumber {
 		pos1, pos2 := vm.getCurrentInstructionPos()
-		return NewRuntimeError2(pos1, pos2, *var_, "'for' limit", "number")
+		return NewRuntimeError2(pos1, pos2, *limit, "'for' limit", "number")
 	}
 
-	if step.Type != ValueTNumber {
+	if step.Type() != ValueTNumber {
 		pos1, pos2 := vm.getCurrentInstructionPos()
-		return NewRuntimeError2(pos1, pos2, *var_, "'for' step", "number")
+		return NewRuntimeError2(pos1, pos2, *step, "'for' step", "number")
 	}
 	return nil
 }
@@ -485,10 +873,16 @@ func (vm *VM) forInit(var_, limit, step *Value) error {
 // Debug help functions
 func (vm *VM) getOperandNameAndScope(a *Value) (string, string) {
 	call, proto := getCallInfoAndProto(vm)
-	reg := int(uintptr(unsafe.Pointer(a)) - uintptr(unsafe.Pointer(call.Register)))
-	instruction := iPointerAdd(call.Instruction, -1)
-	base := proto.GetOpCodes()
-	pc := int(uintptr(unsafe.Pointer(instruction)) - uintptr(unsafe.Pointer(base)))
+	stack := vm.state.stack
+	reg := -1
+	for r := 0; r < frameRegisterCount; r++ {
+		if stack.Get(call.Register+r) == a {
+			reg = r
+			break
+		}
+	}
+	code := proto.GetOpCodes()
+	pc := call.Instruction - 1
 	unknownName := "?"
 	scopeGlobal := "global"
 	scopeLocal := "local"
@@ -496,17 +890,24 @@ func (vm *VM) getOperandNameAndScope(a *Value) (string, string) {
 	scopeTable := "table member"
 	scopeNil := ""
 
+	// Operand may be a local variable referenced by RK operand
+	if reg >= 0 {
+		if name := proto.SearchLocalVar(reg, pc); name != nil {
+			return name.GetCStr(), scopeLocal
+		}
+	}
+
 	// Search last instruction which dst register is reg,
 	// and get the name base on the instruction
-	for uintptr(unsafe.Pointer(instruction)) > uintptr(unsafe.Pointer(base)) {
-		instruction = iPointerAdd(instruction, -1)
+	for index := pc - 1; index >= 0; index-- {
+		instruction := &code[index]
 		switch GetOpCode(*instruction) {
 		case OpTypeGetGlobal:
 			if reg == GetParamA(*instruction) {
 				index := GetParamBx(*instruction)
 				key := proto.GetConstValue(int(index))
-				if key.Type == ValueTString {
-					return key.Str.GetCStr(), scopeGlobal
+				if key.Type() == ValueTString {
+					return key.Str().GetCStr(), scopeGlobal
 				} else {
 					return unknownName, scopeNil
 				}
@@ -530,9 +931,9 @@ func (vm *VM) getOperandNameAndScope(a *Value) (string, string) {
 		case OpTypeGetTable:
 			if reg == GetParamC(*instruction) {
 				key := GetParamB(*instruction)
-				keyReg := vPointerAdd(call.Register, key)
-				if keyReg.Type == ValueTString {
-					return keyReg.Str.GetCStr(), scopeTable
+				keyReg := stack.Get(call.Register + key)
+				if keyReg.Type() == ValueTString {
+					return keyReg.Str().GetCStr(), scopeTable
 				} else {
 					return unknownName, scopeTable
 				}
@@ -543,20 +944,19 @@ func (vm *VM) getOperandNameAndScope(a *Value) (string, string) {
 }
 
 func (vm *VM) getCurrentInstructionPos() (string, int) {
-	call, proto := getCallInfoAndProto(vm)
-	index := uintptr(unsafe.Pointer(call.Instruction)) - uintptr(unsafe.Pointer(proto.GetOpCodes())) - 1
-	return proto.GetModule().GetCStr(), proto.GetInstructionLine(int(index))
+	call, _ := getCallInfoAndProto(vm)
+	return vm.state.getCallInstructionPos(call)
 }
 
 func (vm *VM) checkType(v *Value, vType int, op string) error {
-	if v.Type != vType {
+	if v.Type() != vType {
 		return vm.reportTypeError(v, op)
 	}
 	return nil
 }
 
 func (vm *VM) checkArithType(v1, v2 Value, op string) error {
-	if v1.Type != ValueTNumber || v2.Type != ValueTNumber {
+	if v1.Type() != ValueTNumber || v2.Type() != ValueTNumber {
 		pos1, pos2 := vm.getCurrentInstructionPos()
 		return NewRuntimeError4(pos1, pos2, v1, v2, op)
 	}
@@ -564,8 +964,8 @@ func (vm *VM) checkArithType(v1, v2 Value, op string) error {
 }
 
 func (vm *VM) checkInequalityType(v1, v2 Value, op string) error {
-	if (v1.Type != v2.Type) ||
-		(v1.Type != ValueTNumber && v1.Type != ValueTString) {
+	if (v1.Type() != v2.Type()) ||
+		(v1.Type() != ValueTNumber && v1.Type() != ValueTString) {
 		pos1, pos2 := vm.getCurrentInstructionPos()
 		return NewRuntimeError4(pos1, pos2, v1, v2, op)
 	}
@@ -573,16 +973,16 @@ func (vm *VM) checkInequalityType(v1, v2 Value, op string) error {
 }
 
 func (vm *VM) checkTableType(t, k Value, op, desc string) error {
-	if (t.Type == ValueTTable) ||
-		(t.Type == ValueTUserData && t.UserDate.GetMetaTable() != nil) {
+	if (t.Type() == ValueTTable) ||
+		(t.Type() == ValueTUserData && t.UserData().GetMetaTable() != nil) {
 		return nil
 	}
 
 	n, s := vm.getOperandNameAndScope(&t)
 	pos1, pos2 := vm.getCurrentInstructionPos()
 	var keyName string
-	if k.Type == ValueTString {
-		keyName = k.Str.GetCStr()
+	if k.Type() == ValueTString {
+		keyName = k.Str().GetCStr()
 	} else {
 		keyName = "?"
 	}
@@ -601,16 +1001,41 @@ func (vm *VM) Execute() {
 		panic("assert")
 	}
 
-	for vm.state.calls.Len() != 0 {
+	vm.executeUntil(0)
+}
+
+// Execute stack frames until the count of calls back to 'depth'
+func (vm *VM) executeUntil(depth int) {
+	defer vm.attachTraceback()
+
+	for vm.state.calls.Len() > depth {
 		// If current stack frame is a frame of a c function,
 		// do not continue execute instructions, just return
 		call := vm.state.calls.Back().Value.(*CallInfo)
-		if call.Func.Type == ValueTCFunction {
+		if vm.state.getCallFunc(call).Type() == ValueTCFunction {
 			return
 		}
 
+		// Metamethod called by the frame yielded and returned
+		// in the resumed coroutine
+		if call.finishMeta != nil {
+			vm.finishMetaMethod(call)
+		}
+
 		if err := vm.executeFrame(); err != nil {
 			panic(err)
 		}
 	}
 }
+
+// Attach stack traceback to the panicking RuntimeError,
+// stack frames are not unwound yet
+func (vm *VM) attachTraceback() {
+	if r := recover(); r != nil {
+		if e, ok := r.(RuntimeError); ok && e.Traceback == nil {
+			e.Traceback = vm.state.GetTraceback(0)
+			panic(e)
+		}
+		panic(r)
+	}
+}
@@ -1,11 +1,24 @@
 package vm
 
-import "fmt"
+import (
+	"math"
+	"unsafe"
+)
 
 const ExpValueCountAny = -1
 
 type CFunctionType func(state *State) int
 
+// Continuation of c function, when the coroutine is yielded by the c function
+// or by the function called by it, the continuation is called to continue the
+// c function after the coroutine resumed, 'ctx' is the context set by the
+// c function. It returns the count of results like CFunctionType.
+type CFunctionKType func(state *State, ctx interface{}) int
+
+// Continuation of c function which calls ProtectedCallK, 'err' is the error
+// caught by the protected call, or nil when the called function returned.
+type CFunctionPKType func(state *State, err error, ctx interface{}) int
+
 const (
 	ValueTNil = iota
 	ValueTBool
@@ -17,143 +30,306 @@ const (
 	ValueTTable
 	ValueTUserData
 	ValueTCFunction
+	ValueTThread
 )
 
-func EnValue(v Value) string {
-	return fmt.Sprintf("%v %p %p %p %p %p %p %b %t %d", v.Obj, v.Str, v.Closure,
-		v.Upvalue, v.Table, v.UserDate, v.CFunc, v.Num, v.BValue, v.Type)
-}
+// Tags of non-object values, they are stored in the pointer word of Value
+var valueTags [3]byte
 
-func DeValue(s string) Value {
-	var v Value
-	_, err := fmt.Sscanf(s, "%v %p %p %p %p %p %p %b %t %d", &v.Obj, &v.Str, &v.Closure,
-		&v.Upvalue, &v.Table, &v.UserDate, &v.CFunc, &v.Num, &v.BValue, &v.Type)
-	if err != nil {
-		panic(err)
-	}
-	return v
+var (
+	boolTag   = unsafe.Pointer(&valueTags[0])
+	numberTag = unsafe.Pointer(&valueTags[1])
+	intTag    = unsafe.Pointer(&valueTags[2])
+)
+
+// Flag in payload of c function which is stored without cFunction,
+// ptr is the function pointer itself then
+const plainCFunction = 1 << 32
+
+// C function and the object kept alive by it
+type cFunction struct {
+	fn  CFunctionType
+	obj GCObject
 }
 
-// Value type of vm
+// Value type of vm, it is two words: a pointer and a payload.
+// nil:        ptr is nil
+// bool:       ptr is boolTag, payload is 0 or 1
+// number:     ptr is numberTag, payload is bits of float64
+// integer:    ptr is intTag, payload is bits of int64
+// c function: ptr is the function, payload has plainCFunction flag
+// c function keeping an object alive: ptr points to cFunction
+// otherwise:  ptr points to the object, payload is the ValueT of it
+// Float and integer are both ValueTNumber, they are subtypes of number.
+// Value is comparable, two values are == when they are raw equal.
 type Value struct {
-	Obj      GCObject
-	Str      *String
-	Closure  *Closure
-	Upvalue  *Upvalue
-	Table    *Table
-	UserDate *UserData
-	CFunc    CFunctionType
-	Num      float64
-	BValue   bool
+	ptr     unsafe.Pointer
+	payload uint64
+}
 
-	Type int
+func newValueObject(ptr unsafe.Pointer, vType int) Value {
+	return Value{ptr: ptr, payload: uint64(vType)}
 }
 
 func NewValueObj() Value {
-	return Value{Obj: nil, Type: ValueTNil}
+	return Value{}
 }
 
 func NewValueBValue(bValue bool) Value {
-	return Value{BValue: bValue, Type: ValueTBool}
+	v := Value{}
+	v.SetBool(bValue)
+	return v
 }
 
 func NewValueNum(num float64) Value {
-	return Value{Num: num, Type: ValueTNumber}
+	return Value{ptr: numberTag, payload: math.Float64bits(num)}
+}
+
+func NewValueInt(num int64) Value {
+	return Value{ptr: intTag, payload: uint64(num)}
 }
 
 func NewValueString(str *String) Value {
-	return Value{Str: str, Type: ValueTString}
+	return newValueObject(unsafe.Pointer(str), ValueTString)
 }
 
 func NewValueClosure(closure *Closure) Value {
-	return Value{Closure: closure, Type: ValueTClosure}
+	return newValueObject(unsafe.Pointer(closure), ValueTClosure)
 }
 
 func NewValueUpvalue(upvalue *Upvalue) Value {
-	return Value{Upvalue: upvalue, Type: ValueTUpvalue}
+	return newValueObject(unsafe.Pointer(upvalue), ValueTUpvalue)
 }
 
 func NewValueTable(table *Table) Value {
-	return Value{Table: table, Type: ValueTTable}
+	return newValueObject(unsafe.Pointer(table), ValueTTable)
 }
 
 func NewValueUserData(userData *UserData) Value {
-	return Value{UserDate: userData, Type: ValueTUserData}
+	return newValueObject(unsafe.Pointer(userData), ValueTUserData)
 }
 
 func NewValueCFunction(cFunc CFunctionType) Value {
-	return Value{CFunc: cFunc, Type: ValueTCFunction}
+	return Value{ptr: *(*unsafe.Pointer)(unsafe.Pointer(&cFunc)),
+		payload: ValueTCFunction | plainCFunction}
+}
+
+// New c function value which keeps 'obj' alive,
+// 'obj' is visited by GC as long as the function value is reachable
+func NewValueCFunctionWithObj(cFunc CFunctionType, obj GCObject) Value {
+	if obj == nil {
+		return NewValueCFunction(cFunc)
+	}
+	return newValueObject(unsafe.Pointer(&cFunction{fn: cFunc, obj: obj}), ValueTCFunction)
+}
+
+func NewValueThread(thread *Thread) Value {
+	return newValueObject(unsafe.Pointer(thread), ValueTThread)
+}
+
+// Get ValueT of the value
+func (v *Value) Type() int {
+	switch v.ptr {
+	case nil:
+		return ValueTNil
+	case boolTag:
+		return ValueTBool
+	case numberTag, intTag:
+		return ValueTNumber
+	}
+	return int(uint32(v.payload))
 }
 
 func (v *Value) SetNil() {
-	v.Obj = nil
-	v.Type = ValueTNil
+	*v = Value{}
 }
 
 func (v *Value) SetBool(bValue bool) {
-	v.BValue = bValue
-	v.Type = ValueTBool
+	v.ptr = boolTag
+	v.payload = 0
+	if bValue {
+		v.payload = 1
+	}
+}
+
+func (v *Value) SetNum(num float64) {
+	v.ptr = numberTag
+	v.payload = math.Float64bits(num)
+}
+
+func (v *Value) SetInt(num int64) {
+	v.ptr = intTag
+	v.payload = uint64(num)
 }
 
 func (v *Value) IsNil() bool {
-	return v.Type == ValueTNil
+	return v.ptr == nil
+}
+
+func (v *Value) IsNumber() bool {
+	return v.ptr == numberTag || v.ptr == intTag
+}
+
+// Whether the value is a number of integer subtype
+func (v *Value) IsInteger() bool {
+	return v.ptr == intTag
+}
+
+// Whether the value is a number of float subtype
+func (v *Value) IsFloat() bool {
+	return v.ptr == numberTag
 }
 
 func (v *Value) IsFalse() bool {
-	return (v.Type == ValueTNil) || (v.Type == ValueTBool && !v.BValue)
+	return v.ptr == nil || (v.ptr == boolTag && v.payload == 0)
 }
 
-func (v *Value) Accept(visitor GCObjectVisitor) {
-	switch v.Type {
-	case ValueTNil, ValueTBool, ValueTNumber, ValueTCFunction:
-	case ValueTObj:
-		v.Obj.Accept(visitor)
+// Get the bool, false if value is not a bool
+func (v *Value) Bool() bool {
+	return v.ptr == boolTag && v.payload != 0
+}
+
+// Get the number as float, integer is converted to float,
+// 0 if value is not a number
+func (v *Value) Num() float64 {
+	switch v.ptr {
+	case numberTag:
+		return math.Float64frombits(v.payload)
+	case intTag:
+		return float64(int64(v.payload))
+	}
+	return 0
+}
+
+// Get the integer, float is truncated, 0 if value is not a number
+func (v *Value) Int() int64 {
+	switch v.ptr {
+	case numberTag:
+		return int64(math.Float64frombits(v.payload))
+	case intTag:
+		return int64(v.payload)
+	}
+	return 0
+}
+
+// Convert the number to integer, return false when value is not a
+// number or the float has no exact integer representation
+func (v *Value) ToInteger() (int64, bool) {
+	switch v.ptr {
+	case numberTag:
+		return floatToInteger(math.Float64frombits(v.payload))
+	case intTag:
+		return int64(v.payload), true
+	}
+	return 0, false
+}
+
+// Get pointer of the object when value is 'vType', otherwise nil
+func (v *Value) object(vType int) unsafe.Pointer {
+	if v.ptr == nil || v.ptr == boolTag || v.ptr == numberTag || v.ptr == intTag ||
+		int(uint32(v.payload)) != vType {
+		return nil
+	}
+	return v.ptr
+}
+
+func (v *Value) Str() *String {
+	return (*String)(v.object(ValueTString))
+}
+
+func (v *Value) Closure() *Closure {
+	return (*Closure)(v.object(ValueTClosure))
+}
+
+func (v *Value) Upvalue() *Upvalue {
+	return (*Upvalue)(v.object(ValueTUpvalue))
+}
+
+func (v *Value) Table() *Table {
+	return (*Table)(v.object(ValueTTable))
+}
+
+func (v *Value) UserData() *UserData {
+	return (*UserData)(v.object(ValueTUserData))
+}
+
+func (v *Value) Thread() *Thread {
+	return (*Thread)(v.object(ValueTThread))
+}
+
+// Get the c function, nil if value is not a c function
+func (v *Value) CFunc() CFunctionType {
+	if v.payload == ValueTCFunction|plainCFunction {
+		return *(*CFunctionType)(unsafe.Pointer(&v.ptr))
+	}
+	if f := (*cFunction)(v.object(ValueTCFunction)); f != nil {
+		return f.fn
+	}
+	return nil
+}
+
+// Get the object kept alive by c function, nil if there is not
+func (v *Value) Obj() GCObject {
+	if v.payload == ValueTCFunction|plainCFunction {
+		return nil
+	}
+	if f := (*cFunction)(v.object(ValueTCFunction)); f != nil {
+		return f.obj
+	}
+	return nil
+}
+
+// Get the GC object of value, nil if value is not a GC object. Object
+// kept alive by c function is not the value of c function, so it is nil
+func (v *Value) gcObject() GCObject {
+	switch v.Type() {
 	case ValueTString:
-		v.Str.Accept(visitor)
+		return v.Str()
 	case ValueTClosure:
-		v.Closure.Accept(visitor)
+		return v.Closure()
 	case ValueTUpvalue:
-		v.Upvalue.Accept(visitor)
+		return v.Upvalue()
 	case ValueTTable:
-		v.Table.Accept(visitor)
+		return v.Table()
 	case ValueTUserData:
-		v.UserDate.Accept(visitor)
+		return v.UserData()
+	case ValueTThread:
+		return v.Thread()
 	}
+	return nil
 }
 
-func (v *Value) TypeName() string {
-	return v.GetTypeName(v.Type)
-}
-
-func (v *Value) IsEqual(v1 *Value) bool {
-	if v.Type != v1.Type {
-		return false
-	}
-
-	switch v.Type {
-	case ValueTNil:
-		return true
-	case ValueTBool:
-		return v.BValue == v1.BValue
-	case ValueTNumber:
-		return v.Num == v1.Num
-	case ValueTObj:
-		return v.Obj == v1.Obj
+func (v *Value) Accept(visitor GCObjectVisitor) {
+	switch v.Type() {
+	case ValueTNil, ValueTBool, ValueTNumber:
+	case ValueTCFunction:
+		if obj := v.Obj(); obj != nil {
+			obj.Accept(visitor)
+		}
 	case ValueTString:
-		return v.Str == v1.Str
+		v.Str().Accept(visitor)
 	case ValueTClosure:
-		return v.Closure == v1.Closure
+		v.Closure().Accept(visitor)
 	case ValueTUpvalue:
-		return v.Upvalue == v1.Upvalue
+		v.Upvalue().Accept(visitor)
 	case ValueTTable:
-		return v.Table == v1.Table
+		v.Table().Accept(visitor)
 	case ValueTUserData:
-		return v.UserDate == v1.UserDate
-		//case ValueTCFunction:
-		//	return v.CFunc == v1.CFunc
+		v.UserData().Accept(visitor)
+	case ValueTThread:
+		v.Thread().Accept(visitor)
 	}
+}
 
-	return false
+func (v *Value) TypeName() string {
+	return v.GetTypeName(v.Type())
+}
+
+func (v *Value) IsEqual(v1 *Value) bool {
+	if v.IsNumber() && v1.IsNumber() {
+		return numberEqual(v, v1)
+	}
+	return *v == *v1
 }
 
 func (v *Value) GetTypeName(vType int) string {
@@ -176,6 +352,8 @@ func (v *Value) GetTypeName(vType int) string {
 		return "table"
 	case ValueTUserData:
 		return "userdata"
+	case ValueTThread:
+		return "thread"
 	default:
 		return "unknown type"
 	}
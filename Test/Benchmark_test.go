@@ -0,0 +1,176 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"testing"
+	"unsafe"
+)
+
+// Benchmark scripts
+const (
+	benchmarkFibScript = `
+		local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+		fib(20)
+	`
+	benchmarkArithScript = `
+		local x, y = 0, 1.5
+		for i = 1, 100000 do x = x + i * y - x / 2 end
+	`
+	benchmarkTableArrayScript = `
+		local t = {}
+		for i = 1, 10000 do t[i] = i end
+		local sum = 0
+		for i = 1, 10000 do sum = sum + t[i] end
+	`
+	benchmarkTableHashScript = `
+		local t = {}
+		for i = 1, 1000 do t["k" .. i] = i end
+		local sum = 0
+		for j = 1, 10 do
+			for i = 1, 1000 do sum = sum + t["k" .. i] end
+		end
+	`
+	benchmarkPairsScript = `
+		local t = {}
+		for i = 1, 100 do t[i] = i end
+		local sum = 0
+		for j = 1, 1000 do
+			for k, v in pairs(t) do sum = sum + v end
+		end
+	`
+)
+
+func runBenchmarkScript(b *testing.B, script string) {
+	state := NewLibState()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := state.TryDoString(script, "benchmark"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Count instructions executed by 'script', which is the least
+// Limits.MaxInstructions the script runs within
+func countInstructions(t *testing.T, script string, optimize bool) int {
+	t.Helper()
+	run := func(limit int) bool {
+		state := NewLibState()
+		state.SetOptimize(optimize)
+		state.SetLimits(Limits{MaxInstructions: limit})
+		return state.TryDoString(script, "benchmark") == nil
+	}
+
+	high := 1
+	for ; !run(high); high *= 2 {
+		if high > 1<<30 {
+			t.Fatalf("script failed\n%s", script)
+		}
+	}
+	low := high / 2
+	for low+1 < high {
+		if mid := (low + high) / 2; run(mid) {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+	return high
+}
+
+// Instruction counts of benchmark scripts must be lower than the counts
+// of the scripts compiled without the optimizer, which loads consts and
+// locals into registers instead of referencing them by RK operands
+func TestBenchmarkInstructions(t *testing.T) {
+	counts := []struct {
+		name   string
+		script string
+	}{
+		{"Fib", benchmarkFibScript},
+		{"Arith", benchmarkArithScript},
+		{"TableArray", benchmarkTableArrayScript},
+		{"TableHash", benchmarkTableHashScript},
+	}
+	for _, c := range counts {
+		baseline := countInstructions(t, c.script, false)
+		count := countInstructions(t, c.script, true)
+		t.Logf("%s: %d -> %d (%+d)", c.name, baseline, count, count-baseline)
+		if count >= baseline {
+			t.Errorf("%s executed %d instructions, baseline is %d", c.name, count, baseline)
+		}
+	}
+}
+
+func BenchmarkFib(b *testing.B) {
+	runBenchmarkScript(b, benchmarkFibScript)
+}
+
+func BenchmarkArith(b *testing.B) {
+	runBenchmarkScript(b, benchmarkArithScript)
+}
+
+func BenchmarkTableArray(b *testing.B) {
+	runBenchmarkScript(b, benchmarkTableArrayScript)
+}
+
+func BenchmarkTableHash(b *testing.B) {
+	runBenchmarkScript(b, benchmarkTableHashScript)
+}
+
+func BenchmarkPairs(b *testing.B) {
+	runBenchmarkScript(b, benchmarkPairsScript)
+}
+
+// C function value without object is not allocated
+func TestCFunctionValueAllocs(t *testing.T) {
+	fn := func(state *State) int { return 0 }
+	var v Value
+	allocs := testing.AllocsPerRun(100, func() {
+		v = NewValueCFunction(fn)
+	})
+	if allocs != 0 {
+		t.Errorf("c function value allocs: %v", allocs)
+	}
+	if v.Type() != ValueTCFunction || v.CFunc() == nil || v.Obj() != nil {
+		t.Error("c function value error")
+	}
+	if NewValueCFunction(fn) != v {
+		t.Error("c function values of same function should be equal")
+	}
+}
+
+func BenchmarkNewValueCFunction(b *testing.B) {
+	fn := func(state *State) int { return 0 }
+	values := make([]Value, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values[i%len(values)] = NewValueCFunction(fn)
+	}
+}
+
+// Boxed c function value which keeps an object alive
+func BenchmarkNewValueCFunctionWithObj(b *testing.B) {
+	fn := func(state *State) int { return 0 }
+	obj := NewState().NewTable()
+	values := make([]Value, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values[i%len(values)] = NewValueCFunctionWithObj(fn, obj)
+	}
+}
+
+func BenchmarkValueCopy(b *testing.B) {
+	src := make([]Value, 1024)
+	for i := range src {
+		src[i] = NewValueNum(float64(i))
+	}
+	dst := make([]Value, len(src))
+	b.SetBytes(int64(len(src)) * int64(unsafe.Sizeof(Value{})))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(dst, src)
+	}
+}
@@ -0,0 +1,186 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const bytecodeScript = `
+	local function counter(step)
+		local n = 0
+		return function(...)
+			n = n + step
+			return n, ...
+		end
+	end
+	local c = counter(2)
+	c()
+	count, extra = c("extra")
+	big = 9007199254740993 // 1
+	str = 1.5 .. "x" .. 2
+	sum = 0
+	for i = 1, 10 do
+		if i % 2 == 0 then sum = sum + i end
+	end
+	t = {1, 2, x = "y"}
+`
+
+func dumpString(t *testing.T, script, name string) []byte {
+	t.Helper()
+	state := NewState()
+	if err := state.TryLoadString(script, name); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := state.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checkBytecodeResult(t *testing.T, state *State) {
+	t.Helper()
+	if count := GetGlobalValue(state, "count"); !count.IsInteger() || count.Int() != 4 {
+		t.Error("count error")
+	}
+	checkGlobalString(t, state, "extra", "extra")
+	if big := GetGlobalValue(state, "big"); !big.IsInteger() || big.Int() != 9007199254740993 {
+		t.Error("big error")
+	}
+	checkGlobalString(t, state, "str", "1.5x2")
+	if sum := GetGlobalValue(state, "sum"); sum.Int() != 30 {
+		t.Error("sum error")
+	}
+	if tv := GetGlobalValue(state, "t"); tv.Type() != ValueTTable || tv.Table().ArraySize() != 2 {
+		t.Error("t error")
+	}
+}
+
+func TestBytecode1(t *testing.T) {
+	chunk := dumpString(t, bytecodeScript, "bytecode")
+
+	state := NewLibState()
+	if err := state.TryDoBinary(bytes.NewReader(chunk), "bytecode"); err != nil {
+		t.Fatal(err)
+	}
+	checkBytecodeResult(t, state)
+
+	// Dump of loaded chunk is the same
+	if err := state.TryLoadBinary(bytes.NewReader(chunk), "bytecode"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := state.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), chunk) {
+		t.Error("dump of loaded chunk is different")
+	}
+}
+
+func TestBytecode2(t *testing.T) {
+	chunk := dumpString(t, bytecodeScript, "bytecode")
+	state := NewState()
+
+	// Truncated chunks
+	for size := 0; size < len(chunk); size++ {
+		err := state.TryLoadBinary(bytes.NewReader(chunk[:size]), "bytecode")
+		if _, ok := err.(BinaryChunkError); !ok {
+			t.Fatalf("truncated chunk of %d bytes should be a BinaryChunkError", size)
+		}
+	}
+
+	// Corrupt chunks
+	corrupt := make([]byte, len(chunk))
+	for i := range chunk {
+		for _, mask := range []byte{0x01, 0x80, 0xFF} {
+			copy(corrupt, chunk)
+			corrupt[i] ^= mask
+			err := state.TryLoadBinary(bytes.NewReader(corrupt), "bytecode")
+			if _, ok := err.(BinaryChunkError); !ok {
+				t.Fatalf("corrupt byte %d of chunk should be a BinaryChunkError", i)
+			}
+		}
+	}
+
+	// Foreign chunks
+	err := state.TryLoadBinary(bytes.NewReader([]byte(bytecodeScript)), "bytecode")
+	if e, ok := err.(BinaryChunkError); !ok || e.Desc != "not a binary chunk" {
+		t.Error("text should not be a binary chunk")
+	}
+	copy(corrupt, chunk)
+	corrupt[5]++
+	err = state.TryLoadBinary(bytes.NewReader(corrupt), "bytecode")
+	if e, ok := err.(BinaryChunkError); !ok || e.Desc != "version mismatch" ||
+		e.Error() != "bytecode: bad binary chunk, version mismatch" {
+		t.Error("chunk of other version should be rejected")
+	}
+
+	if state.GetCurrentCall() != nil || state.TryDoString("a = 1", "state") != nil {
+		t.Error("state should be usable after load error")
+	}
+}
+
+func TestBytecode3(t *testing.T) {
+	chunk := dumpString(t, bytecodeScript, "bytecode")
+	module := filepath.Join(t.TempDir(), "bytecode.luac")
+	if err := os.WriteFile(module, chunk, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewLibState()
+	if err := state.TryDoModule(module); err != nil {
+		t.Fatal(err)
+	}
+	checkBytecodeResult(t, state)
+	if !state.IsModuleLoaded(module) {
+		t.Error("binary module should be loaded")
+	}
+}
+
+func TestBytecode4(t *testing.T) {
+	state := NewState()
+	f := state.NewFunction()
+	f.SetModuleName(state.GetString("bytecode"))
+	f.AddInstruction(ACode(OpTypeLoadNil, 0), 1)
+	call := f.AddInstruction(ABCCode(OpTypeCall, 0, 1, 1), 1)
+	ret := f.AddInstruction(AsBxCode(OpTypeRet, 0, 0), 1)
+
+	load := func() error {
+		var buf bytes.Buffer
+		if err := DumpFunction(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+		return state.TryLoadBinary(&buf, "bytecode")
+	}
+	if err := load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Call and Ret with open value count without open values
+	for _, i := range []Instruction{
+		ABCCode(OpTypeCall, 0, 0, 1),
+		ABCode(OpTypeTailCall, 0, 0),
+	} {
+		*f.GetMutableInstruction(call) = i
+		err := load()
+		if e, ok := err.(BinaryChunkError); !ok || e.Desc != "bad open value count" {
+			t.Errorf("%s should be rejected", GetOpTypeName(GetOpCode(i)))
+		}
+	}
+	*f.GetMutableInstruction(call) = ABCCode(OpTypeCall, 0, 1, 1)
+	*f.GetMutableInstruction(ret) = AsBxCode(OpTypeRet, 0, ExpValueCountAny)
+	if err, ok := load().(BinaryChunkError); !ok || err.Desc != "bad open value count" {
+		t.Error("Ret should be rejected")
+	}
+
+	// Open results of the previous instruction
+	*f.GetMutableInstruction(call) = ABCCode(OpTypeCall, 0, 1, 0)
+	if err := load(); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,10 @@ package Test
 
 import (
 	"InterpreterVM/Source/io/text"
+	"InterpreterVM/Source/lib/base"
+	"InterpreterVM/Source/lib/coroutine"
+	libmath "InterpreterVM/Source/lib/math"
+	libstring "InterpreterVM/Source/lib/string"
 	. "InterpreterVM/Source/vm"
 	"unsafe"
 )
@@ -292,3 +296,18 @@ func FindName(name string, term *Terminator) bool {
 		return false
 	}
 }
+
+func GetGlobalValue(state *State, name string) Value {
+	global := state.GetGlobal()
+	return global.Table().GetValue(NewValueString(state.GetString(name)))
+}
+
+// New state with the libraries which tests use
+func NewLibState() *State {
+	state := NewState()
+	base.RegisterLibBase(state)
+	coroutine.RegisterLibCoroutine(state)
+	libmath.RegisterLibMath(state)
+	libstring.RegisterLibString(state)
+	return state
+}
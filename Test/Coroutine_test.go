@@ -0,0 +1,280 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"testing"
+)
+
+func TestCoroutine1(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local co = coroutine.create(function(a, b)
+			local c = coroutine.yield(a + b)
+			return c * 2
+		end)
+		local _
+		_, a = coroutine.resume(co, 1, 2)
+		b = coroutine.status(co)
+		_, c = coroutine.resume(co, 10)
+		d = coroutine.status(co)
+		e = coroutine.resume(co)
+	`, "coroutine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 3 {
+		t.Error("coroutine1 error")
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTString || b.Str().GetStdString() != "suspended" {
+		t.Error("coroutine1 error")
+	}
+	if c := GetGlobalValue(state, "c"); c.Type() != ValueTNumber || c.Num() != 20 {
+		t.Error("coroutine1 error")
+	}
+	if d := GetGlobalValue(state, "d"); d.Type() != ValueTString || d.Str().GetStdString() != "dead" {
+		t.Error("coroutine1 error")
+	}
+	if e := GetGlobalValue(state, "e"); !e.IsFalse() {
+		t.Error("coroutine1 error")
+	}
+}
+
+func TestCoroutine2(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local gen = coroutine.wrap(function()
+			for i = 1, 3 do coroutine.yield(i) end
+		end)
+		sum = gen() + gen() + gen()
+		yieldable = coroutine.isyieldable()
+		ok = pcall(coroutine.yield)
+	`, "coroutine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sum := GetGlobalValue(state, "sum"); sum.Type() != ValueTNumber || sum.Num() != 6 {
+		t.Error("coroutine2 error")
+	}
+	if yieldable := GetGlobalValue(state, "yieldable"); !yieldable.IsFalse() {
+		t.Error("coroutine2 error")
+	}
+	if ok := GetGlobalValue(state, "ok"); !ok.IsFalse() {
+		t.Error("coroutine2 error")
+	}
+}
+
+func TestCoroutine3(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local f = coroutine.wrap(function() error("oops") end)
+		f()
+	`, "coroutine")
+	if _, ok := err.(ScriptError); !ok {
+		t.Error("coroutine3 should be a ScriptError")
+	}
+	if state.GetCurrentThread().IsMain() == false {
+		t.Error("coroutine3 error")
+	}
+}
+
+func TestCoroutine4(t *testing.T) {
+	state := NewLibState()
+	var k CFunctionKType
+	k = func(state *State, ctx interface{}) int {
+		api := NewStackAPI(state)
+		sum := ctx.(float64) + api.GetNumber(-1)
+		if sum < 10 {
+			api.PushNumber(sum)
+			return api.YieldK(1, sum, k)
+		}
+		api.PushNumber(sum)
+		return 1
+	}
+	lib := NewLibrary(state)
+	lib.RegisterFunc("accumulate", func(state *State) int {
+		return k(state, float64(0))
+	})
+
+	err := state.TryDoString(`
+		local co = coroutine.wrap(function(n)
+			return "done", accumulate(n)
+		end)
+		a = co(1)
+		b = co(2)
+		c = co(3)
+		d, e = co(4)
+	`, "coroutine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 1 {
+		t.Error("coroutine4 error")
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTNumber || b.Num() != 3 {
+		t.Error("coroutine4 error")
+	}
+	if c := GetGlobalValue(state, "c"); c.Type() != ValueTNumber || c.Num() != 6 {
+		t.Error("coroutine4 error")
+	}
+	if d := GetGlobalValue(state, "d"); d.Type() != ValueTString || d.Str().GetStdString() != "done" {
+		t.Error("coroutine4 error")
+	}
+	if e := GetGlobalValue(state, "e"); e.Type() != ValueTNumber || e.Num() != 10 {
+		t.Error("coroutine4 error")
+	}
+}
+
+func TestCoroutine5(t *testing.T) {
+	state := NewLibState()
+	k := func(state *State, ctx interface{}) int {
+		api := NewStackAPI(state)
+		api.PushNumber(api.GetNumber(-1) + ctx.(float64))
+		return 1
+	}
+	lib := NewLibrary(state)
+	lib.RegisterFunc("addcall", func(state *State) int {
+		api := NewStackAPI(state)
+		n := api.GetNumber(1)
+		api.CallK(0, 0, 1, n, k)
+		return k(state, n)
+	})
+
+	err := state.TryDoString(`
+		local co = coroutine.create(function()
+			return addcall(function() return coroutine.yield(1) end, 100)
+		end)
+		local _
+		_, a = coroutine.resume(co)
+		_, b = coroutine.resume(co, 2)
+		c = addcall(function() return 3 end, 10)
+	`, "coroutine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 1 {
+		t.Error("coroutine5 error")
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTNumber || b.Num() != 102 {
+		t.Error("coroutine5 error")
+	}
+	if c := GetGlobalValue(state, "c"); c.Type() != ValueTNumber || c.Num() != 13 {
+		t.Error("coroutine5 error")
+	}
+}
+
+func TestCoroutine6(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local co = coroutine.create(function()
+			ok1, v1 = pcall(function()
+				local x = coroutine.yield(1)
+				return x + 1
+			end)
+			ok2, v2 = pcall(function()
+				coroutine.yield(2)
+				error("after resume", 0)
+			end)
+			ok3, v3 = xpcall(function()
+				coroutine.yield(3)
+				error({})
+			end, function(e) return "handled" end)
+			ok4, inner4, v4 = pcall(pcall, function()
+				coroutine.yield(4)
+				error("inner", 0)
+			end)
+			return "done"
+		end)
+		local _
+		_, y1 = coroutine.resume(co)
+		_, y2 = coroutine.resume(co, 10)
+		_, y3 = coroutine.resume(co)
+		_, y4 = coroutine.resume(co)
+		_, y5 = coroutine.resume(co)
+		status = coroutine.status(co)
+	`, "coroutine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index, name := range []string{"y1", "y2", "y3", "y4"} {
+		if y := GetGlobalValue(state, name); y.Type() != ValueTNumber || y.Num() != float64(index+1) {
+			t.Errorf("coroutine6 yield through pcall error: %s", name)
+		}
+	}
+	for name, expect := range map[string]string{
+		"y5": "done", "v2": "after resume", "v3": "handled", "v4": "inner", "status": "dead",
+	} {
+		if v := GetGlobalValue(state, name); v.Type() != ValueTString || v.Str().GetStdString() != expect {
+			t.Errorf("coroutine6 error: %s", name)
+		}
+	}
+	if v := GetGlobalValue(state, "v1"); v.Type() != ValueTNumber || v.Num() != 11 {
+		t.Error("coroutine6 error: v1")
+	}
+	for name, expect := range map[string]bool{
+		"ok1": true, "ok2": false, "ok3": false, "ok4": true, "inner4": false,
+	} {
+		if v := GetGlobalValue(state, name); v.IsFalse() == expect {
+			t.Errorf("coroutine6 error: %s", name)
+		}
+	}
+}
+
+func TestCoroutine7(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local mt = {
+			__index = function(t, k) return coroutine.yield(k) end,
+			__newindex = function(t, k, v) coroutine.yield(k) newkey = v end,
+			__add = function(a, b) return coroutine.yield("add") end,
+			__lt = function(a, b) return coroutine.yield("lt") end,
+			__eq = function(a, b) return coroutine.yield("eq") end,
+			__concat = function(a, b) return coroutine.yield("concat") end,
+		}
+		local co = coroutine.wrap(function()
+			local t = setmetatable({}, mt)
+			local u = setmetatable({}, mt)
+			a = t.foo
+			b = t + 1
+			c = t < u
+			d = t == u
+			e = t .. "x"
+			t.bar = 5
+		end)
+		r1 = co()
+		r2 = co("A")
+		r3 = co(7)
+		r4 = co(nil)
+		r5 = co(1)
+		r6 = co("cat")
+		co()
+	`, "coroutine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Metamethods yielded, then results of resume finished the instructions
+	for name, expect := range map[string]string{
+		"r1": "foo", "r2": "add", "r3": "lt", "r4": "eq", "r5": "concat", "r6": "bar",
+		"a": "A", "e": "cat",
+	} {
+		if v := GetGlobalValue(state, name); v.Type() != ValueTString || v.Str().GetStdString() != expect {
+			t.Errorf("coroutine7 error: %s", name)
+		}
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTNumber || b.Num() != 7 {
+		t.Error("coroutine7 error: b")
+	}
+	c := GetGlobalValue(state, "c")
+	d := GetGlobalValue(state, "d")
+	if c.Type() != ValueTBool || !c.IsFalse() || d.Type() != ValueTBool || d.IsFalse() {
+		t.Error("coroutine7 compare error")
+	}
+	if v := GetGlobalValue(state, "newkey"); v.Type() != ValueTNumber || v.Num() != 5 {
+		t.Error("coroutine7 error: newkey")
+	}
+}
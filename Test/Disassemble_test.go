@@ -0,0 +1,80 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble1(t *testing.T) {
+	state := NewState()
+	state.SetOptimize(false)
+	err := state.TryLoadString(`
+		local function counter(step, ...)
+			local n = 0
+			return function() n = n + step return n end
+		end
+		for i = 1, 2 do x = "x" .. 1.5 end
+	`, "listing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := state.Disassemble(&buf); err != nil {
+		t.Fatal(err)
+	}
+	listing := buf.String()
+
+	expects := []string{
+		"function <listing:1> (",
+		"function <listing:2> (4 instructions, 1 args, vararg)",
+		"function <listing:4> (",
+		"\t[0]\t2\tClosure     \t0 0\t; function <listing:2>",
+		"\t.Int        \t1\n",
+		"\t.Jmp        \t",
+		"\tConcat      \t5 5 6\n",
+		"\tSetGlobal   \t",
+		"; \"x\"\n",
+		"\t[3]\t1.5\n",
+		"\tGetUpvalue  \t0 0\t; n\n",
+		"\tSetUpvalue  \t0 0\t; n\n",
+		"\t[0]\tn\tlocal r1\n",
+		"\t[1]\tstep\tlocal r0\n",
+		"\tstep\tr0\t[0, ",
+		"upvalues (2):",
+	}
+	for _, expect := range expects {
+		if !strings.Contains(listing, expect) {
+			t.Errorf("listing should contain %q:\n%s", expect, listing)
+		}
+	}
+
+	// Listing of the loaded binary chunk is the same
+	if err := state.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	chunk := buf.Bytes()[len(listing):]
+	if err := state.TryLoadBinary(bytes.NewReader(chunk), "listing"); err != nil {
+		t.Fatal(err)
+	}
+	var loaded bytes.Buffer
+	if err := state.Disassemble(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.String() != listing {
+		t.Error("listing of loaded chunk is different")
+	}
+}
+
+func TestDisassemble2(t *testing.T) {
+	for op := OpTypeLoadNil; op <= OpTypeTailCall; op++ {
+		if !IsValidOpType(op) || GetOpTypeName(op) == "Unknown" {
+			t.Errorf("op type %d has no name", op)
+		}
+	}
+	if IsValidOpType(0) || IsValidOpType(OpTypeTailCall+1) {
+		t.Error("invalid op type error")
+	}
+}
@@ -3,6 +3,10 @@ package Test
 import (
 	"InterpreterVM/Source/vm"
 	"container/list"
+	"fmt"
+	"math/rand"
+	"testing"
+	"unsafe"
 )
 
 var gGC vm.GC
@@ -16,3 +20,633 @@ var (
 	gScopeClosure list.List
 	gScopeString  list.List
 )
+
+func TestGCFinalize(t *testing.T) {
+	gc := vm.NewGC(func(vm.GCObject, int) {})
+	destroyed := make(map[*vm.UserData]bool)
+	gc.SetFinalizeChecker(func(u *vm.UserData) bool { return !destroyed[u] })
+
+	var alive *vm.UserData
+	gc.SetRootTraveller(func(v vm.GCObjectVisitor) {
+		if alive != nil {
+			alive.Accept(v)
+		}
+	}, func(vm.GCObjectVisitor) {})
+
+	for i := 0; i < 512; i++ {
+		u := gc.NewUserData(vm.GCGen0)
+		if i == 0 {
+			alive = u
+		}
+	}
+	gc.CheckGC()
+
+	count := 0
+	for u := gc.PopFinalizeObject(); u != nil; u = gc.PopFinalizeObject() {
+		if u == alive {
+			t.Error("gc finalize error")
+		}
+		destroyed[u] = true
+		count++
+	}
+	if count != 511 {
+		t.Error("gc finalize error")
+	}
+}
+
+func TestGCObjectLimit(t *testing.T) {
+	gc := vm.NewGC(func(vm.GCObject, int) {})
+
+	var alive []*vm.Table
+	root := func(v vm.GCObjectVisitor) {
+		for _, table := range alive {
+			table.Accept(v)
+		}
+	}
+	gc.SetRootTraveller(root, root)
+
+	for i := 0; i < 200; i++ {
+		table := gc.NewTAble(vm.GCGen0)
+		if i < 50 {
+			alive = append(alive, table)
+		}
+	}
+
+	// Unreachable objects are collected when the limit exceeded
+	if !gc.CheckObjectLimit(100) || gc.GetObjectCount() != 50 {
+		t.Error("gc object limit error")
+	}
+	if gc.CheckObjectLimit(40) || gc.GetObjectCount() != 50 {
+		t.Error("gc object limit error")
+	}
+}
+
+func TestGCStats(t *testing.T) {
+	gc := vm.NewGC(func(vm.GCObject, int) {})
+
+	var alive []*vm.Table
+	root := func(v vm.GCObjectVisitor) {
+		for _, table := range alive {
+			table.Accept(v)
+		}
+	}
+	gc.SetRootTraveller(root, root)
+
+	for i := 0; i < 512; i++ {
+		table := gc.NewTAble(vm.GCGen0)
+		if i < 10 {
+			alive = append(alive, table)
+		}
+	}
+	gc.CheckGC()
+
+	stats := gc.Stats()
+	if stats.MinorCollections != 1 || stats.MajorCollections != 0 ||
+		stats.Gen0.Count != 0 || stats.Gen1.Count != 10 || stats.Gen0.Threshold == 0 {
+		t.Errorf("gc stats error: %+v", stats)
+	}
+
+	// Stopped GC is not triggered, but it can be run explicitly
+	gc.Stop()
+	for i := 0; i < 512; i++ {
+		gc.NewTAble(vm.GCGen0)
+	}
+	gc.CheckGC()
+	if stats = gc.Stats(); stats.MinorCollections != 1 || stats.Gen0.Count != 512 {
+		t.Errorf("gc stop error: %+v", stats)
+	}
+	gc.FullGC()
+	if stats = gc.Stats(); stats.MajorCollections != 1 || gc.GetObjectCount() != 10 {
+		t.Errorf("gc full error: %+v", stats)
+	}
+
+	// All generations are collected in incremental mode
+	gc.Restart()
+	if old := gc.SetMode(vm.GCModeIncremental); old != vm.GCModeGenerational {
+		t.Error("gc mode error")
+	}
+	for i := 0; i < 512; i++ {
+		gc.NewTAble(vm.GCGen0)
+	}
+	gc.CheckGC()
+	if stats = gc.Stats(); stats.MajorCollections != 2 || stats.MinorCollections != 1 {
+		t.Errorf("gc incremental error: %+v", stats)
+	}
+}
+
+func TestGCObserver(t *testing.T) {
+	gc := vm.NewGC(func(vm.GCObject, int) {})
+	gc.SetRootTraveller(func(vm.GCObjectVisitor) {}, func(vm.GCObjectVisitor) {})
+
+	var events []vm.GCEvent
+	gc.SetObserver(vm.GCObserverFunc(func(event vm.GCEvent) {
+		events = append(events, event)
+	}))
+
+	for i := 0; i < 512; i++ {
+		gc.NewTAble(vm.GCGen0)
+	}
+	gc.CheckGC()
+	gc.NewTAble(vm.GCGen0)
+	gc.FullGC()
+
+	if len(events) != 2 {
+		t.Fatalf("gc observer error: %d events", len(events))
+	}
+	minor, major := events[0], events[1]
+	if minor.Major || minor.Before.Gen0.Count != 512 || minor.After.Gen0.Count != 0 ||
+		minor.Before.Gen0.Threshold != 512 || minor.Duration < 0 {
+		t.Errorf("gc minor event error: %+v", minor)
+	}
+	if !major.Major || major.Before.Gen0.Count != 1 || major.After.Gen0.Count != 0 {
+		t.Errorf("gc major event error: %+v", major)
+	}
+
+	// No event after the observer is removed
+	gc.SetObserver(nil)
+	gc.FullGC()
+	if len(events) != 2 {
+		t.Error("gc observer remove error")
+	}
+}
+
+func TestGCCollectGarbage(t *testing.T) {
+	state := NewLibState()
+
+	err := state.TryDoString(`
+		r1 = collectgarbage("stop")
+		for i = 1, 1000 do local t = {} end
+		before = collectgarbage("count")
+		r2 = collectgarbage()
+		after = collectgarbage("count")
+		r3 = collectgarbage("step")
+		r4 = collectgarbage("restart")
+		m1 = collectgarbage("incremental")
+		m2 = collectgarbage("generational")
+		ok = pcall(collectgarbage, "unknown")
+	`, "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := GetGlobalValue(state, "before")
+	after := GetGlobalValue(state, "after")
+	// Count is in Kbytes, and each collected table is counted
+	tables := 999 * float64(unsafe.Sizeof(vm.Table{})) / 1024
+	if before.Type() != vm.ValueTNumber || before.Num()-after.Num() < tables {
+		t.Errorf("collectgarbage count error: %v %v", before.Num(), after.Num())
+	}
+	for name, expect := range map[string]vm.Value{
+		"r1": vm.NewValueInt(0), "r2": vm.NewValueInt(0), "r3": vm.NewValueBValue(true),
+		"r4": vm.NewValueInt(0), "ok": vm.NewValueBValue(false),
+	} {
+		if v := GetGlobalValue(state, name); !v.IsEqual(&expect) {
+			t.Errorf("collectgarbage %s error", name)
+		}
+	}
+	m1 := GetGlobalValue(state, "m1")
+	m2 := GetGlobalValue(state, "m2")
+	if m1.Type() != vm.ValueTString || m1.Str().GetStdString() != "generational" ||
+		m2.Type() != vm.ValueTString || m2.Str().GetStdString() != "incremental" {
+		t.Error("collectgarbage mode error")
+	}
+	if stats := state.GetGC().Stats(); stats.MajorCollections < 1 {
+		t.Errorf("collectgarbage stats error: %+v", stats)
+	}
+}
+
+// Visitor collects all objects reachable from roots
+type reachableVisitor struct {
+	objects map[vm.GCObject]bool
+}
+
+func (r *reachableVisitor) visit(obj vm.GCObject) bool {
+	if r.objects[obj] {
+		return false
+	}
+	r.objects[obj] = true
+	return true
+}
+
+func (r *reachableVisitor) VisitTable(table *vm.Table) bool          { return r.visit(table) }
+func (r *reachableVisitor) VisitFunction(function *vm.Function) bool { return r.visit(function) }
+func (r *reachableVisitor) VisitClosure(closure *vm.Closure) bool    { return r.visit(closure) }
+func (r *reachableVisitor) VisitUpvalue(value *vm.Upvalue) bool      { return r.visit(value) }
+func (r *reachableVisitor) VisitString(str *vm.String) bool          { return r.visit(str) }
+func (r *reachableVisitor) VisitUserData(userData *vm.UserData) bool { return r.visit(userData) }
+func (r *reachableVisitor) VisitThread(thread *vm.Thread) bool       { return r.visit(thread) }
+
+// Mutate a random object graph between small steps of GC, and check no
+// reachable object is deleted
+func stressGC(t *testing.T, mode int, seed int64) {
+	deleted := make(map[vm.GCObject]bool)
+	gc := vm.NewGC(func(obj vm.GCObject, _ int) { deleted[obj] = true })
+	gc.SetMode(mode)
+	gc.SetStepSize(16)
+	gc.SetPauseTarget(0)
+
+	// Registers are roots which are changed without barrier
+	root := gc.NewTAble(vm.GCGen0)
+	registers := make([]vm.Value, 8)
+	traveller := func(v vm.GCObjectVisitor) {
+		root.Accept(v)
+		for index := range registers {
+			registers[index].Accept(v)
+		}
+	}
+	gc.SetRootTraveller(traveller, traveller)
+
+	const slots = 16
+	rnd := rand.New(rand.NewSource(seed))
+	key := func() vm.Value { return vm.NewValueInt(int64(rnd.Intn(slots) + 1)) }
+	newValue := func() vm.Value {
+		switch rnd.Intn(4) {
+		case 0:
+			str := gc.NewString(vm.GCGen0)
+			str.SetValue(fmt.Sprint(rnd.Int()))
+			return vm.NewValueString(str)
+		case 1:
+			upvalue := gc.NewUpvalue(vm.GCGen0)
+			v := vm.NewValueTable(gc.NewTAble(vm.GCGen0))
+			upvalue.SetValue(&v)
+			return vm.NewValueUpvalue(upvalue)
+		default:
+			return vm.NewValueTable(gc.NewTAble(vm.GCGen0))
+		}
+	}
+	// Some tables of the first level are weak, entries of them are
+	// removed when they are not reachable from others
+	weakModes := make(map[*vm.Table]int)
+	gc.SetWeakModeChecker(func(table *vm.Table) (bool, bool) {
+		mode := weakModes[table]
+		return mode&1 != 0, mode&2 != 0
+	})
+	meta := gc.NewTAble(vm.GCGen0)
+	for i := 1; i <= slots; i++ {
+		table := gc.NewTAble(vm.GCGen0)
+		if mode := i % 4; mode != 0 {
+			weakModes[table] = mode
+			table.SetMetaTable(meta)
+		}
+		root.SetValue(vm.NewValueInt(int64(i)), vm.NewValueTable(table))
+	}
+
+	// Get a random table of the first level or the second level
+	randomTable := func() *vm.Table {
+		v := root.GetValue(key())
+		table := v.Table()
+		if inner := table.GetValue(key()); inner.Type() == vm.ValueTTable && rnd.Intn(2) == 0 {
+			return inner.Table()
+		}
+		return table
+	}
+	randomValue := func() vm.Value {
+		return randomTable().GetValue(key())
+	}
+
+	check := func() {
+		visitor := reachableVisitor{make(map[vm.GCObject]bool)}
+		traveller(&visitor)
+		for obj := range visitor.objects {
+			if deleted[obj] {
+				t.Fatalf("reachable object %T is deleted", obj)
+			}
+		}
+	}
+
+	for i := 0; i < 30000; i++ {
+		switch rnd.Intn(8) {
+		case 0:
+			v := root.GetValue(key())
+			v.Table().SetValue(key(), newValue())
+		case 1, 2, 3:
+			randomTable().SetValue(key(), newValue())
+		case 4:
+			// Store old object into young object and young object
+			// into old object
+			randomTable().SetValue(key(), randomValue())
+		case 5:
+			randomTable().SetValue(key(), vm.NewValueObj())
+		case 6:
+			// Move a value into registers only
+			table := randomTable()
+			k := key()
+			registers[rnd.Intn(len(registers))] = table.GetValue(k)
+			table.SetValue(k, vm.NewValueObj())
+		case 7:
+			randomTable().SetValue(key(), registers[rnd.Intn(len(registers))])
+		}
+		gc.CheckGC()
+		if i%10 == 0 {
+			check()
+		}
+	}
+	gc.FullGC()
+	check()
+
+	stats := gc.Stats()
+	if stats.MajorCollections == 0 || len(deleted) == 0 {
+		t.Errorf("gc stress error: %+v", stats)
+	}
+}
+
+func TestGCStress(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		stressGC(t, vm.GCModeIncremental, seed)
+		stressGC(t, vm.GCModeGenerational, seed)
+	}
+}
+
+func TestGCIncremental(t *testing.T) {
+	gc := vm.NewGC(func(vm.GCObject, int) {})
+	var alive []*vm.Table
+	root := func(v vm.GCObjectVisitor) {
+		for _, table := range alive {
+			table.Accept(v)
+		}
+	}
+	gc.SetRootTraveller(root, root)
+	gc.SetMode(vm.GCModeIncremental)
+	gc.SetStepSize(64)
+
+	var events []vm.GCEvent
+	gc.SetObserver(vm.GCObserverFunc(func(event vm.GCEvent) {
+		events = append(events, event)
+	}))
+
+	for i := 0; i < 2000; i++ {
+		table := gc.NewTAble(vm.GCGen0)
+		if i%2 == 0 {
+			alive = append(alive, table)
+		}
+	}
+
+	// Major collection is done in many bounded steps
+	steps := 1
+	for !gc.Step() {
+		if !gc.IsCollecting() {
+			t.Fatal("gc incremental error")
+		}
+		steps++
+	}
+	if steps < 2 || gc.IsCollecting() || gc.GetObjectCount() != 1000 {
+		t.Errorf("gc incremental error: %d steps %d objects", steps, gc.GetObjectCount())
+	}
+	if len(events) != 1 || !events[0].Major || events[0].Steps != uint(steps) ||
+		events[0].Before.Gen0.Count != 2000 || events[0].After.Gen1.Count != 1000 {
+		t.Errorf("gc incremental event error: %+v", events)
+	}
+	if stats := gc.Stats(); stats.MaxPause > stats.MajorPause {
+		t.Errorf("gc incremental stats error: %+v", stats)
+	}
+
+	// Full GC finishes the collection in progress
+	gc.Step()
+	alive = alive[:10]
+	gc.FullGC()
+	if gc.IsCollecting() || gc.GetObjectCount() != 10 || len(events) != 3 {
+		t.Errorf("gc full error: %d objects %d events", gc.GetObjectCount(), len(events))
+	}
+}
+
+func TestGCIncrementalScript(t *testing.T) {
+	for _, mode := range []int{vm.GCModeIncremental, vm.GCModeGenerational} {
+		state := NewLibState()
+		gc := state.GetGC()
+		gc.SetMode(mode)
+		gc.SetStepSize(8)
+
+		var steps uint
+		gc.SetObserver(vm.GCObserverFunc(func(event vm.GCEvent) {
+			if event.Steps > steps {
+				steps = event.Steps
+			}
+		}))
+
+		err := state.TryDoString(`
+			local keys = {}
+			local old = {}
+			for i = 1, 2000 do
+				local k = "key" .. i
+				keys[i] = k
+				old[k] = i
+			end
+
+			local counters = {}
+			for i = 1, 100 do
+				local n, s = 0, "c0"
+				counters[i] = function()
+					if s ~= "c" .. n then bad = true end
+					n = n + 1
+					s = "c" .. n
+				end
+			end
+
+			local co = coroutine.create(function()
+				local s = "s0"
+				for i = 1, 20000 do
+					if s ~= "s" .. (i - 1) then bad = true end
+					s = "s" .. i
+					coroutine.yield()
+				end
+			end)
+
+			local last = "g0"
+			for i = 1, 20000 do
+				local g = "g" .. (i % 10)
+				if last ~= "g" .. ((i - 1) % 10) then bad = true end
+				last = g
+				coroutine.resume(co)
+				old[keys[i % 2000 + 1]] = {"v" .. i}
+				counters[i % 100 + 1]()
+				local garbage = {"x" .. i}
+			end
+
+			for i = 1, 2000 do
+				local v = old["key" .. i]
+				if type(v) ~= "table" or v[1] ~= "v" .. (20000 - (20001 - i) % 2000) then bad = true end
+			end
+			for i = 1, 100 do
+				counters[i]()
+			end
+		`, "gc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bad := GetGlobalValue(state, "bad"); !bad.IsNil() {
+			t.Errorf("gc script error in mode %d", mode)
+		}
+		if mode == vm.GCModeIncremental && steps < 2 {
+			t.Error("gc script is not collected incrementally")
+		}
+	}
+}
+
+func TestGCWeakTable(t *testing.T) {
+	// Weak tables are cleared by major collection and minor collection
+	for _, collect := range []string{`collectgarbage()`, `collectgarbage("step")`} {
+		state := NewLibState()
+
+		err := state.TryDoString(`
+			wk = setmetatable({}, {__mode = "k"})
+			wv = setmetatable({}, {__mode = "v"})
+			wkv = setmetatable({}, {__mode = "kv"})
+			strong = {}
+
+			local function fill()
+				for i = 1, 10 do
+					local k = {}
+					wk[k] = i
+					wv[i] = {}
+					wkv[k] = {}
+					if i <= 3 then strong[i] = k end
+				end
+				wv.s = "str" .. 1
+				wk.key = {}
+
+				for i = 1, 5 do
+					local k = {}
+					wk[k] = {k}
+				end
+
+				local k = {}
+				wk[strong[1]] = k
+				wk[k] = "chain"
+			end
+
+			local function count(t)
+				local n = 0
+				for _ in pairs(t) do n = n + 1 end
+				return n
+			end
+
+			fill()
+			`+collect+`
+			nwk, nwv, nwkv = count(wk), count(wv), count(wkv)
+			chain = wk[wk[strong[1]]]
+			s = wv.s
+		`, "gc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, expect := range map[string]int64{"nwk": 5, "nwv": 1, "nwkv": 0} {
+			if v := GetGlobalValue(state, name); !v.IsInteger() || v.Int() != expect {
+				t.Errorf("%s weak table %s error: %v", collect, name, v.Int())
+			}
+		}
+		if chain := GetGlobalValue(state, "chain"); chain.Type() != vm.ValueTString ||
+			chain.Str().GetStdString() != "chain" {
+			t.Errorf("%s ephemeron error", collect)
+		}
+		if s := GetGlobalValue(state, "s"); s.Type() != vm.ValueTString {
+			t.Errorf("%s weak string error", collect)
+		}
+	}
+}
+
+// Go resource attached to user data, it records its name when closed
+type gcResource struct {
+	name   string
+	closed *[]string
+}
+
+func (r *gcResource) Close() error {
+	*r.closed = append(*r.closed, r.name)
+	return nil
+}
+
+func TestGCUserDataDestroy(t *testing.T) {
+	state := NewLibState()
+
+	var closed, finalized []string
+	lib := vm.NewLibrary(state)
+	lib.RegisterFunc("newobj", func(state *vm.State) int {
+		api := vm.NewStackAPI(state)
+		var metaTable *vm.Table
+		if api.GetStackSize() > 1 {
+			metaTable = api.GetTable(1)
+		}
+		resource := &gcResource{name: api.GetCString(0), closed: &closed}
+		api.PushUserData(state.NewUserDataValue(resource, metaTable))
+		return 1
+	})
+	lib.RegisterFunc("onfinalize", func(state *vm.State) int {
+		api := vm.NewStackAPI(state)
+		name := api.GetUserData(0).Value().(*gcResource).name
+		finalized = append(finalized, name)
+		api.PushString(name)
+		return 1
+	})
+
+	// Destroyer is called when user data is swept, destroyer of user data
+	// marked destroyed is never called
+	userData := state.NewUserData()
+	userData.SetDestroyer(func(unsafe.Pointer) { closed = append(closed, "x") })
+	released := state.NewUserData()
+	released.SetDestroyer(func(unsafe.Pointer) { closed = append(closed, "released") })
+	released.MarkDestroyed()
+	userData, released = nil, nil
+
+	check := func(step, expectFinalized, expectClosed string) {
+		t.Helper()
+		if fmt.Sprint(finalized) != expectFinalized || fmt.Sprint(closed) != expectClosed {
+			t.Errorf("gc %s error: finalized %v closed %v", step, finalized, closed)
+		}
+	}
+
+	// Finalizers are called in reverse order of creation, user data "b"
+	// is resurrected by its finalizer. Registers which held the user data
+	// are left above the stack top by the call of type, and they are not
+	// live any more
+	err := state.TryDoString(`
+		mt = {__gc = function(u)
+			if onfinalize(u) == "b" then saved = u end
+		end}
+
+		local function create()
+			do
+				local a = newobj("a", mt)
+				local b = newobj("b", mt)
+				local c = newobj("c", mt)
+				local d = newobj("d")
+			end
+			return type(nil)
+		end
+
+		create()
+		collectgarbage()
+	`, "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("finalize", "[c b a]", "[d x]")
+
+	// Finalized user data are destroyed by next collection, except the
+	// resurrected one
+	state.FullGC()
+	check("destroy", "[c b a]", "[d x a c]")
+	if saved := GetGlobalValue(state, "saved"); saved.Type() != vm.ValueTUserData ||
+		saved.UserData().IsDestroyed() {
+		t.Error("gc resurrection error")
+	}
+
+	// Resurrected user data is not finalized again
+	if err := state.TryDoString(`saved = nil collectgarbage()`, "gc"); err != nil {
+		t.Fatal(err)
+	}
+	check("resurrection destroy", "[c b a]", "[d x a c b]")
+
+	// All user data are finalized and destroyed when state is closed
+	if err := state.TryDoString(`
+		k1 = newobj("e", mt)
+		k2 = newobj("f", mt)
+		k3 = newobj("g")
+	`, "gc"); err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+	check("close", "[c b a f e]", "[d x a c b g f e]")
+	state.Close()
+	check("close again", "[c b a f e]", "[d x a c b g f e]")
+}
@@ -237,3 +237,39 @@ func TestLex7(t *testing.T) {
 		t.Error("lex7 error")
 	}
 }
+
+func TestLex8(t *testing.T) {
+	lexer := NewLexerWrapper("// & | ~ << >> 9007199254740993 0xffffffffffffffff " +
+		"9223372036854775808 3.0 0x10")
+	tokens := []int{TokenIDiv, '&', '|', '~', TokenShiftLeft, TokenShiftRight}
+	for _, expect := range tokens {
+		if token, _ := lexer.GetToken(); token != expect {
+			t.Error("lex8 error")
+		}
+	}
+
+	var detail TokenDetail
+	numbers := []struct {
+		isInteger bool
+		integer   int64
+		number    float64
+	}{
+		{true, 9007199254740993, 0},
+		{true, -1, 0},
+		{false, 0, 9223372036854775808},
+		{false, 0, 3},
+		{true, 16, 0},
+	}
+	for _, expect := range numbers {
+		if token, _ := lexer.lexer.GetToken(&detail); token != TokenNumber ||
+			detail.IsInteger != expect.isInteger ||
+			(expect.isInteger && detail.Integer != expect.integer) ||
+			(!expect.isInteger && detail.Number != expect.number) {
+			t.Error("lex8 error")
+		}
+	}
+
+	if token, _ := lexer.GetToken(); token != TokenEOF {
+		t.Error("lex8 error")
+	}
+}
@@ -0,0 +1,147 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"testing"
+)
+
+func TestMetaTable1(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local Base = {}
+		Base.__index = Base
+		function Base.new(x) return setmetatable({x = x}, Base) end
+		function Base:get() return self.x end
+		local b = Base.new(5)
+		a = b:get()
+		same = getmetatable(b) == Base
+		none = getmetatable({})
+	`, "metatable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 5 {
+		t.Error("metatable1 error")
+	}
+	if same := GetGlobalValue(state, "same"); same.IsFalse() {
+		t.Error("metatable1 error")
+	}
+	if none := GetGlobalValue(state, "none"); !none.IsNil() {
+		t.Error("metatable1 error")
+	}
+}
+
+func TestMetaTable2(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local d = setmetatable({}, {__index = function(t, k) return k .. "!" end})
+		a = d.foo
+		local p = setmetatable({}, {__newindex = function(t, k, v) key = k end})
+		p.b = 1
+		b = p.b
+	`, "metatable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTString || a.Str().GetStdString() != "foo!" {
+		t.Error("metatable2 error")
+	}
+	if key := GetGlobalValue(state, "key"); key.Type() != ValueTString || key.Str().GetStdString() != "b" {
+		t.Error("metatable2 error")
+	}
+	if b := GetGlobalValue(state, "b"); !b.IsNil() {
+		t.Error("metatable2 error")
+	}
+}
+
+func TestMetaTable3(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local t = setmetatable({}, {})
+		getmetatable(t).__index = t
+		local v = t.x
+	`, "metatable")
+	if _, ok := err.(RuntimeError); !ok {
+		t.Error("metatable3 should be a RuntimeError")
+	}
+}
+
+func TestMetaTable4(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local V = {}
+		local function new(x) return setmetatable({x = x}, V) end
+		V.__add = function(a, b) return new(a.x + b.x) end
+		V.__unm = function(a) return new(-a.x) end
+		V.__eq = function(a, b) return a.x == b.x end
+		V.__lt = function(a, b) return a.x < b.x end
+		V.__len = function(a) return a.x end
+		V.__concat = function(a, b) return "v" .. b end
+		a = (new(1) + new(2)).x
+		b = (-new(1)).x
+		c = new(1) == new(1)
+		d = new(2) >= new(1)
+		e = #new(7)
+		f = new(1) .. "x"
+	`, "metatable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 3 {
+		t.Error("metatable4 error")
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTNumber || b.Num() != -1 {
+		t.Error("metatable4 error")
+	}
+	if c := GetGlobalValue(state, "c"); c.IsFalse() {
+		t.Error("metatable4 error")
+	}
+	if d := GetGlobalValue(state, "d"); d.IsFalse() {
+		t.Error("metatable4 error")
+	}
+	if e := GetGlobalValue(state, "e"); e.Type() != ValueTNumber || e.Num() != 7 {
+		t.Error("metatable4 error")
+	}
+	if f := GetGlobalValue(state, "f"); f.Type() != ValueTString || f.Str().GetStdString() != "vx" {
+		t.Error("metatable4 error")
+	}
+}
+
+func TestMetaTable5(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString("local t = {} local a = t + 1", "metatable")
+	if e, ok := err.(RuntimeError); !ok || e.Kind != RuntimeErrorKindBinaryOp {
+		t.Error("metatable5 should be a RuntimeError")
+	}
+}
+
+func TestMetaTable6(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local f = setmetatable({}, {__call = function(self, a, b) return a + b end})
+		a = f(1, 2)
+		local p = setmetatable({}, {__tostring = function() return "p" end, __metatable = "locked"})
+		b = tostring(p)
+		c = getmetatable(p)
+		d = pcall(setmetatable, p, {})
+	`, "metatable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 3 {
+		t.Error("metatable6 error")
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTString || b.Str().GetStdString() != "p" {
+		t.Error("metatable6 error")
+	}
+	if c := GetGlobalValue(state, "c"); c.Type() != ValueTString || c.Str().GetStdString() != "locked" {
+		t.Error("metatable6 error")
+	}
+	if d := GetGlobalValue(state, "d"); !d.IsFalse() {
+		t.Error("metatable6 error")
+	}
+}
@@ -0,0 +1,103 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"testing"
+)
+
+func checkGlobalString(t *testing.T, state *State, name, expect string) {
+	t.Helper()
+	if v := GetGlobalValue(state, name); v.Type() != ValueTString ||
+		v.Str().GetStdString() != expect {
+		t.Errorf("%s is not %q: %v", name, expect, v.Str().GetStdString())
+	}
+}
+
+func TestNumber1(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local a = 9007199254740993
+		s1 = tostring(a)
+		s2 = string.format("%d %5i %x %X %o %c", a, 42, 255, -1, 8, 65)
+		s3 = a .. "," .. (a + 1) .. "," .. (a - 1)
+		s4 = string.format("%s %s %.3f %q", a, 1.5, 2, "a\"b")
+		s5 = tostring(math.maxinteger + 1 == math.mininteger)
+		types = math.type(1) .. " " .. math.type(1.0) .. " " .. math.type(1 + 1.0) ..
+			" " .. math.type(2 * 3) .. " " .. math.type(6 / 3) .. " " .. math.type(2 ^ 2) ..
+			" " .. tostring(math.type("1"))
+		converts = tostring(math.tointeger(3.0)) .. " " .. tostring(math.tointeger(3.5)) ..
+			" " .. math.type(math.floor(3.7)) .. " " .. math.floor(-3.5) .. " " .. math.ceil(3.2) ..
+			" " .. math.type(math.max(1, 2.5, 2)) .. " " .. math.abs(-3) .. " " .. #"abc"
+		local s = ""
+		for i = 1, 3 do s = s .. math.type(i) .. i end
+		loop = s
+		ok, msg = pcall(string.format, "%d", 1.5)
+	`, "number")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGlobalString(t, state, "s1", "9007199254740993")
+	checkGlobalString(t, state, "s2", "9007199254740993    42 ff FFFFFFFFFFFFFFFF 10 A")
+	checkGlobalString(t, state, "s3", "9007199254740993,9007199254740994,9007199254740992")
+	checkGlobalString(t, state, "s4", "9007199254740993 1.5 2.000 \"a\\\"b\"")
+	checkGlobalString(t, state, "s5", "true")
+	checkGlobalString(t, state, "types", "integer float float integer float float nil")
+	checkGlobalString(t, state, "converts", "3 nil integer -4 4 float 3 3")
+	checkGlobalString(t, state, "loop", "integer1integer2integer3")
+	checkGlobalString(t, state, "msg",
+		"bad argument #2 to 'format' (number has no integer representation)")
+}
+
+func TestNumber2(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		div = (7 // 2) .. " " .. (-7 // 2) .. " " .. math.type(7.0 // 2) .. " " .. (7 / 2)
+		mod = (-7 % 3) .. " " .. (7 % -3) .. " " .. (5.5 % -2) .. " " .. (-6 % 3)
+		bits = (0xF0 & 0x3C) .. " " .. (0xF0 | 0x3C) .. " " .. (0xF0 ~ 0x3C) .. " " .. ~0 ..
+			" " .. tostring(1 << 63 == math.mininteger) .. " " .. (1 << 64) .. " " .. (-1 >> 60) ..
+			" " .. (1 << -1) .. " " .. (3.0 & 1) .. " " .. (1 | 2 ~ 3 & 4 << 1)
+		compare = tostring(2 ^ 53 < 9007199254740993) .. " " ..
+			tostring(math.maxinteger < 2 ^ 63) .. " " ..
+			tostring(math.maxinteger == 2 ^ 63) .. " " ..
+			tostring(math.maxinteger + 0.0 == 2 ^ 63) .. " " ..
+			tostring(1 == 1.0) .. " " .. tostring(-1 <= -1.5)
+		ok1, msg1 = pcall(function() return 1 // 0 end)
+		ok2, msg2 = pcall(function() return 1 % 0 end)
+		ok3, msg3 = pcall(function() return 1.5 & 1 end)
+		inf = tostring(1 // 0.0 > 0)
+	`, "number")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGlobalString(t, state, "div", "3 -4 float 3.5")
+	checkGlobalString(t, state, "mod", "2 -2 -0.5 0")
+	checkGlobalString(t, state, "bits", "48 252 204 -1 true 0 15 0 1 3")
+	checkGlobalString(t, state, "compare", "true true false true true false")
+	checkGlobalString(t, state, "msg1", "number:12: attempt to perform 'n//0'")
+	checkGlobalString(t, state, "msg2", "number:13: attempt to perform 'n%0'")
+	checkGlobalString(t, state, "msg3", "number:14: number has no integer representation")
+	checkGlobalString(t, state, "inf", "true")
+}
+
+func TestNumber3(t *testing.T) {
+	state := NewLibState()
+	err := state.TryDoString(`
+		local two = 2.0
+		concat = "x" .. 1e20 .. " " .. 2 ^ 63 .. " " .. two .. " " .. -two .. " " ..
+			0.1 .. " " .. 1 / 0 .. " " .. -1 / 0
+		folded = "y" .. 2.0 .. " " .. 1e20
+		str = tostring(1e20) .. " " .. tostring(2 ^ 63) .. " " .. tostring(two) ..
+			" " .. tostring(3)
+		format = string.format("%s %s", 2 ^ 63, two)
+	`, "number")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGlobalString(t, state, "concat", "x1e+20 9.2233720368548e+18 2.0 -2.0 0.1 inf -inf")
+	checkGlobalString(t, state, "folded", "y2.0 1e+20")
+	checkGlobalString(t, state, "str", "1e+20 9.2233720368548e+18 2.0 3")
+	checkGlobalString(t, state, "format", "9.2233720368548e+18 2.0")
+}
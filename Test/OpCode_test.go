@@ -0,0 +1,81 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOpCode1(t *testing.T) {
+	i := ABCCode(OpTypeGreaterEqual, 250, RKConst(MaxRKConstIndex), 249)
+	if GetOpCode(i) != OpTypeGreaterEqual || GetParamA(i) != 250 ||
+		GetParamB(i) != RKConst(MaxRKConstIndex) || GetParamC(i) != 249 {
+		t.Error("ABC instruction encoding error")
+	}
+	if !IsRKConst(GetParamB(i)) || GetRKConstIndex(GetParamB(i)) != MaxRKConstIndex || IsRKConst(GetParamC(i)) {
+		t.Error("RK operand encoding error")
+	}
+
+	i = AsBxCode(OpTypeJmpFalse, 255, -32768)
+	if GetOpCode(i) != OpTypeJmpFalse || GetParamA(i) != 255 || GetParamsBx(i) != -32768 {
+		t.Error("AsBx instruction encoding error")
+	}
+	i.RefillsBx(32767)
+	i.RefillA(7)
+	if GetOpCode(i) != OpTypeJmpFalse || GetParamA(i) != 7 || GetParamsBx(i) != 32767 {
+		t.Error("refill instruction error")
+	}
+
+	i = ABxCode(OpTypeLoadConst, 1, 65535)
+	if GetOpCode(i) != OpTypeLoadConst || GetParamA(i) != 1 || GetParamBx(i) != 65535 {
+		t.Error("ABx instruction encoding error")
+	}
+}
+
+func TestOpCode2(t *testing.T) {
+	// Const and local variable operands are referenced directly
+	script := `local a = 1 local b = a + 1 local c = 2 * a local d = a == nil`
+	listing := listScript(t, script, true)
+	for _, expect := range []string{"\tAdd         \t1 0 k1\t; 1\n",
+		"\tMul         \t2 k2 0\t; 2\n", "\tEqual       \t3 0 k3\t; nil\n"} {
+		if !strings.Contains(listing, expect) {
+			t.Errorf("listing should contain %q:\n%s", expect, listing)
+		}
+	}
+	if strings.Count(listing, "LoadConst") != 1 || strings.Contains(listing, "Move") {
+		t.Errorf("operands are loaded into registers:\n%s", listing)
+	}
+
+	// Operands are loaded into registers without the optimizer
+	listing = listScript(t, script, false)
+	if strings.Contains(listing, "k1") || !strings.Contains(listing, "Move") {
+		t.Errorf("operands are referenced directly:\n%s", listing)
+	}
+
+	// Left local variable is read before calculating the right expression
+	// which may change it, and functions which have more const values
+	// than RK operands can reference work too
+	var rkScript strings.Builder
+	rkScript.WriteString(`
+		local a = 1
+		local function f() a = 10 return 1 end
+		r1 = a + f()
+		r2 = f() + a
+		local x = 0
+	`)
+	for n := 0; n <= MaxRKConstIndex+10; n++ {
+		fmt.Fprintf(&rkScript, "x = x + %d\n", n%3)
+	}
+	rkScript.WriteString("r3 = x")
+
+	state := NewLibState()
+	if err := state.TryDoString(rkScript.String(), "rk"); err != nil {
+		t.Fatal(err)
+	}
+	for name, expect := range map[string]int64{"r1": 2, "r2": 11, "r3": 265} {
+		if v := GetGlobalValue(state, name); !v.IsInteger() || v.Int() != expect {
+			t.Errorf("%s should be %d", name, expect)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const optimizeScript = `
+	local r = {}
+	local function add(v) r[#r + 1] = tostring(v) end
+	add(2 * 3 + 1) add(7 // 2) add(-7 // 2) add(7.0 // 2) add(3 % -2) add(5.5 % 2)
+	add(1 / 2) add(2 ^ 10) add(1 << 63) add(1 << 64) add(-1 >> 1) add(~0) add(5 & 3 | 8 ~ 1)
+	add(-(-9223372036854775807 - 1)) add("a" .. 1 .. "b" .. 1.5) add(#"abc")
+	add(not nil) add(not 0) add(1 == 1.0) add("a" ~= "a") add(1 < 1.5) add(2 >= 3)
+	add(nil and 1) add(false or "x") add(1 and 2) add(nil or false)
+	local a, b = 1, 2
+	a, b = b, a
+	add(a .. "," .. b)
+	local c = a
+	c = c + 1
+	add(c)
+	local fs = {}
+	local i = 0
+	while true do
+		i = i + 1
+		if i > 3 then break end
+		local j = i * 10
+		fs[i] = function() return j end
+	end
+	add(fs[1]() + fs[2]() + fs[3]())
+	local function f(n)
+		if n > 0 then return n end
+		do return -n end
+		return 0
+	end
+	add(f(4) + f(-5))
+	local s = 0
+	for k = 1, 10 do
+		if k % 2 == 0 then s = s + k else s = s - 1 end
+	end
+	add(s)
+	result = r
+`
+
+// Run optimizeScript and return the results joined by ' '
+func runOptimizeScript(t *testing.T, optimize bool) string {
+	t.Helper()
+	state := NewLibState()
+	state.SetOptimize(optimize)
+	if err := state.TryDoString(optimizeScript, "optimize"); err != nil {
+		t.Fatal(err)
+	}
+
+	result := GetGlobalValue(state, "result")
+	if result.Type() != ValueTTable {
+		t.Fatal("result is not table")
+	}
+	var items []string
+	for i := 1; ; i++ {
+		v := result.Table().GetValue(NewValueInt(int64(i)))
+		if v.Type() != ValueTString {
+			break
+		}
+		items = append(items, v.Str().GetStdString())
+	}
+	return strings.Join(items, " ")
+}
+
+// Get listing of 'script' with optimizer enabled or not
+func listScript(t *testing.T, script string, optimize bool) string {
+	t.Helper()
+	state := NewState()
+	state.SetOptimize(optimize)
+	if err := state.TryLoadString(script, "optimize"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := state.Disassemble(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestOptimize1(t *testing.T) {
+	expect := "7 3 -4 3.0 -1 1.5 0.5 1024.0 -9223372036854775808 0 9223372036854775807 -1 9" +
+		" -9223372036854775808 a1b1.5 3 true false true false true false" +
+		" nil x 2 false 2,1 3 60 9 25"
+	if result := runOptimizeScript(t, true); result != expect {
+		t.Errorf("optimized result error:\n%s\n%s", result, expect)
+	}
+	if result := runOptimizeScript(t, false); result != expect {
+		t.Errorf("result error:\n%s\n%s", result, expect)
+	}
+}
+
+func TestOptimize2(t *testing.T) {
+	// Constant expressions are folded, division by zero of integers and
+	// bitwise operators of floats are reported at runtime
+	listing := listScript(t, `x = 2 * 3 + 1 y = "a" .. 1`, true)
+	if strings.Contains(listing, "Mul") || strings.Contains(listing, "Concat") ||
+		!strings.Contains(listing, "; 7\n") || !strings.Contains(listing, "; \"a1\"\n") {
+		t.Errorf("constant expressions are not folded:\n%s", listing)
+	}
+
+	state := NewState()
+	for _, script := range []string{"x = 1 // 0", "x = 1 % 0", "x = 1.5 | 1", "x = 1 .. 2"} {
+		if err := state.TryDoString(script, "optimize"); err == nil {
+			t.Errorf("%q should report error", script)
+		}
+	}
+	if err := state.TryDoString("x = 1.0 // 0 y = -1 % 0.0", "optimize"); err != nil {
+		t.Error(err)
+	}
+
+	// Dead code after return and break, redundant moves and jumps are
+	// removed, and the result is a smaller function
+	script := `
+		local a = 0
+		while a < 10 do
+			a = a + 1
+			if a == 5 then break end
+		end
+		return a
+	`
+	optimized := listScript(t, script, true)
+	original := listScript(t, script, false)
+	if len(optimized) >= len(original) || strings.Contains(optimized, "Jmp         \t1\t") {
+		t.Errorf("code is not optimized:\n%s\n%s", optimized, original)
+	}
+	if !strings.Contains(optimized, "\tAdd         \t0 ") {
+		t.Errorf("move is not removed:\n%s", optimized)
+	}
+}
+
+func TestOptimize3(t *testing.T) {
+	// Optimized code can be dumped and loaded
+	state := NewState()
+	if err := state.TryLoadString(optimizeScript, "optimize"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := state.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.TryLoadBinary(&buf, "optimize"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"testing"
+)
+
+func TestProtectedCall1(t *testing.T) {
+	state := NewLibState()
+
+	state.DoString(`
+		local e = {code = 42}
+		ok1, r1 = pcall(function() error(e) end)
+		same = r1 == e
+
+		ok2, inner, msg2 = pcall(function()
+			local ok, m = pcall(error, "inner", 0)
+			return ok, m
+		end)
+
+		ok3, r3 = pcall(function() error("msg") end)
+		local function g() error("level2", 2) end
+		ok4, r4 = pcall(function()
+			g()
+		end)
+		ok5, r5 = pcall(error, "nopos", 0)
+
+		ok6, r6 = xpcall(function() error({}) end, function(err) return "handled" end)
+		ok7, r7 = xpcall(function(a, b) return a + b end, print, 1, 2)
+
+		local function add(a, b) return a + b end
+		for i = 1, 100 do pcall(function() local t = {} error(t) end) end
+		sum = add(1, 2)
+	`, "pcall")
+
+	// Table error value is passed through unchanged
+	if ok := GetGlobalValue(state, "ok1"); !ok.IsFalse() {
+		t.Error("pcall1 error")
+	}
+	if same := GetGlobalValue(state, "same"); same.IsFalse() {
+		t.Error("pcall1 table error value error")
+	}
+
+	// Inner error is caught by the inner pcall only
+	inner := GetGlobalValue(state, "inner")
+	if ok := GetGlobalValue(state, "ok2"); ok.IsFalse() || !inner.IsFalse() {
+		t.Error("pcall1 nested pcall error")
+	}
+	if msg := GetGlobalValue(state, "msg2"); msg.Type() != ValueTString ||
+		msg.Str().GetStdString() != "inner" {
+		t.Error("pcall1 nested pcall error")
+	}
+
+	// Error level selects the position prefix
+	for name, expect := range map[string]string{
+		"r3": "pcall:11: msg", "r4": "pcall:14: level2", "r5": "nopos",
+	} {
+		if r := GetGlobalValue(state, name); r.Type() != ValueTString ||
+			r.Str().GetStdString() != expect {
+			t.Errorf("pcall1 error level error: %s %v", name, r)
+		}
+	}
+
+	// Handler of xpcall transforms the error value
+	ok6 := GetGlobalValue(state, "ok6")
+	if r := GetGlobalValue(state, "r6"); r.Type() != ValueTString ||
+		r.Str().GetStdString() != "handled" || !ok6.IsFalse() {
+		t.Error("pcall1 xpcall error")
+	}
+	ok7 := GetGlobalValue(state, "ok7")
+	if r := GetGlobalValue(state, "r7"); r.Num() != 3 || ok7.IsFalse() {
+		t.Error("pcall1 xpcall error")
+	}
+
+	// Frames and stack are unwound after errors
+	if sum := GetGlobalValue(state, "sum"); sum.Num() != 3 {
+		t.Error("pcall1 unwind error")
+	}
+}
@@ -0,0 +1,293 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestState1(t *testing.T) {
+	state := NewState()
+	err := state.TryDoString("a = \"abc", "state")
+	e, ok := err.(LexError)
+	if !ok {
+		t.Fatal("state1 should be a LexError")
+	}
+	if e.Module != "state" || e.Line != 1 {
+		t.Error("state1 error")
+	}
+}
+
+func TestState2(t *testing.T) {
+	state := NewState()
+	err := state.TryDoString("print(", "state")
+	if _, ok := err.(ParseError); !ok {
+		t.Error("state2 should be a ParseError")
+	}
+
+	// State can be used after error
+	err = state.TryDoString("a = \"abc", "state")
+	if _, ok := err.(LexError); !ok {
+		t.Error("state2 should be a LexError")
+	}
+	if state.GetCurrentCall() != nil {
+		t.Error("state2 error")
+	}
+}
+
+func TestState3(t *testing.T) {
+	state := NewState()
+	err := state.TryDoModule("not_existed_module.lua")
+	if _, ok := err.(OpenFileFail); !ok {
+		t.Error("state3 should be a OpenFileFail")
+	}
+}
+
+func TestState4(t *testing.T) {
+	state := NewState()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := state.TryDoStringContext(ctx, "while true do end", "state")
+	if !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatal("state4 should be ErrDeadlineExceeded")
+	}
+	if e, ok := err.(RuntimeError); !ok || e.Kind != RuntimeErrorKindInterrupt || e.Line != 1 {
+		t.Error("state4 error")
+	}
+
+	// State can be used after interrupted
+	if err = state.TryDoString("a = 1", "state"); err != nil {
+		t.Error(err)
+	}
+	if state.GetCurrentCall() != nil {
+		t.Error("state4 error")
+	}
+}
+
+func TestState5(t *testing.T) {
+	state := NewLibState()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Interrupt error can not be caught by pcall or coroutine.resume
+	err := state.TryDoStringContext(ctx, `
+		while true do
+			pcall(function() while true do end end)
+			coroutine.resume(coroutine.create(function() while true do end end))
+		end
+	`, "state")
+	if !errors.Is(err, ErrCanceled) {
+		t.Error("state5 should be ErrCanceled")
+	}
+	if !state.GetCurrentThread().IsMain() {
+		t.Error("state5 error")
+	}
+}
+
+func TestState6(t *testing.T) {
+	state := NewLibState()
+	state.SetLimits(Limits{MaxInstructions: 10000})
+
+	err := state.TryDoString(`
+		ok = pcall(function() while true do end end)
+		while true do end
+	`, "state")
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Fatal("state6 should be ErrInstructionLimit")
+	}
+	if e := err.(RuntimeError); e.Kind != RuntimeErrorKindLimit || e.Line != 2 {
+		t.Error("state6 error")
+	}
+	if ok := GetGlobalValue(state, "ok"); !ok.IsFalse() {
+		t.Error("state6 error")
+	}
+
+	// Instruction count is reset in each call
+	if err = state.TryDoString("a = 1", "state"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestState7(t *testing.T) {
+	state := NewLibState()
+	state.SetLimits(Limits{MaxCallDepth: 100})
+
+	err := state.TryDoString(`
+		local function f(n) if n == 0 then return 0 end return f(n - 1) + 1 end
+		ok1, r1 = pcall(f, 50)
+		ok2, r2 = pcall(f, 200)
+	`, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := GetGlobalValue(state, "ok1"); ok.IsFalse() {
+		t.Error("state7 error")
+	}
+	if ok := GetGlobalValue(state, "ok2"); !ok.IsFalse() {
+		t.Error("state7 error")
+	}
+	if r := GetGlobalValue(state, "r2"); r.Type() != ValueTString ||
+		r.Str().GetStdString() != "state:2: call depth limit exceeded" {
+		t.Error("state7 error")
+	}
+
+	// Stack size limit
+	state.SetLimits(Limits{MaxStackSize: 1000})
+	err = state.TryDoString(`
+		local function f(n) if n == 0 then return 0 end return f(n - 1) + 1 end
+		f(1000)
+	`, "state")
+	if !errors.Is(err, ErrStackSizeLimit) {
+		t.Error("state7 should be ErrStackSizeLimit")
+	}
+}
+
+func TestState8(t *testing.T) {
+	state := NewLibState()
+
+	// Stack grows on demand until stack overflow
+	err := state.TryDoString(`
+		local function f(n) if n == 0 then return 0 end return f(n - 1) + 1 end
+		a = f(10000)
+		ok, msg = pcall(f, 10000000)
+	`, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTNumber || a.Num() != 10000 {
+		t.Error("state8 error")
+	}
+	if ok := GetGlobalValue(state, "ok"); !ok.IsFalse() {
+		t.Error("state8 error")
+	}
+	if msg := GetGlobalValue(state, "msg"); msg.Type() != ValueTString ||
+		msg.Str().GetStdString() != "state:2: stack overflow" {
+		t.Error("state8 error")
+	}
+}
+
+func TestState9(t *testing.T) {
+	state := NewLibState()
+	state.SetLimits(Limits{MaxObjects: 1000})
+
+	// Garbage is collected before the limit is exceeded
+	err := state.TryDoString(`
+		for i = 1, 100000 do local t = {} end
+	`, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = state.TryDoString(`
+		local t = {}
+		for i = 1, 100000 do t[i] = {} end
+	`, "state")
+	if !errors.Is(err, ErrObjectLimit) {
+		t.Fatal("state9 should be ErrObjectLimit")
+	}
+	if e := err.(RuntimeError); e.Kind != RuntimeErrorKindLimit {
+		t.Error("state9 error")
+	}
+}
+
+func TestState10(t *testing.T) {
+	state := NewLibState()
+
+	// Error raised by script carries the traceback
+	err := state.TryDoString(`
+		local function f() error("boom") end
+		local function g() f() end
+		g()
+	`, "state")
+	e, ok := err.(ScriptError)
+	if !ok {
+		t.Fatal("state10 should be a ScriptError")
+	}
+	if len(e.Traceback) != 4 || !e.Traceback[0].IsGoFunction ||
+		e.Traceback[1].Line != 2 || e.Traceback[2].Line != 3 ||
+		!e.Traceback[3].IsMainChunk || e.Traceback[3].Line != 4 {
+		t.Errorf("state10 traceback error: %v", e.Traceback)
+	}
+	if !strings.HasPrefix(e.StackTrace(), "state:2: boom\nstack traceback:\n\t[Go function]") {
+		t.Errorf("state10 stack trace error: %s", e.StackTrace())
+	}
+
+	// Runtime error carries the traceback too
+	err = state.TryDoString(`
+		local function f() local t t.x = 1 end
+		f()
+	`, "state")
+	r, ok := err.(RuntimeError)
+	if !ok {
+		t.Fatal("state10 should be a RuntimeError")
+	}
+	if len(r.Traceback) != 2 || r.Traceback[0].Line != 2 || !r.Traceback[1].IsMainChunk {
+		t.Errorf("state10 traceback error: %v", r.Traceback)
+	}
+}
+
+func TestState11(t *testing.T) {
+	state := NewLibState()
+	lib := NewLibrary(state)
+	lib.RegisterFunc("newobj", func(state *State) int {
+		api := NewStackAPI(state)
+		api.PushUserData(state.NewUserDataValue(nil, api.GetTable(0)))
+		return 1
+	})
+	state.SetLimits(Limits{MaxObjects: 1000})
+
+	// Objects kept by pending finalizers are released before the limit
+	// is checked again
+	err := state.TryDoString(`
+		collectgarbage("stop")
+		finalized = 0
+		local function gc() finalized = finalized + 1 end
+		for i = 1, 300 do
+			newobj({__gc = gc, data = {{}, {}, {}}})
+		end
+		collectgarbage("restart")
+	`, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finalized := GetGlobalValue(state, "finalized"); finalized.Num() == 0 {
+		t.Error("state11 finalizer error")
+	}
+
+	// No collection is run for instructions which do not allocate,
+	// though the limit is exceeded, and next allocation fails
+	var collections []uint
+	lib.RegisterFunc("setlimit", func(state *State) int {
+		state.SetLimits(Limits{MaxObjects: 1000})
+		return 0
+	})
+	lib.RegisterFunc("mark", func(state *State) int {
+		collections = append(collections, state.GetGC().Stats().MajorCollections)
+		return 0
+	})
+	state.SetLimits(Limits{})
+	err = state.TryDoString(`
+		keep = {}
+		for i = 1, 2000 do keep[i] = {} end
+		setlimit()
+		mark()
+		local n = 0
+		for i = 1, 10000 do n = n + i end
+		mark()
+		sum = n
+	`, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) != 2 || collections[0] != collections[1] {
+		t.Errorf("state11 collections without allocation: %v", collections)
+	}
+	err = state.TryDoString(`keep[1] = {}`, "state")
+	if !errors.Is(err, ErrObjectLimit) {
+		t.Error("state11 should be ErrObjectLimit")
+	}
+}
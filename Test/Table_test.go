@@ -1 +1,154 @@
 package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestTable1(t *testing.T) {
+	state := NewState()
+	table := NewTable()
+
+	// Numeric keys
+	table.SetValue(NewValueNum(1.5), NewValueNum(1))
+	table.SetValue(NewValueNum(math.Copysign(0, -1)), NewValueNum(2))
+	if v := table.GetValue(NewValueNum(1.5)); v.Num() != 1 {
+		t.Error("table1 error")
+	}
+	if v := table.GetValue(NewValueNum(0)); v.Num() != 2 {
+		t.Error("table1 error")
+	}
+
+	// NaN and nil keys are ignored
+	table.SetValue(NewValueNum(math.NaN()), NewValueNum(3))
+	table.SetValue(Value{}, NewValueNum(3))
+	if v := table.GetValue(NewValueNum(math.NaN())); !v.IsNil() {
+		t.Error("table1 error")
+	}
+
+	// Objects are identified by address
+	t1, t2 := NewTable(), NewTable()
+	table.SetValue(NewValueTable(t1), NewValueNum(4))
+	if v := table.GetValue(NewValueTable(t1)); v.Num() != 4 {
+		t.Error("table1 error")
+	}
+	if v := table.GetValue(NewValueTable(t2)); !v.IsNil() {
+		t.Error("table1 error")
+	}
+
+	// Strings are compared by content
+	table.SetValue(NewValueString(state.GetString("name")), NewValueNum(5))
+	if v := table.GetValue(NewValueString(NewString("name"))); v.Num() != 5 {
+		t.Error("table1 error")
+	}
+
+	// Insert and remove a lot of string keys
+	for i := 0; i < 1000; i++ {
+		key := NewValueString(state.GetString("key" + strconv.Itoa(i)))
+		table.SetValue(key, NewValueNum(float64(i)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		key := NewValueString(state.GetString("key" + strconv.Itoa(i)))
+		table.SetValue(key, Value{})
+	}
+	for i := 0; i < 1000; i++ {
+		key := NewValueString(state.GetString("key" + strconv.Itoa(i)))
+		v := table.GetValue(key)
+		if (i%2 == 0 && !v.IsNil()) || (i%2 == 1 && v.Num() != float64(i)) {
+			t.Fatal("table1 error")
+		}
+	}
+
+	// Keys in hash part are moved to array part
+	table.SetValue(NewValueNum(2), NewValueNum(2))
+	table.SetValue(NewValueNum(1), NewValueNum(1))
+	if table.ArraySize() != 2 {
+		t.Error("table1 error")
+	}
+}
+
+func TestTable2(t *testing.T) {
+	state := NewLibState()
+
+	err := state.TryDoString(`
+		local t = {}
+		ok1, msg1 = pcall(function() t[nil] = 1 end)
+		ok2, msg2 = pcall(function() t[0/0] = 1 end)
+		t[1.0] = "a"
+		t[2^53] = "b"
+		a, b = t[1], t[2^53]
+		for i = 1, 2000 do t[{}] = i; t["s" .. i] = i end
+		c = t.s2000
+	`, "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := GetGlobalValue(state, "msg1"); msg.Type() != ValueTString ||
+		msg.Str().GetStdString() != "table:3: table index is nil" {
+		t.Error("table2 error")
+	}
+	if msg := GetGlobalValue(state, "msg2"); msg.Type() != ValueTString ||
+		msg.Str().GetStdString() != "table:4: table index is NaN" {
+		t.Error("table2 error")
+	}
+	if a := GetGlobalValue(state, "a"); a.Type() != ValueTString || a.Str().GetStdString() != "a" {
+		t.Error("table2 error")
+	}
+	if b := GetGlobalValue(state, "b"); b.Type() != ValueTString || b.Str().GetStdString() != "b" {
+		t.Error("table2 error")
+	}
+	if c := GetGlobalValue(state, "c"); c.Num() != 2000 {
+		t.Error("table2 error")
+	}
+}
+
+func TestTable3(t *testing.T) {
+	state := NewLibState()
+
+	err := state.TryDoString(`
+		local t = {10, 20, z = 1, y = 2, x = 3}
+		t.w = 4
+		t.y = nil
+		t.y = 5
+
+		order = ""
+		for k, v in pairs(t) do order = order .. k .. "=" .. v .. " " end
+
+		count = 0
+		for k, v in pairs(t) do
+			count = count + 1
+			if type(k) == "string" then t[k] = nil else t[k] = v + 1 end
+		end
+		rest = next(t, 2)
+
+		empty = next({})
+		ok, msg = pcall(next, t, "missing")
+	`, "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order := GetGlobalValue(state, "order"); order.Type() != ValueTString ||
+		order.Str().GetStdString() != "1=10 2=20 z=1 y=5 x=3 w=4 " {
+		t.Error("table3 error")
+	}
+	if count := GetGlobalValue(state, "count"); count.Num() != 6 {
+		t.Error("table3 error")
+	}
+	if rest := GetGlobalValue(state, "rest"); !rest.IsNil() {
+		t.Error("table3 error")
+	}
+	if empty := GetGlobalValue(state, "empty"); !empty.IsNil() {
+		t.Error("table3 error")
+	}
+	if ok := GetGlobalValue(state, "ok"); !ok.IsFalse() {
+		t.Error("table3 error")
+	}
+	if msg := GetGlobalValue(state, "msg"); msg.Type() != ValueTString ||
+		msg.Str().GetStdString() != "invalid key to 'next'" {
+		t.Error("table3 error")
+	}
+}
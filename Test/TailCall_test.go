@@ -0,0 +1,80 @@
+package Test
+
+import (
+	. "InterpreterVM/Source/vm"
+	"strings"
+	"testing"
+)
+
+func TestTailCall1(t *testing.T) {
+	state := NewLibState()
+	state.SetLimits(Limits{MaxCallDepth: 50})
+
+	// Tail calls run in constant stack, they are not limited by call depth
+	err := state.TryDoString(`
+		local function loop(n, acc) if n == 0 then return acc end return loop(n - 1, acc + 1) end
+		a = loop(1000000, 0)
+		local t = {}
+		function t:even(n) if n == 0 then return true end return self:odd(n - 1) end
+		function t:odd(n) if n == 0 then return false end return self:even(n - 1) end
+		b = t:even(100001)
+		local function va(x, y, z, ...) return z, y, x, ... end
+		local function tv(...) return va(...) end
+		c1, c2, c3, c4, c5 = tv(1, nil, 3, 4, 5)
+		local function up(n) local x = n local f = function() return x end if n == 0 then return f end return up(n - 1) end
+		local f = up(5)
+		d = f()
+		local ct = setmetatable({}, {__call = function(self, v) return v * 2 end})
+		local function callt(v) return ct(v) end
+		e = callt(21)
+		local function cf(v) return tostring(v) end
+		s = cf(12)
+		local function pf(n) if n == 0 then return n end return (pf)(n - 1) end
+		g = pf(1000)
+		local pt = {}
+		function pt.m(n) if n == 0 then return n end return (pt).m(n - 1) end
+		h = pt.m(1000)
+	`, "tailcall")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expects := map[string]Value{
+		"a": NewValueInt(1000000), "b": NewValueBValue(false),
+		"c1": NewValueInt(3), "c2": NewValueObj(), "c3": NewValueInt(1),
+		"c4": NewValueInt(4), "c5": NewValueInt(5),
+		"d": NewValueInt(0), "e": NewValueInt(42),
+		"g": NewValueInt(0), "h": NewValueInt(0),
+	}
+	for name, expect := range expects {
+		if v := GetGlobalValue(state, name); !v.IsEqual(&expect) {
+			t.Errorf("%s error: %v", name, v)
+		}
+	}
+	if s := GetGlobalValue(state, "s"); s.Type() != ValueTString || s.Str().GetStdString() != "12" {
+		t.Error("s error")
+	}
+
+	// Calls which are not tail calls are still limited
+	err = state.TryDoString(`
+		local function f(n) if n == 0 then return 0 end return (f(n - 1)) end
+		f(100)
+	`, "tailcall")
+	if err == nil {
+		t.Error("call depth limit error")
+	}
+}
+
+func TestTailCall2(t *testing.T) {
+	listing := listScript(t, `
+		local function f(x) return x end
+		local function g(x) return f(x) end
+		local function h(x) return (f(x)) end
+		local function k(x) return f(x) + 1 end
+		local function m(x) return (f)(x) end
+		local function n(x) return ((f)(x)) end
+	`, true)
+	if strings.Count(listing, "TailCall") != 2 {
+		t.Errorf("tail call error:\n%s", listing)
+	}
+}